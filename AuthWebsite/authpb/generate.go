@@ -0,0 +1,5 @@
+// Package authpb holds the protobuf messages and gRPC stubs of the AuthWebsite
+// authentication service.
+package authpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative auth.proto
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type profile struct {
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email"`
+	AvatarURL   string `json:"avatar_url"`
+	Locale      string `json:"locale"`
+	Timezone    string `json:"timezone"`
+}
+
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+func loadProfile(username string) (profile, error) {
+	var p profile
+	err := db.QueryRow("SELECT display_name, email, avatar_url, locale, timezone FROM users WHERE username = ?", username).
+		Scan(&p.DisplayName, &p.Email, &p.AvatarURL, &p.Locale, &p.Timezone)
+	return p, err
+}
+
+// validate checks the fields a user can set; empty values clear a field and are always allowed.
+func (p profile) validate() error {
+	if len(p.DisplayName) > 255 {
+		return fmt.Errorf("display_name is too long")
+	}
+	if p.Email != "" {
+		if addr, err := mail.ParseAddress(p.Email); err != nil || addr.Address != p.Email {
+			return fmt.Errorf("email is not a valid address")
+		}
+	}
+	if p.AvatarURL != "" {
+		u, err := url.Parse(p.AvatarURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("avatar_url must be an http(s) URL")
+		}
+	}
+	if p.Locale != "" && !localePattern.MatchString(p.Locale) {
+		return fmt.Errorf("locale must be a language tag such as en-US")
+	}
+	if p.Timezone != "" {
+		if _, err := time.LoadLocation(p.Timezone); err != nil {
+			return fmt.Errorf("timezone must be an IANA zone such as Europe/Berlin")
+		}
+	}
+	return nil
+}
+
+// updateProfileHandler applies a partial update: only fields present in the body change.
+func updateProfileHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		DisplayName *string `json:"display_name"`
+		Email       *string `json:"email"`
+		AvatarURL   *string `json:"avatar_url"`
+		Locale      *string `json:"locale"`
+		Timezone    *string `json:"timezone"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	p, err := loadProfile(username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	oldEmail := p.Email
+	for _, f := range []struct {
+		dst *string
+		src *string
+	}{
+		{&p.DisplayName, data.DisplayName},
+		{&p.Email, data.Email},
+		{&p.AvatarURL, data.AvatarURL},
+		{&p.Locale, data.Locale},
+		{&p.Timezone, data.Timezone},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	if err := p.validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// An address the user typed in is not proven, so it no longer counts as verified.
+	_, err = db.Exec(`UPDATE users SET display_name = ?, email = ?, avatar_url = ?, locale = ?, timezone = ?,
+            email_verified = email_verified AND ? WHERE username = ?`,
+		p.DisplayName, p.Email, p.AvatarURL, p.Locale, p.Timezone, p.Email == oldEmail, username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(username, "profile_update", c.IP(), "")
+	return c.JSON(fiber.Map{"message": "Profile updated", "profile": p})
+}
+
+// checkPassword re-authenticates username for sensitive actions against the same
+// backends as loginHandler.
+func checkPassword(username, password string) error {
+	id, err := authenticate(context.Background(), authChain, username, password)
+	if err == nil && id.Username != username {
+		err = errInvalidCredentials
+	}
+	return err
+}
+
+// reauthWindow is how long a sign-in at a provider through ?reauth=1 stands in for
+// the password.
+const reauthWindow = 5 * time.Minute
+
+// reauthenticate confirms the caller of a sensitive action. Without a password, a
+// fresh sign-in at one of the account's providers will do, which is the only way
+// for accounts that have no password.
+func reauthenticate(c *fiber.Ctx, username, password string) error {
+	if password == "" && takeReauthentication(c.Locals("token").(string), reauthWindow) {
+		return nil
+	}
+	return checkPassword(username, password)
+}
+
+func changeUsernameHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		NewUsername string `json:"new_username"`
+		Password    string `json:"password"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.NewUsername == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if err := reauthenticate(c, username, data.Password); err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	// Directory accounts are matched by name on every login, so renaming would orphan them.
+	var source string
+	if err := db.QueryRow("SELECT auth_source FROM users WHERE username = ?", username).Scan(&source); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if source != "local" {
+		return c.Status(403).JSON(fiber.Map{"error": "Username is managed by your directory"})
+	}
+
+	newName, err := normalizeUsername(data.NewUsername)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid username"})
+	}
+	data.NewUsername = newName
+	if status, msg := usernameRejection(checkNewUsername(newName, username)); status != 0 {
+		return c.Status(status).JSON(fiber.Map{"error": msg})
+	}
+
+	// Only a change of case or width may map to the caller's own key.
+	var exists int
+	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE username_canonical = ? AND username <> ?", usernameKey(newName), username).Scan(&exists)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if exists > 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Username is already taken"})
+	}
+	// The unique index still guards against a concurrent rename to the same name.
+	if err := renameUser(username, data.NewUsername); err != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "Username is already taken"})
+	}
+	audit(data.NewUsername, "username_change", c.IP(), "from "+username)
+	return c.JSON(fiber.Map{"message": "Username changed", "username": data.NewUsername})
+}
+
+// deleteAccount erases the account and logs out its sessions.
+func deleteAccount(id int64, username string) error {
+	if err := deleteUserData(id, username); err != nil {
+		return err
+	}
+	revokeUserSessions(username)
+	renameAuditUser(username, anonymizedName(id), true)
+	audit(anonymizedName(id), "account_delete", "", "")
+	emitEvent(eventUserDeleted, fiber.Map{"username": username})
+	return nil
+}
+
+// deleteAccountHandler removes the caller's account after re-authentication. The
+// users row is deleted and rows that must be kept for other users, like the audit
+// trail, are anonymized.
+func deleteAccountHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if err := reauthenticate(c, username, data.Password); err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	orgs, err := soleOwnerOrgs(username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if len(orgs) > 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Transfer ownership of your organizations first", "organizations": orgs})
+	}
+
+	var id int64
+	if err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if err := deleteAccount(id, username); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     "session_token",
+		Value:    "",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		HTTPOnly: true,
+		Secure:   secureCookies,
+	})
+	return c.JSON(fiber.Map{"message": "Account deleted"})
+}
+
+// usernameRefs lists the columns outside users that refer to an account by name.
+var usernameRefs = []struct{ table, column string }{
+	{"sessions", "username"},
+	{"sessions", "impersonator"},
+	{"invitations", "created_by"},
+	{"data_exports", "username"},
+	{"data_exports", "pending_for"},
+	{"webauthn_credentials", "username"},
+	{"user_identities", "username"},
+	{"refresh_token_families", "username"},
+	{"organizations", "created_by"},
+	{"org_memberships", "username"},
+	{"org_invitations", "invitee_username"},
+	{"org_invitations", "invited_by"},
+	{"scim_group_members", "username"},
+	{"known_devices", "username"},
+	{"device_alerts", "username"},
+	{"password_history", "username"},
+	{"policy_documents", "created_by"},
+	{"policy_acceptances", "username"},
+}
+
+// renameUser renames an account along with its live sessions and queued audit entries.
+func renameUser(oldName, newName string) error {
+	if err := renameUserData(oldName, newName); err != nil {
+		return err
+	}
+	renameSessionUser(oldName, newName)
+	renameAuditUser(oldName, newName, false)
+	return nil
+}
+
+// renameUserData renames the account and every row that refers to it by name.
+func renameUserData(oldName, newName string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	key := usernameKey(newName)
+	_, err = tx.Exec("UPDATE users SET username = ?, username_canonical = ?, username_skeleton = ? WHERE username = ?",
+		newName, key, usernameSkeleton(key), oldName)
+	if err != nil {
+		return err
+	}
+	for _, ref := range usernameRefs {
+		if _, err := tx.Exec("UPDATE "+ref.table+" SET "+ref.column+" = ? WHERE "+ref.column+" = ?", newName, oldName); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func anonymizedName(id int64) string {
+	return fmt.Sprintf("deleted-user-%d", id)
+}
+
+// deleteUserData removes the user row and anonymizes the rows that reference it. The
+// audit trail is anonymized separately through the audit queue.
+func deleteUserData(id int64, username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	anon := anonymizedName(id)
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{"DELETE FROM users WHERE id = ?", []any{id}},
+		{"DELETE FROM sessions WHERE username = ? OR impersonator = ?", []any{username, username}},
+		{"DELETE FROM data_exports WHERE username = ?", []any{username}},
+		{"DELETE FROM webauthn_credentials WHERE username = ?", []any{username}},
+		{"DELETE FROM user_identities WHERE username = ?", []any{username}},
+		{"DELETE FROM refresh_tokens WHERE family_id IN (SELECT id FROM refresh_token_families WHERE username = ?)", []any{username}},
+		{"DELETE FROM refresh_token_families WHERE username = ?", []any{username}},
+		{"UPDATE invitations SET created_by = ? WHERE created_by = ?", []any{anon, username}},
+		{"DELETE FROM scim_group_members WHERE username = ?", []any{username}},
+		{"DELETE FROM known_devices WHERE username = ?", []any{username}},
+		{"DELETE FROM device_alerts WHERE username = ?", []any{username}},
+		{"DELETE FROM password_history WHERE username = ?", []any{username}},
+		{"DELETE FROM policy_acceptances WHERE username = ?", []any{username}},
+		{"UPDATE policy_documents SET created_by = ? WHERE created_by = ?", []any{anon, username}},
+		{"DELETE FROM org_memberships WHERE username = ?", []any{username}},
+		{"DELETE FROM org_invitations WHERE invitee_username = ?", []any{username}},
+		{"UPDATE org_invitations SET invited_by = ? WHERE invited_by = ?", []any{anon, username}},
+		{"UPDATE organizations SET created_by = ? WHERE created_by = ?", []any{anon, username}},
+		// Organizations the user was alone in go with the account.
+		{"DELETE FROM org_invitations WHERE org_id NOT IN (SELECT org_id FROM org_memberships)", nil},
+		{"DELETE FROM organizations WHERE id NOT IN (SELECT org_id FROM org_memberships)", nil},
+	} {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
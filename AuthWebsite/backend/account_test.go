@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestUpdateProfile(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+
+	decode(t, request(t, "PATCH", "/api/profile", fiber.Map{"display_name": "Ada", "locale": "en-GB", "timezone": "Europe/London"}, cookie), 200)
+	// Fields missing from the body keep their values.
+	decode(t, request(t, "PATCH", "/api/profile", fiber.Map{"avatar_url": "https://example.com/ada.png"}, cookie), 200)
+	p := decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)["profile"].(map[string]any)
+	if p["display_name"] != "Ada" || p["locale"] != "en-GB" || p["timezone"] != "Europe/London" || p["avatar_url"] != "https://example.com/ada.png" {
+		t.Errorf("profile = %v", p)
+	}
+
+	for _, body := range []fiber.Map{
+		{"email": "Ada <ada@example.com>"},
+		{"avatar_url": "javascript:alert(1)"},
+		{"locale": "english"},
+		{"timezone": "Mars/Olympus_Mons"},
+	} {
+		decode(t, request(t, "PATCH", "/api/profile", body, cookie), 400)
+	}
+
+	// An empty value clears a field.
+	decode(t, request(t, "PATCH", "/api/profile", fiber.Map{"display_name": ""}, cookie), 200)
+	if p, err := loadProfile(username); err != nil || p.DisplayName != "" || p.Locale != "en-GB" {
+		t.Errorf("profile = %+v (%v)", p, err)
+	}
+}
+
+func TestChangeUsername(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+	taken := newUsername()
+	register(t, taken, "correct horse")
+
+	newName := newUsername()
+	decode(t, request(t, "POST", "/api/profile/username", fiber.Map{"new_username": newName, "password": "wrong"}, cookie), 401)
+	decode(t, request(t, "POST", "/api/profile/username", fiber.Map{"new_username": taken, "password": "correct horse"}, cookie), 409)
+	decode(t, request(t, "POST", "/api/profile/username", fiber.Map{"new_username": "", "password": "correct horse"}, cookie), 400)
+
+	data := decode(t, request(t, "POST", "/api/profile/username", fiber.Map{"new_username": newName, "password": "correct horse"}, cookie), 200)
+	if data["username"] != newName {
+		t.Errorf("rename = %v", data)
+	}
+	// The session follows the account, and the old name is free again.
+	if got := decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)["username"]; got != newName {
+		t.Errorf("session belongs to %v, want %s", got, newName)
+	}
+	login(t, newName, "correct horse")
+	decode(t, request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "correct horse"}), 401)
+	register(t, username, "another password")
+}
+
+func TestChangeUsernameDirectoryAccount(t *testing.T) {
+	dir := newFakeDirectory()
+	ldapUser := newUsername()
+	dir.addUser(ldapUser, "directory password", map[string][]string{})
+	saved := authChain
+	authChain = []Authenticator{dir.authenticator(t), localAuthenticator{}}
+	t.Cleanup(func() { authChain = saved })
+
+	cookie := login(t, ldapUser, "directory password")
+	resp := request(t, "POST", "/api/profile/username", fiber.Map{"new_username": newUsername(), "password": "directory password"}, cookie)
+	if data := decode(t, resp, 403); data["error"] != "Username is managed by your directory" {
+		t.Errorf("rename of a directory account: %v", data)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+	other := login(t, username, "correct horse")
+
+	decode(t, request(t, "DELETE", "/api/account", fiber.Map{"password": "wrong"}, cookie), 401)
+	decode(t, request(t, "DELETE", "/api/account", fiber.Map{"password": "correct horse"}, cookie), 200)
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&n); err != nil || n != 0 {
+		t.Errorf("%d users rows left (%v)", n, err)
+	}
+	// Every session of the account is signed out.
+	decode(t, request(t, "GET", "/api/profile", nil, other), 401)
+	decode(t, request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "correct horse"}), 401)
+}
+
+func TestDeleteAccountSoleOrgOwner(t *testing.T) {
+	slug, owner := newOrg(t)
+	member := newUsername()
+	register(t, member, "correct horse")
+	inv := decode(t, request(t, "POST", "/api/orgs/current/invitations", fiber.Map{"username": member}, owner), 201)
+	decode(t, request(t, "POST", "/api/orgs/invitations/"+inv["id"].(string)+"/accept", nil, login(t, member, "correct horse")), 200)
+
+	data := decode(t, request(t, "DELETE", "/api/account", fiber.Map{"password": "correct horse"}, owner), 409)
+	if orgs, _ := data["organizations"].([]any); len(orgs) != 1 || orgs[0] != slug {
+		t.Errorf("conflict = %v", data)
+	}
+
+	// Once the owner is alone, the organization goes with the account.
+	decode(t, request(t, "DELETE", "/api/orgs/current/members/"+member, nil, owner), 200)
+	decode(t, request(t, "DELETE", "/api/account", fiber.Map{"password": "correct horse"}, owner), 200)
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM organizations WHERE slug = ?", slug).Scan(&n); err != nil || n != 0 {
+		t.Errorf("%d organizations left (%v)", n, err)
+	}
+}
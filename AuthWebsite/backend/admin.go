@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// adminMiddleware must run after authMiddleware and rejects callers without the admin role.
+func adminMiddleware(c *fiber.Ctx) error {
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE username = ?", c.Locals("username").(string)).Scan(&role)
+	if err != nil || role != "admin" {
+		return c.Status(403).JSON(fiber.Map{"error": "Forbidden"})
+	}
+	return c.Next()
+}
+
+// bootstrapAdmins grants the admin role to the comma-separated usernames in AUTH_ADMIN_USERS.
+func bootstrapAdmins() error {
+	for _, username := range strings.Split(envOr("AUTH_ADMIN_USERS", ""), ",") {
+		username = strings.TrimSpace(username)
+		if username == "" {
+			continue
+		}
+		username = resolveUsername(username)
+		if _, err := db.Exec("UPDATE users SET role = 'admin' WHERE username = ?", username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type auditEntry struct {
+	CreatedAt time.Time
+	Username  string
+	Action    string
+	IP        string
+	Detail    string
+
+	// renameTo, when set, rewrites Username's existing entries instead of inserting one.
+	renameTo string
+	dropIP   bool
+}
+
+var (
+	auditQueue  = make(chan auditEntry, 1024)
+	auditMu     sync.RWMutex // guards auditClosed against concurrent sends
+	auditClosed bool
+	auditDone   sync.WaitGroup
+)
+
+// audit records a security-relevant event. Entries are written to the audit_log
+// table in the background so handlers never wait on the insert.
+func audit(username, action, ip, detail string) {
+	entry := auditEntry{CreatedAt: time.Now(), Username: username, Action: action, IP: ip, Detail: detail}
+	auditMu.RLock()
+	defer auditMu.RUnlock()
+	if auditClosed {
+		log.Printf("audit log closed, dropping %s event for %q", action, username)
+		return
+	}
+	select {
+	case auditQueue <- entry:
+	default:
+		log.Printf("audit queue full, dropping %s event for %q", action, username)
+	}
+}
+
+// renameAuditUser moves every audit entry of oldName to newName, including entries
+// still waiting in the queue. dropIP also clears the recorded addresses.
+func renameAuditUser(oldName, newName string, dropIP bool) {
+	auditMu.RLock()
+	defer auditMu.RUnlock()
+	if !auditClosed {
+		auditQueue <- auditEntry{Username: oldName, renameTo: newName, dropIP: dropIP}
+	}
+}
+
+func startAuditWriter() {
+	auditDone.Add(1)
+	go func() {
+		defer auditDone.Done()
+		for e := range auditQueue {
+			if e.renameTo != "" {
+				query := "UPDATE audit_log SET username = ? WHERE username = ?"
+				if e.dropIP {
+					query = "UPDATE audit_log SET username = ?, ip = '' WHERE username = ?"
+				}
+				if _, err := db.Exec(query, e.renameTo, e.Username); err != nil {
+					log.Println("audit:", err)
+				}
+				continue
+			}
+			_, err := db.Exec("INSERT INTO audit_log (created_at, username, action, ip, detail) VALUES (?, ?, ?, ?, ?)",
+				e.CreatedAt, e.Username, e.Action, e.IP, e.Detail)
+			if err != nil {
+				log.Println("audit:", err)
+			}
+		}
+	}()
+}
+
+// flushAudit stops accepting entries and waits until the queue has been written.
+func flushAudit() {
+	auditMu.Lock()
+	if !auditClosed {
+		auditClosed = true
+		close(auditQueue)
+	}
+	auditMu.Unlock()
+	auditDone.Wait()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Errors returned by an Authenticator. errUnknownUser and errBackendUnavailable
+// let the chain fall through to the next backend; errInvalidCredentials stops it.
+var (
+	errUnknownUser        = errors.New("unknown user")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errBackendUnavailable = errors.New("authentication backend unavailable")
+	errAccountDisabled    = errors.New("account is disabled")
+
+	errPasswordResetRequired = errors.New("password reset required")
+	errPasswordExpired       = errors.New("password expired")
+)
+
+// Identity is a user as vouched for by an authentication backend.
+type Identity struct {
+	Username    string
+	Source      string // value stored in users.auth_source
+	Role        string // empty leaves the stored role untouched
+	Email       string
+	DisplayName string
+}
+
+// Authenticator checks a username/password pair against one user store.
+type Authenticator interface {
+	Name() string
+	Authenticate(ctx context.Context, username, password string) (Identity, error)
+}
+
+// localAuthenticator checks the bcrypt hashes in the users table. Users provisioned
+// from another backend have no usable hash and are left to that backend.
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string { return "local" }
+
+func (localAuthenticator) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	var storedHash, source string
+	var resetRequired bool
+	err := db.QueryRowContext(ctx, "SELECT password_hash, auth_source, password_reset_required FROM users WHERE username = ?", username).
+		Scan(&storedHash, &source, &resetRequired)
+	if err == sql.ErrNoRows || (err == nil && source != "local") {
+		return Identity{}, errUnknownUser
+	} else if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", errBackendUnavailable, err)
+	}
+
+	// Verify password
+	if err := comparePassword(storedHash, password); err != nil {
+		return Identity{}, errInvalidCredentials
+	}
+	// The password may be known to whoever the user reported through a device alert.
+	if resetRequired {
+		return Identity{}, errPasswordResetRequired
+	}
+	return Identity{Username: username, Source: "local"}, nil
+}
+
+// authChain is tried in order by loginHandler.
+var authChain []Authenticator
+
+// loadAuthChain builds the chain from AUTH_AUTHENTICATORS, e.g. "ldap,local".
+func loadAuthChain() ([]Authenticator, error) {
+	var chain []Authenticator
+	for _, name := range strings.Split(envOr("AUTH_AUTHENTICATORS", "local"), ",") {
+		switch strings.TrimSpace(name) {
+		case "local":
+			chain = append(chain, localAuthenticator{})
+		case "ldap":
+			a, err := newLDAPAuthenticator(loadLDAPConfig())
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, a)
+		default:
+			return nil, fmt.Errorf("unknown authenticator %q", name)
+		}
+	}
+	return chain, nil
+}
+
+// authenticate walks the chain until a backend accepts or definitively rejects the
+// credentials. A username matching an account's canonical key is replaced by its
+// stored spelling first. Unknown users and unreachable backends fall through to the next one.
+func authenticate(ctx context.Context, chain []Authenticator, username, password string) (Identity, error) {
+	username = resolveUsername(username)
+	lastErr := errUnknownUser
+	for _, a := range chain {
+		id, err := a.Authenticate(ctx, username, password)
+		switch {
+		case err == nil:
+			return id, nil
+		case errors.Is(err, errUnknownUser):
+			continue
+		case errors.Is(err, errBackendUnavailable):
+			log.Printf("authenticator %s: %v", a.Name(), err)
+			lastErr = err
+			continue
+		default:
+			return Identity{}, err
+		}
+	}
+	return Identity{}, lastErr
+}
+
+// checkAccountActive returns errAccountDisabled for accounts deactivated through SCIM.
+func checkAccountActive(username string) error {
+	var active bool
+	if err := db.QueryRow("SELECT active FROM users WHERE username = ?", username).Scan(&active); err != nil {
+		return err
+	}
+	if !active {
+		return errAccountDisabled
+	}
+	return nil
+}
+
+// checkSignIn is checkAccountActive plus the password reset a user asked for through
+// a device alert, which holds for every sign-in method until a new password is set.
+func checkSignIn(username string) error {
+	if err := checkAccountActive(username); err != nil {
+		return err
+	}
+	var resetRequired bool
+	if err := db.QueryRow("SELECT password_reset_required FROM users WHERE username = ?", username).Scan(&resetRequired); err != nil {
+		return err
+	}
+	if resetRequired {
+		return errPasswordResetRequired
+	}
+	return nil
+}
+
+// checkAccountUsable is checkSignIn plus the expiry check that a sign-in without the
+// password, such as a token refresh, must still pass.
+func checkAccountUsable(username string) error {
+	if err := checkSignIn(username); err != nil {
+		return err
+	}
+	expired, err := passwordExpired(username)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return errPasswordExpired
+	}
+	return nil
+}
+
+// provisionUser creates or refreshes the users row of an externally authenticated
+// identity. It refuses to take over an account that belongs to another source.
+func provisionUser(id Identity) error {
+	if id.Source == "local" {
+		return nil
+	}
+	var source string
+	err := db.QueryRow("SELECT auth_source FROM users WHERE username = ?", id.Username).Scan(&source)
+	switch {
+	case err == sql.ErrNoRows:
+		role := id.Role
+		if role == "" {
+			role = "user"
+		}
+		// The "!" hash can never match a bcrypt comparison.
+		key := usernameKey(id.Username)
+		_, err = db.Exec(`INSERT INTO users (username, username_canonical, username_skeleton, password_hash, role, auth_source, email, display_name)
+                VALUES (?, ?, ?, '!', ?, ?, ?, ?)`, id.Username, key, usernameSkeleton(key), role, id.Source, id.Email, id.DisplayName)
+		if err == nil {
+			emitEvent(eventUserRegistered, fiber.Map{"username": id.Username, "source": id.Source})
+		}
+		return err
+	case err != nil:
+		return err
+	case source != id.Source:
+		return fmt.Errorf("user %q already exists with auth source %q", id.Username, source)
+	}
+
+	if id.Role != "" {
+		_, err = db.Exec("UPDATE users SET role = ?, email = ?, display_name = ? WHERE username = ?",
+			id.Role, id.Email, id.DisplayName, id.Username)
+	} else {
+		_, err = db.Exec("UPDATE users SET email = ?, display_name = ? WHERE username = ?",
+			id.Email, id.DisplayName, id.Username)
+	}
+	return err
+}
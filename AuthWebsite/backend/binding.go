@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Browser sessions remember the client that signed in: its address and the family
+// of its user agent (browser and operating system, without versions, so updates do
+// not count as a change). AUTH_SESSION_BINDING decides what happens when the session
+// cookie shows up with a different fingerprint:
+//
+//	off      nothing is checked
+//	monitor  changes are audited, nothing is blocked
+//	lenient  a new /16 network asks for the password again (step-up), another browser revokes
+//	strict   any change of browser or /24 network revokes
+//
+// A token used alternately from two fingerprints within AUTH_SESSION_DIVERGENCE_WINDOW
+// is taken to be in two hands at once; lenient and strict revoke it, monitor audits it.
+// API access tokens are bound the same way to the client that fetched them from the
+// token endpoint. Refresh tokens are not bound; their reuse is detected separately.
+
+const (
+	stepUpPath          = "/api/session/step-up"
+	maxStepUpFailures   = 3
+	eventSessionRevoked = "session.revoked"
+)
+
+type bindingMode struct {
+	Name     string
+	IPv4Bits int
+	IPv6Bits int
+	Enforce  bool // false only audits
+	StepUp   bool // a network change asks for the password instead of revoking
+}
+
+var bindingModes = map[string]bindingMode{
+	"off":     {Name: "off"},
+	"monitor": {Name: "monitor", IPv4Bits: 24, IPv6Bits: 48},
+	"lenient": {Name: "lenient", IPv4Bits: 16, IPv6Bits: 32, Enforce: true, StepUp: true},
+	"strict":  {Name: "strict", IPv4Bits: 24, IPv6Bits: 48, Enforce: true},
+}
+
+var sessionBindingMode = bindingModes["off"]
+
+// divergenceWindow is how recently another fingerprint must have used a token for a
+// return to an earlier one to count as simultaneous use; 0 disables the check.
+var divergenceWindow time.Duration
+
+func loadSessionBinding() error {
+	name := envOr("AUTH_SESSION_BINDING", "off")
+	mode, ok := bindingModes[name]
+	if !ok {
+		return fmt.Errorf("unknown AUTH_SESSION_BINDING %q", name)
+	}
+	sessionBindingMode = mode
+	var err error
+	if divergenceWindow, err = time.ParseDuration(envOr("AUTH_SESSION_DIVERGENCE_WINDOW", "5m")); err != nil {
+		return fmt.Errorf("AUTH_SESSION_DIVERGENCE_WINDOW: %w", err)
+	}
+	return nil
+}
+
+// clientBinding is the fingerprint a session is bound to.
+type clientBinding struct {
+	IP     string
+	Client string // user-agent family, see userAgentFamily
+}
+
+// sessionUse is a fingerprint that recently used a session.
+type sessionUse struct {
+	Fingerprint string
+	At          time.Time
+}
+
+func requestBinding(c *fiber.Ctx) clientBinding {
+	return clientBinding{IP: c.IP(), Client: userAgentFamily(c.Get(fiber.HeaderUserAgent))}
+}
+
+// network is the part of the address that must stay the same in the current mode.
+func (b clientBinding) network() string {
+	return maskIP(b.IP, sessionBindingMode.IPv4Bits, sessionBindingMode.IPv6Bits)
+}
+
+func (b clientBinding) fingerprint() string {
+	return b.network() + "|" + b.Client
+}
+
+// userAgentFamily reduces a User-Agent header to browser and operating system, like
+// "Firefox/Windows". Clients it does not know are named by their first product token.
+func userAgentFamily(ua string) string {
+	var browser string
+	switch {
+	case strings.Contains(ua, "Edg/") || strings.Contains(ua, "EdgA/") || strings.Contains(ua, "EdgiOS/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/") || strings.Contains(ua, "Opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/") || strings.Contains(ua, "FxiOS/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/") || strings.Contains(ua, "CriOS/") || strings.Contains(ua, "Chromium/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	default:
+		product, _, _ := strings.Cut(ua, "/")
+		if product = strings.TrimSpace(product); product == "" || len(product) > 64 {
+			product = "unknown"
+		}
+		return product
+	}
+
+	var os string
+	switch {
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod"):
+		os = "iOS"
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(ua, "Mac OS X") || strings.Contains(ua, "Macintosh"):
+		os = "macOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	default:
+		os = "other"
+	}
+	return browser + "/" + os
+}
+
+type bindingVerdict int
+
+const (
+	bindingOK       bindingVerdict = iota
+	bindingMismatch                // audited only
+	bindingStepUp
+	bindingRevoke
+)
+
+// observeSessionUse records that the session behind token is being used by current
+// and decides what to do about it. Only the first request after a change reports a
+// mismatch in monitor mode, and a pending step-up keeps being reported until it is
+// completed. Requests refused for a step-up are not recorded as uses.
+func observeSessionUse(token string, current clientBinding) (bindingVerdict, string) {
+	if sessionBindingMode.Name == "off" {
+		return bindingOK, ""
+	}
+	id := hashToken(token)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[id]
+	if !ok || s.Binding == (clientBinding{}) {
+		return bindingOK, ""
+	}
+
+	now := time.Now()
+	fp := current.fingerprint()
+	uses := make([]sessionUse, 0, len(s.uses)+1)
+	for _, u := range s.uses {
+		if now.Sub(u.At) <= divergenceWindow {
+			uses = append(uses, u)
+		}
+	}
+	// A B A: the token came back to a fingerprint after another one used it in
+	// between. Coming back to the bound fingerprint is the owner returning, not a
+	// second holder.
+	divergent := false
+	if n := len(uses); n > 0 && uses[n-1].Fingerprint != fp && fp != s.Binding.fingerprint() {
+		for _, u := range uses[:n-1] {
+			divergent = divergent || u.Fingerprint == fp
+		}
+	}
+
+	var verdict bindingVerdict
+	var reason string
+	switch {
+	case divergent:
+		verdict, reason = bindingRevoke, "divergent use"
+	case current.Client != s.Binding.Client:
+		verdict, reason = bindingRevoke, "browser changed"
+	case current.network() != s.Binding.network():
+		verdict, reason = bindingRevoke, "network changed"
+		// Only the user can confirm a network change; a support session cannot.
+		if sessionBindingMode.StepUp && s.Impersonator == "" {
+			verdict = bindingStepUp
+		}
+	default:
+		verdict = bindingOK
+	}
+
+	if verdict != bindingStepUp || !sessionBindingMode.Enforce {
+		if n := len(uses); n > 0 && uses[n-1].Fingerprint == fp {
+			uses[n-1].At = now
+		} else {
+			uses = append(uses, sessionUse{fp, now})
+		}
+		if len(uses) > 8 {
+			uses = uses[len(uses)-8:]
+		}
+	}
+	s.uses = uses
+	sessions[id] = s
+
+	if verdict == bindingOK {
+		// The bound client keeps working while a step-up is pending elsewhere.
+		return bindingOK, ""
+	}
+	if !sessionBindingMode.Enforce {
+		// Rebinding reports each change once instead of on every request.
+		s.Binding = current
+		sessions[id] = s
+		return bindingMismatch, reason
+	}
+	if verdict == bindingStepUp && !s.StepUp {
+		s.StepUp = true
+		sessions[id] = s
+	}
+	return verdict, reason
+}
+
+// allowedDuringStepUp lists the requests a session waiting for re-authentication may
+// make: completing it, and signing out.
+func allowedDuringStepUp(c *fiber.Ctx) bool {
+	return c.Method() == fiber.MethodPost && (c.Path() == stepUpPath || c.Path() == "/api/logout")
+}
+
+// sessionBindingMiddleware runs right after authMiddleware and checks the request
+// against the client the session is bound to.
+func sessionBindingMiddleware(c *fiber.Ctx) error {
+	token := c.Locals("token").(string)
+	sess := c.Locals("session").(session)
+	verdict, reason := observeSessionUse(token, requestBinding(c))
+	switch verdict {
+	case bindingMismatch:
+		sessionBindingActions.WithLabelValues("audited", reason).Inc()
+		audit(sess.Username, "session_binding_mismatch", c.IP(), reason+", "+userAgentFamily(c.Get(fiber.HeaderUserAgent)))
+	case bindingStepUp:
+		if allowedDuringStepUp(c) {
+			break
+		}
+		sessionBindingActions.WithLabelValues("step_up", reason).Inc()
+		audit(sess.Username, "session_step_up_required", c.IP(), reason)
+		return c.Status(401).JSON(fiber.Map{"error": "Re-authentication required"})
+	case bindingRevoke:
+		revokeBoundSession(c, token, sess, reason)
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	return c.Next()
+}
+
+// boundSession looks up the session behind token for a request outside the protected
+// routes, like the OIDC redirects, and applies the checks of sessionBindingMiddleware
+// to it. A session waiting for a step-up is refused unless allowStepUp is set, for
+// requests that complete one.
+func boundSession(c *fiber.Ctx, token string, allowStepUp bool) (session, bool) {
+	sess, ok := lookupSession(token)
+	if !ok {
+		return session{}, false
+	}
+	verdict, reason := observeSessionUse(token, requestBinding(c))
+	switch verdict {
+	case bindingMismatch:
+		sessionBindingActions.WithLabelValues("audited", reason).Inc()
+		audit(sess.Username, "session_binding_mismatch", c.IP(), reason+", "+userAgentFamily(c.Get(fiber.HeaderUserAgent)))
+	case bindingRevoke:
+		revokeBoundSession(c, token, sess, reason)
+		return session{}, false
+	}
+	// The check above may just have asked for a step-up.
+	if sess, ok = lookupSession(token); !ok || (sess.StepUp && !allowStepUp) {
+		return session{}, false
+	}
+	return sess, true
+}
+
+// revokeBoundSession ends a session whose token appears to have been copied.
+func revokeBoundSession(c *fiber.Ctx, token string, sess session, reason string) {
+	deleteSession(token)
+	sessionBindingActions.WithLabelValues("revoked", reason).Inc()
+	audit(sess.Username, "session_revoked", c.IP(), reason+", "+userAgentFamily(c.Get(fiber.HeaderUserAgent)))
+	emitEvent(eventSessionRevoked, fiber.Map{"username": sess.Username, "ip": c.IP(), "reason": reason})
+	if c.Cookies("session_token") == token {
+		c.ClearCookie("session_token")
+	}
+}
+
+// stepUpHandler confirms a session after a network change with the account's
+// password, or a fresh sign-in at a linked provider, and binds it to the new network.
+func stepUpHandler(c *fiber.Ctx) error {
+	token := c.Locals("token").(string)
+	sess, ok := lookupSession(token)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	if !sess.StepUp {
+		return c.Status(409).JSON(fiber.Map{"error": "Re-authentication is not required"})
+	}
+	var data struct {
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := reauthenticate(c, sess.Username, data.Password); err != nil {
+		audit(sess.Username, "session_step_up_failure", c.IP(), "")
+		if recordStepUpFailure(token) >= maxStepUpFailures {
+			revokeBoundSession(c, token, sess, "step-up failed")
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+	rebindSession(token, requestBinding(c))
+	audit(sess.Username, "session_step_up", c.IP(), userAgentFamily(c.Get(fiber.HeaderUserAgent)))
+	return c.JSON(fiber.Map{"message": "Session confirmed"})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Addresses on other /16 networks than the one the tests connect from.
+const (
+	elsewhere = "198.51.100.7"
+	wifiAddr  = "192.0.2.10"
+)
+
+func useBindingMode(t *testing.T, name string) {
+	t.Helper()
+	savedMode, savedWindow := sessionBindingMode, divergenceWindow
+	sessionBindingMode, divergenceWindow = bindingModes[name], 5*time.Minute
+	t.Cleanup(func() { sessionBindingMode, divergenceWindow = savedMode, savedWindow })
+}
+
+// moveSession rebinds the session behind cookie as if it had been started from ip,
+// so that the next request looks like it comes from another network.
+func moveSession(t *testing.T, cookie *http.Cookie, ip string) clientBinding {
+	t.Helper()
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	id := hashToken(cookie.Value)
+	s, ok := sessions[id]
+	if !ok {
+		t.Fatal("no such session")
+	}
+	here := s.Binding
+	s.Binding.IP = ip
+	sessions[id] = s
+	return here
+}
+
+func bindingLogin(t *testing.T, mode string) *http.Cookie {
+	t.Helper()
+	useBindingMode(t, mode)
+	username := newUsername()
+	register(t, username, "correct horse")
+	return login(t, username, "correct horse")
+}
+
+func TestSessionBindingModes(t *testing.T) {
+	t.Run("off", func(t *testing.T) {
+		cookie := bindingLogin(t, "off")
+		moveSession(t, cookie, elsewhere)
+		decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	})
+
+	t.Run("monitor", func(t *testing.T) {
+		cookie := bindingLogin(t, "monitor")
+		moveSession(t, cookie, elsewhere)
+		audited := sessionBindingActions.WithLabelValues("audited", "network changed")
+		before := testutil.ToFloat64(audited)
+		decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+		decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+		// The session is rebound, so the change is reported once.
+		if got := testutil.ToFloat64(audited) - before; got != 1 {
+			t.Errorf("%v mismatches audited, want 1", got)
+		}
+	})
+
+	t.Run("lenient", func(t *testing.T) {
+		cookie := bindingLogin(t, "lenient")
+		moveSession(t, cookie, elsewhere)
+		if data := decode(t, request(t, "GET", "/api/profile", nil, cookie), 401); data["error"] != "Re-authentication required" {
+			t.Errorf("network change: %v", data)
+		}
+		// Only completing the step-up and signing out get through.
+		if data := decode(t, request(t, "POST", stepUpPath, fiber.Map{"password": "wrong"}, cookie), 401); data["error"] != "Invalid credentials" {
+			t.Errorf("step-up: %v", data)
+		}
+		decode(t, request(t, "GET", "/api/orgs", nil, cookie), 401)
+		decode(t, request(t, "POST", "/api/logout", nil, cookie), 200)
+
+		// Another browser is revoked outright.
+		cookie = bindingLogin(t, "lenient")
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		req.Header.Set("User-Agent", otherBrowser)
+		req.AddCookie(cookie)
+		resp, err := testApp.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decode(t, resp, 401)
+		if _, ok := lookupSession(cookie.Value); ok {
+			t.Error("session survived a change of browser")
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		cookie := bindingLogin(t, "strict")
+		moveSession(t, cookie, elsewhere)
+		if data := decode(t, request(t, "GET", "/api/profile", nil, cookie), 401); data["error"] != "Unauthorized" {
+			t.Errorf("network change: %v", data)
+		}
+		if _, ok := lookupSession(cookie.Value); ok {
+			t.Error("session survived a change of network")
+		}
+	})
+}
+
+func TestStepUp(t *testing.T) {
+	cookie := bindingLogin(t, "lenient")
+	decode(t, request(t, "POST", stepUpPath, fiber.Map{"password": "correct horse"}, cookie), 409)
+
+	moveSession(t, cookie, elsewhere)
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 401)
+	decode(t, request(t, "POST", stepUpPath, fiber.Map{"password": "correct horse"}, cookie), 200)
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	if s, ok := lookupSession(cookie.Value); !ok || s.StepUp || s.Binding.IP == elsewhere {
+		t.Errorf("session after step-up = %+v", s)
+	}
+}
+
+func TestStepUpFailures(t *testing.T) {
+	cookie := bindingLogin(t, "lenient")
+	moveSession(t, cookie, elsewhere)
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 401)
+	for i := 1; i < maxStepUpFailures; i++ {
+		decode(t, request(t, "POST", stepUpPath, fiber.Map{"password": "wrong"}, cookie), 401)
+		if _, ok := lookupSession(cookie.Value); !ok {
+			t.Fatalf("session revoked after %d failures", i)
+		}
+	}
+	if data := decode(t, request(t, "POST", stepUpPath, fiber.Map{"password": "wrong"}, cookie), 401); data["error"] != "Unauthorized" {
+		t.Errorf("last failure: %v", data)
+	}
+	if _, ok := lookupSession(cookie.Value); ok {
+		t.Error("session survived repeated step-up failures")
+	}
+}
+
+// TestNetworkRoundTrip walks a session from its network to another and back, as a
+// phone moving between Wi-Fi and cellular does.
+func TestNetworkRoundTrip(t *testing.T) {
+	cookie := bindingLogin(t, "lenient")
+	client := moveSession(t, cookie, wifiAddr).Client
+	wifi := clientBinding{IP: wifiAddr, Client: client}
+	cellular := clientBinding{IP: elsewhere, Client: client}
+
+	for _, step := range []struct {
+		from clientBinding
+		want bindingVerdict
+	}{
+		{wifi, bindingOK},
+		{cellular, bindingStepUp},
+		{wifi, bindingOK}, // the bound client keeps working while a step-up is pending
+		{cellular, bindingStepUp},
+	} {
+		if got, reason := observeSessionUse(cookie.Value, step.from); got != step.want {
+			t.Fatalf("use from %s: verdict %d (%s), want %d", step.from.IP, got, reason, step.want)
+		}
+	}
+
+	// After confirming on cellular, going back to Wi-Fi asks again instead of revoking.
+	rebindSession(cookie.Value, cellular)
+	if got, reason := observeSessionUse(cookie.Value, cellular); got != bindingOK {
+		t.Fatalf("use from the confirmed network: verdict %d (%s)", got, reason)
+	}
+	if got, reason := observeSessionUse(cookie.Value, wifi); got != bindingStepUp {
+		t.Errorf("return to the earlier network: verdict %d (%s), want a step-up", got, reason)
+	}
+}
+
+func TestDivergentUse(t *testing.T) {
+	// The token was used from here, then from another network it was bound to.
+	// Coming back here within the window means two clients hold it.
+	diverge := func(t *testing.T, cookie *http.Cookie) (here clientBinding) {
+		t.Helper()
+		here = moveSession(t, cookie, elsewhere)
+		sessionsMu.Lock()
+		id := hashToken(cookie.Value)
+		s := sessions[id]
+		s.uses = []sessionUse{{here.fingerprint(), time.Now()}, {s.Binding.fingerprint(), time.Now()}}
+		sessions[id] = s
+		sessionsMu.Unlock()
+		return here
+	}
+
+	for _, mode := range []string{"lenient", "strict"} {
+		t.Run(mode, func(t *testing.T) {
+			cookie := bindingLogin(t, mode)
+			diverge(t, cookie)
+			revoked := sessionBindingActions.WithLabelValues("revoked", "divergent use")
+			before := testutil.ToFloat64(revoked)
+			decode(t, request(t, "GET", "/api/profile", nil, cookie), 401)
+			if _, ok := lookupSession(cookie.Value); ok {
+				t.Error("session survived divergent use")
+			}
+			if got := testutil.ToFloat64(revoked) - before; got != 1 {
+				t.Errorf("%v divergent revocations counted, want 1", got)
+			}
+		})
+	}
+
+	t.Run("monitor", func(t *testing.T) {
+		cookie := bindingLogin(t, "monitor")
+		diverge(t, cookie)
+		audited := sessionBindingActions.WithLabelValues("audited", "divergent use")
+		before := testutil.ToFloat64(audited)
+		decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+		if got := testutil.ToFloat64(audited) - before; got != 1 {
+			t.Errorf("%v divergent uses audited, want 1", got)
+		}
+	})
+
+	t.Run("outside the window", func(t *testing.T) {
+		cookie := bindingLogin(t, "strict")
+		here := diverge(t, cookie)
+		divergenceWindow = 0
+		// Still a network change, which strict mode revokes, but not divergent use.
+		if got, reason := observeSessionUse(cookie.Value, here); got != bindingRevoke || reason != "network changed" {
+			t.Errorf("verdict %d (%s)", got, reason)
+		}
+	})
+}
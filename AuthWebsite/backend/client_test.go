@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"authwebsite/client"
+)
+
+// The Go client is tested here, against the real handlers, because its own package
+// cannot import the server.
+
+// appTransport hands the client's requests to the test app. The first Unavailable
+// requests are answered with 503 instead, and every request is counted.
+type appTransport struct {
+	Unavailable int32
+	requests    atomic.Int32
+}
+
+func (t *appTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.requests.Add(1) <= t.Unavailable {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"error":"Service unavailable"}`)),
+			Request:    req,
+		}, nil
+	}
+	return testApp.Test(req, -1)
+}
+
+func newClient(t *testing.T, transport *appTransport) *client.Client {
+	t.Helper()
+	c, err := client.New("http://auth.test",
+		client.WithHTTPClient(&http.Client{Transport: transport}),
+		client.WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientRegisterAndLogin(t *testing.T) {
+	usePow(t, 4, 100)
+	ctx := context.Background()
+	c := newClient(t, &appTransport{})
+	username := newUsername()
+
+	if err := c.Register(ctx, client.RegisterRequest{Username: username, Password: "correct horse"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Login(ctx, client.LoginRequest{Username: username, Password: "correct horse"}); err != nil {
+		t.Fatal(err)
+	}
+	// The session cookie stays in the client's jar.
+	p, err := c.Profile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Username != username || p.Impersonation != nil {
+		t.Errorf("profile = %+v", p)
+	}
+	if err := c.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Profile(ctx); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("profile after logout: %v", err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, &appTransport{})
+	username := newUsername()
+	register(t, username, "correct horse")
+
+	err := c.Login(ctx, client.LoginRequest{Username: username, Password: "wrong"})
+	var apiErr *client.APIError
+	if !errors.Is(err, client.ErrInvalidCredentials) || !errors.As(err, &apiErr) || apiErr.StatusCode != 401 {
+		t.Errorf("login with a wrong password: %v", err)
+	}
+	err = c.Register(ctx, client.RegisterRequest{Username: username, Password: "correct horse"})
+	if !errors.Is(err, client.ErrUsernameTaken) {
+		t.Errorf("register a taken username: %v", err)
+	}
+	if _, err := c.Profile(ctx); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("profile without a session: %v", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	ctx := context.Background()
+	username := newUsername()
+	register(t, username, "correct horse")
+
+	// Idempotent calls are retried through temporary failures.
+	transport := &appTransport{Unavailable: 2}
+	if _, err := newClient(t, transport).Policies(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := transport.requests.Load(); n != 3 {
+		t.Errorf("policies took %d requests, want 3", n)
+	}
+
+	// A login may have gone through, so it is not repeated.
+	transport = &appTransport{Unavailable: 1}
+	err := newClient(t, transport).Login(ctx, client.LoginRequest{Username: username, Password: "correct horse"})
+	if !errors.Is(err, client.ErrServer) {
+		t.Errorf("login during an outage: %v", err)
+	}
+	if n := transport.requests.Load(); n != 1 {
+		t.Errorf("login took %d requests, want 1", n)
+	}
+
+	// Retries stop after the configured number.
+	transport = &appTransport{Unavailable: 10}
+	if _, err := newClient(t, transport).Policies(ctx); !errors.Is(err, client.ErrServer) {
+		t.Errorf("policies during an outage: %v", err)
+	}
+	if n := transport.requests.Load(); n != 3 {
+		t.Errorf("policies took %d requests, want 3", n)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import "os"
+
+// envOr returns the value of the environment variable key, or def if it is unset or empty.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Policy documents (terms of service, privacy policy) are versioned; the current
+// version of a kind is the one most recently published, and of versions published
+// at the same time the one added last. Users accept the current versions when they
+// register, and whenever a new version takes effect every protected route answers
+// "Consent required" until they accept it.
+
+var policyKinds = map[string]bool{"terms": true, "privacy": true}
+
+type policyDocument struct {
+	Kind        string    `json:"kind"`
+	Version     string    `json:"version"`
+	Title       string    `json:"title"`
+	Body        string    `json:"body,omitempty"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+type policyAcceptance struct {
+	Kind       string    `json:"kind"`
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	IP         string    `json:"ip"`
+}
+
+// currentPolicies returns the version of each kind in effect now, without bodies.
+// With username set, only those the user has not accepted are returned.
+func currentPolicies(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, username string) ([]policyDocument, error) {
+	now := time.Now()
+	query := `SELECT p.kind, p.version, p.title, p.published_at FROM policy_documents p
+            WHERE p.id = (SELECT id FROM policy_documents WHERE kind = p.kind AND published_at <= ?
+                ORDER BY published_at DESC, id DESC LIMIT 1)`
+	args := []any{now}
+	if username != "" {
+		query += ` AND NOT EXISTS (SELECT 1 FROM policy_acceptances a
+                WHERE a.username = ? AND a.kind = p.kind AND a.version = p.version)`
+		args = append(args, username)
+	}
+	rows, err := q.Query(query+" ORDER BY p.kind", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := []policyDocument{}
+	for rows.Next() {
+		var d policyDocument
+		if err := rows.Scan(&d.Kind, &d.Version, &d.Title, &d.PublishedAt); err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+	return docs, rows.Err()
+}
+
+// acceptPolicies records that username accepted the given kind → version pairs.
+// Every current policy must be accepted in its current version; otherwise it
+// returns the documents still outstanding and records nothing.
+func acceptPolicies(tx *sql.Tx, username string, accepted map[string]string, ip string) ([]policyDocument, error) {
+	current, err := currentPolicies(tx, "")
+	if err != nil {
+		return nil, err
+	}
+	var missing []policyDocument
+	for _, d := range current {
+		if accepted[d.Kind] != d.Version {
+			missing = append(missing, d)
+		}
+	}
+	if len(missing) > 0 {
+		return missing, nil
+	}
+	now := time.Now()
+	for _, d := range current {
+		_, err := tx.Exec(`INSERT IGNORE INTO policy_acceptances (username, kind, version, accepted_at, ip)
+                VALUES (?, ?, ?, ?, ?)`, username, d.Kind, d.Version, now, ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// consentExempt lists the protected requests allowed without consent: reading and
+// giving it, signing out, changing an expired password, confirming the session and
+// deleting the account.
+func consentExempt(c *fiber.Ctx) bool {
+	switch c.Method() + " " + c.Path() {
+	case "GET /api/consent", "POST /api/consent", "POST /api/logout", "POST " + changePasswordPath, "POST " + stepUpPath, "DELETE /api/account":
+		return true
+	}
+	return false
+}
+
+// consentMiddleware blocks users who have not accepted the current policies.
+// Impersonating admins are let through, since only the user can consent.
+func consentMiddleware(c *fiber.Ctx) error {
+	if consentExempt(c) || c.Locals("session").(session).Impersonator != "" {
+		return c.Next()
+	}
+	missing, err := currentPolicies(db, c.Locals("username").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if len(missing) > 0 {
+		return c.Status(403).JSON(fiber.Map{"error": "Consent required", "policies": missing})
+	}
+	return c.Next()
+}
+
+// listPoliciesHandler returns the policies in effect, for the registration form.
+func listPoliciesHandler(c *fiber.Ctx) error {
+	docs, err := currentPolicies(db, "")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(fiber.Map{"policies": docs})
+}
+
+func getPolicyHandler(c *fiber.Ctx) error {
+	var d policyDocument
+	err := db.QueryRow("SELECT kind, version, title, body, published_at FROM policy_documents WHERE kind = ? AND version = ?",
+		c.Params("kind"), c.Params("version")).Scan(&d.Kind, &d.Version, &d.Title, &d.Body, &d.PublishedAt)
+	if err == sql.ErrNoRows || (err == nil && d.PublishedAt.After(time.Now())) {
+		return c.Status(404).JSON(fiber.Map{"error": "Policy not found"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(d)
+}
+
+// consentStatusHandler lists the policies the user still has to accept.
+func consentStatusHandler(c *fiber.Ctx) error {
+	missing, err := currentPolicies(db, c.Locals("username").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(fiber.Map{"required": len(missing) > 0, "policies": missing})
+}
+
+func giveConsentHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		Accepted map[string]string `json:"accepted_policies"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer tx.Rollback()
+	missing, err := acceptPolicies(tx, username, data.Accepted, c.IP())
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if len(missing) > 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Consent required", "policies": missing})
+	}
+	audit(username, "consent", c.IP(), acceptedSummary(data.Accepted))
+	return c.JSON(fiber.Map{"message": "Thank you"})
+}
+
+func acceptedSummary(accepted map[string]string) string {
+	parts := []string{}
+	for kind, version := range accepted {
+		if policyKinds[kind] {
+			parts = append(parts, kind+" "+version)
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// publishPolicyHandler adds a new policy version. It takes effect at published_at,
+// or immediately when that is omitted.
+func publishPolicyHandler(c *fiber.Ctx) error {
+	var data struct {
+		Kind        string     `json:"kind"`
+		Version     string     `json:"version"`
+		Title       string     `json:"title"`
+		Body        string     `json:"body"`
+		PublishedAt *time.Time `json:"published_at"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.Version == "" || data.Title == "" || data.Body == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if !policyKinds[data.Kind] {
+		return c.Status(400).JSON(fiber.Map{"error": "Unknown policy kind"})
+	}
+	if len(data.Version) > 32 {
+		return c.Status(400).JSON(fiber.Map{"error": "Version is too long"})
+	}
+	d := policyDocument{Kind: data.Kind, Version: data.Version, Title: data.Title, Body: data.Body, PublishedAt: time.Now().Truncate(time.Second)}
+	if data.PublishedAt != nil {
+		d.PublishedAt = *data.PublishedAt
+	}
+	admin := c.Locals("username").(string)
+	_, err := db.Exec(`INSERT INTO policy_documents (kind, version, title, body, published_at, created_by)
+            VALUES (?, ?, ?, ?, ?, ?)`, d.Kind, d.Version, d.Title, d.Body, d.PublishedAt, admin)
+	if isDuplicateKey(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "Version already exists"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(admin, "policy_publish", c.IP(), d.Kind+" "+d.Version)
+	return c.Status(201).JSON(d)
+}
+
+// listPolicyVersionsHandler lists every version, including scheduled ones, for admins.
+func listPolicyVersionsHandler(c *fiber.Ctx) error {
+	rows, err := db.Query("SELECT kind, version, title, published_at FROM policy_documents ORDER BY kind, published_at DESC")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer rows.Close()
+	docs := []policyDocument{}
+	for rows.Next() {
+		var d policyDocument
+		if err := rows.Scan(&d.Kind, &d.Version, &d.Title, &d.PublishedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		}
+		docs = append(docs, d)
+	}
+	return c.JSON(fiber.Map{"policies": docs})
+}
+
+// exportConsents lists the policy versions a user accepted, for the personal-data export.
+func exportConsents(username string) (any, error) {
+	rows, err := db.Query("SELECT kind, version, accepted_at, ip FROM policy_acceptances WHERE username = ? ORDER BY accepted_at", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	acceptances := []policyAcceptance{}
+	for rows.Next() {
+		var a policyAcceptance
+		if err := rows.Scan(&a.Kind, &a.Version, &a.AcceptedAt, &a.IP); err != nil {
+			return nil, err
+		}
+		acceptances = append(acceptances, a)
+	}
+	return acceptances, rows.Err()
+}
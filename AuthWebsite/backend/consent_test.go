@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// publishPolicy publishes a policy version as the admin behind cookie, then has the
+// admin accept it so that the admin routes stay open. Every test that publishes
+// must call clearPolicies, or later registrations would need consent.
+func publishPolicy(t *testing.T, cookie *http.Cookie, kind, version string) {
+	t.Helper()
+	decode(t, request(t, "POST", "/api/admin/policies", fiber.Map{"kind": kind, "version": version, "title": kind + " " + version, "body": "Text"}, cookie), 201)
+	decode(t, request(t, "POST", "/api/consent", fiber.Map{"accepted_policies": currentVersions(t)}, cookie), 200)
+}
+
+// currentVersions maps each policy kind in effect to its version.
+func currentVersions(t *testing.T) map[string]string {
+	t.Helper()
+	versions := map[string]string{}
+	for _, d := range decode(t, request(t, "GET", "/api/policies", nil), 200)["policies"].([]any) {
+		doc := d.(map[string]any)
+		versions[doc["kind"].(string)] = doc["version"].(string)
+	}
+	return versions
+}
+
+func clearPolicies(t *testing.T) {
+	t.Cleanup(func() {
+		if _, err := db.Exec("DELETE FROM policy_documents"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestConsentRequiredForNewVersion(t *testing.T) {
+	clearPolicies(t)
+	adminCookie := admin(t)
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+
+	publishPolicy(t, adminCookie, "terms", "1")
+	got := decode(t, request(t, "GET", "/api/profile", nil, cookie), 403)
+	if got["error"] != "Consent required" {
+		t.Errorf("profile before consent: %v", got)
+	}
+	if status := decode(t, request(t, "GET", "/api/consent", nil, cookie), 200); status["required"] != true {
+		t.Errorf("consent status = %v", status)
+	}
+
+	// Only the version in effect counts.
+	decode(t, request(t, "POST", "/api/consent", fiber.Map{"accepted_policies": map[string]string{"terms": "0"}}, cookie), 409)
+	decode(t, request(t, "POST", "/api/consent", fiber.Map{"accepted_policies": map[string]string{"terms": "1"}}, cookie), 200)
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+
+	// A new version asks again; a scheduled one does not until it takes effect.
+	decode(t, request(t, "POST", "/api/admin/policies", fiber.Map{"kind": "terms", "version": "3", "title": "Terms 3", "body": "Text",
+		"published_at": time.Now().Add(time.Hour)}, adminCookie), 201)
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	decode(t, request(t, "GET", "/api/policies/terms/3", nil), 404)
+	publishPolicy(t, adminCookie, "terms", "2")
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 403)
+	decode(t, request(t, "POST", "/api/consent", fiber.Map{"accepted_policies": map[string]string{"terms": "2"}}, cookie), 200)
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+
+	decode(t, request(t, "POST", "/api/admin/policies", fiber.Map{"kind": "terms", "version": "2", "title": "Again", "body": "Text"}, adminCookie), 409)
+}
+
+func TestRegistrationRequiresConsent(t *testing.T) {
+	clearPolicies(t)
+	adminCookie := admin(t)
+	publishPolicy(t, adminCookie, "terms", "1")
+	publishPolicy(t, adminCookie, "privacy", "1")
+
+	username := newUsername()
+	decode(t, request(t, "POST", "/api/register", fiber.Map{"username": username, "password": "correct horse",
+		"accepted_policies": map[string]string{"terms": "1"}}), 400)
+	decode(t, request(t, "POST", "/api/register", fiber.Map{"username": username, "password": "correct horse",
+		"accepted_policies": map[string]string{"terms": "1", "privacy": "1"}}), 200)
+	decode(t, request(t, "GET", "/api/profile", nil, login(t, username, "correct horse")), 200)
+}
+
+func TestConsentWithTiedPublicationTimes(t *testing.T) {
+	clearPolicies(t)
+	published := time.Now().Add(-time.Minute).Truncate(time.Second)
+	for _, version := range []string{"a", "b"} {
+		_, err := db.Exec(`INSERT INTO policy_documents (kind, version, title, body, published_at, created_by)
+                VALUES ('terms', ?, 'Terms', 'Text', ?, 'test')`, version, published)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The version added last is the one in effect, and accepting it is enough.
+	if versions := currentVersions(t); len(versions) != 1 || versions["terms"] != "b" {
+		t.Fatalf("current policies = %v", versions)
+	}
+	username := newUsername()
+	decode(t, request(t, "POST", "/api/register", fiber.Map{"username": username, "password": "correct horse",
+		"accepted_policies": map[string]string{"terms": "b"}}), 200)
+	decode(t, request(t, "GET", "/api/profile", nil, login(t, username, "correct horse")), 200)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Each login is fingerprinted by a hash of the user agent and the client's IP prefix.
+// A fingerprint never seen for the account triggers a notification with a "this
+// wasn't me" link, which logs the account out everywhere and requires a new password.
+
+const eventUserNewDevice = "user.new_device"
+
+const deviceAlertTTL = 7 * 24 * time.Hour
+
+// deviceSensitivity decides how much of a login's origin makes up its fingerprint.
+type deviceSensitivity struct {
+	Name      string
+	IPv4Bits  int
+	IPv6Bits  int
+	UserAgent bool
+}
+
+var deviceSensitivities = map[string]deviceSensitivity{
+	"off":    {Name: "off"},
+	"low":    {Name: "low", IPv4Bits: 16, IPv6Bits: 32},
+	"medium": {Name: "medium", IPv4Bits: 24, IPv6Bits: 48, UserAgent: true},
+	"high":   {Name: "high", IPv4Bits: 32, IPv6Bits: 64, UserAgent: true},
+}
+
+var deviceTracking = deviceSensitivities["medium"]
+
+// loadDeviceConfig reads AUTH_NEW_DEVICE_SENSITIVITY: off, low (network only),
+// medium (browser and /24 network) or high (browser and exact address).
+func loadDeviceConfig() error {
+	name := envOr("AUTH_NEW_DEVICE_SENSITIVITY", "medium")
+	s, ok := deviceSensitivities[name]
+	if !ok {
+		return fmt.Errorf("unknown AUTH_NEW_DEVICE_SENSITIVITY %q", name)
+	}
+	deviceTracking = s
+	return nil
+}
+
+// ipPrefix masks ip to the network size of the configured sensitivity.
+func ipPrefix(ip string) string {
+	return maskIP(ip, deviceTracking.IPv4Bits, deviceTracking.IPv6Bits)
+}
+
+// maskIP returns the network of ip in CIDR notation, keeping v4Bits of an IPv4
+// address or v6Bits of an IPv6 one. Unparseable input is returned unchanged.
+func maskIP(ip string, v4Bits, v6Bits int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(v4Bits, 32)), Mask: net.CIDRMask(v4Bits, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(v6Bits, 128)), Mask: net.CIDRMask(v6Bits, 128)}).String()
+}
+
+func deviceFingerprint(userAgent, prefix string) string {
+	if !deviceTracking.UserAgent {
+		userAgent = ""
+	}
+	sum := sha256.Sum256([]byte(userAgent + "|" + prefix))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkDevice records the login's fingerprint and notifies the user when it is new.
+// The first device of an account is recorded silently.
+func checkDevice(c *fiber.Ctx, username string) {
+	if deviceTracking.Name == "off" {
+		return
+	}
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	prefix := ipPrefix(c.IP())
+	fingerprint := deviceFingerprint(userAgent, prefix)
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	now := time.Now()
+	res, err := db.Exec("UPDATE known_devices SET last_seen = ? WHERE username = ? AND fingerprint = ?", now, username, fingerprint)
+	if err != nil {
+		log.Println("known devices:", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return
+	}
+
+	var known int
+	if err := db.QueryRow("SELECT COUNT(*) FROM known_devices WHERE username = ?", username).Scan(&known); err != nil {
+		log.Println("known devices:", err)
+		return
+	}
+	_, err = db.Exec(`INSERT IGNORE INTO known_devices (username, fingerprint, ip_prefix, user_agent, first_seen, last_seen)
+            VALUES (?, ?, ?, ?, ?, ?)`, username, fingerprint, prefix, userAgent, now, now)
+	if err != nil {
+		log.Println("known devices:", err)
+		return
+	}
+	if known == 0 {
+		return
+	}
+
+	token := generateToken()
+	_, err = db.Exec("INSERT INTO device_alerts (token_hash, username, fingerprint, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hashToken(token), username, fingerprint, now, now.Add(deviceAlertTTL))
+	if err != nil {
+		log.Println("device alert:", err)
+		return
+	}
+	audit(username, "new_device", c.IP(), userAgent)
+	emitEvent(eventUserNewDevice, fiber.Map{"username": username, "ip": c.IP(), "user_agent": userAgent})
+
+	var email string
+	if err := db.QueryRow("SELECT email FROM users WHERE username = ?", username).Scan(&email); err != nil {
+		log.Println("device alert:", err)
+		return
+	}
+	notify(Notification{
+		Username: username,
+		To:       email,
+		Subject:  "New sign-in to your account",
+		Body: fmt.Sprintf("Your account %s was just signed in to from a new device.\n\n"+
+			"Time: %s\nNetwork: %s\nBrowser: %s\n\n"+
+			"If this was you, no action is needed. If it wasn't, secure your account here:\n%s/?not-me=%s\n",
+			username, now.UTC().Format(time.RFC1123), prefix, userAgent,
+			envOr("AUTH_PUBLIC_URL", "http://localhost:8080"), token),
+		Secrets: []string{token},
+	})
+}
+
+// deviceAlert is a new-device notification that can still be answered.
+type deviceAlert struct {
+	Username    string
+	Fingerprint string
+	CreatedAt   time.Time // when the flagged sign-in happened
+	Reported    bool      // the user answered "this wasn't me"
+}
+
+// lookupDeviceAlert returns the alert for token if it has not expired.
+func lookupDeviceAlert(token string) (deviceAlert, error) {
+	var a deviceAlert
+	var reportedAt sql.NullTime
+	err := db.QueryRow("SELECT username, fingerprint, created_at, reported_at FROM device_alerts WHERE token_hash = ? AND expires_at > ?",
+		hashToken(token), time.Now()).Scan(&a.Username, &a.Fingerprint, &a.CreatedAt, &reportedAt)
+	a.Reported = reportedAt.Valid
+	return a, err
+}
+
+// notMeHandler answers the "this wasn't me" link: every session and refresh token of
+// the account is revoked, passkeys and identities added since the reported sign-in
+// are removed, the device is forgotten and sign-ins are refused until a new password
+// is set with the same token.
+func notMeHandler(c *fiber.Ctx) error {
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	alert, err := lookupDeviceAlert(data.Token)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Link is invalid or has expired"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	username := alert.Username
+
+	_, err = db.Exec("UPDATE device_alerts SET reported_at = ? WHERE token_hash = ?", time.Now(), hashToken(data.Token))
+	// Directory accounts cannot take a new password here.
+	if err == nil {
+		_, err = db.Exec("UPDATE users SET password_reset_required = 1 WHERE username = ? AND auth_source = 'local'", username)
+	}
+	if err == nil {
+		_, err = db.Exec("DELETE FROM known_devices WHERE username = ? AND fingerprint = ?", username, alert.Fingerprint)
+	}
+	if err == nil {
+		err = revokeAllLogins(username, "not_me")
+	}
+	var passkeys, identities []string
+	if err == nil {
+		passkeys, identities, err = removeCredentialsSince(username, alert.CreatedAt)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(username, "not_me", c.IP(), fmt.Sprintf("all sessions revoked, %d passkeys and %d identities removed, password reset required",
+		len(passkeys), len(identities)))
+	return c.JSON(fiber.Map{
+		"message":            "All sessions were signed out. Choose a new password to continue.",
+		"removed_passkeys":   passkeys,
+		"removed_identities": identities,
+	})
+}
+
+// removeCredentialsSince deletes the passkeys and provider identities username
+// gained at or after since, which may belong to whoever signed in then, and returns
+// their names.
+func removeCredentialsSince(username string, since time.Time) (passkeys, identities []string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if passkeys, err = queryStrings(tx, "SELECT name FROM webauthn_credentials WHERE username = ? AND created_at >= ?", username, since); err != nil {
+		return nil, nil, err
+	}
+	if identities, err = queryStrings(tx, "SELECT provider FROM user_identities WHERE username = ? AND created_at >= ?", username, since); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM webauthn_credentials WHERE username = ? AND created_at >= ?", username, since); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM user_identities WHERE username = ? AND created_at >= ?", username, since); err != nil {
+		return nil, nil, err
+	}
+	return passkeys, identities, tx.Commit()
+}
+
+func queryStrings(tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// deviceResetPasswordHandler sets a new password with the token from a device alert
+// that has been reported through notMeHandler. The token is spent by the reset.
+func deviceResetPasswordHandler(c *fiber.Ctx) error {
+	var data struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.Password == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	alert, err := lookupDeviceAlert(data.Token)
+	if err == sql.ErrNoRows || (err == nil && !alert.Reported) {
+		return c.Status(404).JSON(fiber.Map{"error": "Link is invalid or has expired"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	username := alert.Username
+
+	// Directory passwords cannot be set here; find out before the link is spent.
+	var source string
+	if err := db.QueryRow("SELECT auth_source FROM users WHERE username = ?", username).Scan(&source); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if source != "local" {
+		return c.Status(403).JSON(fiber.Map{"error": "Password is managed by your directory"})
+	}
+
+	// The old password is presumed compromised, so it must not come back.
+	reused, err := passwordReused(username, data.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if reused {
+		return c.Status(400).JSON(fiber.Map{"error": "Password was used recently"})
+	}
+	hash, err := hashPassword(data.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to hash password"})
+	}
+	res, err := db.Exec("DELETE FROM device_alerts WHERE token_hash = ? AND reported_at IS NOT NULL", hashToken(data.Token))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Link is invalid or has expired"})
+	}
+	if err := storePassword(username, hash); errors.Is(err, errNotLocalAccount) {
+		return c.Status(403).JSON(fiber.Map{"error": "Password is managed by your directory"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if err := revokeAllLogins(username, "password_change"); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(username, "password_change", c.IP(), "after not-me report")
+	emitEvent(eventUserPasswordChanged, fiber.Map{"username": username})
+	return c.JSON(fiber.Map{"message": "Password changed"})
+}
+
+// exportDevices lists the known devices of a user for the personal-data export.
+func exportDevices(username string) (any, error) {
+	rows, err := db.Query("SELECT ip_prefix, user_agent, first_seen, last_seen FROM known_devices WHERE username = ? ORDER BY first_seen", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type device struct {
+		IPPrefix  string    `json:"ip_prefix"`
+		UserAgent string    `json:"user_agent"`
+		FirstSeen time.Time `json:"first_seen"`
+		LastSeen  time.Time `json:"last_seen"`
+	}
+	devices := []device{}
+	for rows.Next() {
+		var d device
+		if err := rows.Scan(&d.IPPrefix, &d.UserAgent, &d.FirstSeen, &d.LastSeen); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
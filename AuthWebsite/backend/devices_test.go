@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const otherBrowser = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:130.0) Gecko/20100101 Firefox/130.0"
+
+// loginFrom signs in from a browser with the given User-Agent and returns the
+// session cookie.
+func loginFrom(t *testing.T, username, password, userAgent string) *http.Cookie {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"`+username+`","password":"`+password+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := testApp.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, resp, 200)
+	return sessionCookie(resp)
+}
+
+// newDeviceAlert has a user with an email address sign in from a second browser
+// and returns the user's name, the token of the "this wasn't me" link and the
+// session of the second browser.
+func newDeviceAlert(t *testing.T) (username, token string, session *http.Cookie) {
+	t.Helper()
+	saved := deviceTracking
+	deviceTracking = deviceSensitivities["medium"]
+	t.Cleanup(func() { deviceTracking = saved })
+	notes := useRecordingNotifier(t)
+	username = newUsername()
+	email := username + "@example.com"
+	register(t, username, "correct horse")
+	decode(t, request(t, "PATCH", "/api/profile", fiber.Map{"email": email}, login(t, username, "correct horse")), 200)
+
+	session = loginFrom(t, username, "correct horse", otherBrowser)
+	link := regexp.MustCompile(`not-me=(\S+)`).FindStringSubmatch(notes.waitFor(t, email).Body)
+	if link == nil {
+		t.Fatal("new-device notification without a link")
+	}
+	return username, link[1], session
+}
+
+func TestDeviceResetRequiresReport(t *testing.T) {
+	username, token, _ := newDeviceAlert(t)
+
+	// The link alone does not allow setting a password.
+	reset := fiber.Map{"token": token, "password": "battery staple"}
+	decode(t, request(t, "POST", "/api/devices/reset-password", reset), 404)
+	login(t, username, "correct horse")
+
+	decode(t, request(t, "POST", "/api/devices/not-me", fiber.Map{"token": token}), 200)
+	decode(t, request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "correct horse"}), 403)
+	decode(t, request(t, "POST", "/api/devices/reset-password", reset), 200)
+	decode(t, request(t, "POST", "/api/devices/reset-password", reset), 404)
+	login(t, username, "battery staple")
+}
+
+func TestDeviceResetDirectoryAccount(t *testing.T) {
+	username, token, _ := newDeviceAlert(t)
+	if _, err := db.Exec("UPDATE users SET auth_source = 'ldap' WHERE username = ?", username); err != nil {
+		t.Fatal(err)
+	}
+	decode(t, request(t, "POST", "/api/devices/not-me", fiber.Map{"token": token}), 200)
+
+	// Refusing the reset leaves the link as it was.
+	reset := fiber.Map{"token": token, "password": "battery staple"}
+	for i := 0; i < 2; i++ {
+		if data := decode(t, request(t, "POST", "/api/devices/reset-password", reset), 403); data["error"] != "Password is managed by your directory" {
+			t.Errorf("reset of a directory account: %v", data)
+		}
+	}
+	if alert, err := lookupDeviceAlert(token); err != nil || !alert.Reported {
+		t.Errorf("alert after a refused reset = %+v (%v)", alert, err)
+	}
+}
+
+func TestLogNotifierRedactsSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+
+	token := generateToken()
+	err := logNotifier{}.Send(context.Background(), Notification{
+		Username: "alice",
+		Subject:  "New sign-in to your account",
+		Body:     "Secure your account here:\nhttp://localhost:8080/?not-me=" + token + "\n",
+		Secrets:  []string{token},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), token) {
+		t.Errorf("token logged: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "?not-me=[redacted]") {
+		t.Errorf("log = %s", buf.String())
+	}
+}
+
+func TestNotMeSecuresAccount(t *testing.T) {
+	username, token, intruder := newDeviceAlert(t)
+	own, planted := newSoftAuthenticator(t, true), newSoftAuthenticator(t, true)
+	cookie := login(t, username, "correct horse")
+	challenge := beginPasskey(t, "/api/webauthn/register/begin", fiber.Map{"password": "correct horse"}, cookie)
+	decode(t, request(t, "POST", "/api/webauthn/register/finish", own.attest(challenge, "none"), cookie), 200)
+	if _, err := db.Exec("UPDATE webauthn_credentials SET created_at = ? WHERE username = ?", time.Now().Add(-time.Hour), username); err != nil {
+		t.Fatal(err)
+	}
+	challenge = beginPasskey(t, "/api/webauthn/register/begin", fiber.Map{"password": "correct horse"}, intruder)
+	decode(t, request(t, "POST", "/api/webauthn/register/finish", planted.attest(challenge, "none"), intruder), 200)
+
+	got := decode(t, request(t, "POST", "/api/devices/not-me", fiber.Map{"token": token}), 200)
+	if removed := got["removed_passkeys"].([]any); len(removed) != 1 {
+		t.Errorf("removed passkeys = %v", removed)
+	}
+	decode(t, request(t, "GET", "/api/profile", nil, intruder), 401)
+
+	// No sign-in method gets around the reset.
+	if got := decode(t, passkeyLogin(t, username, own.assert), 403); got["error"] != "Password reset required" {
+		t.Errorf("passkey login: %v", got["error"])
+	}
+	decode(t, request(t, "POST", "/api/token", fiber.Map{"grant_type": "password", "username": username, "password": "correct horse"}), 403)
+
+	decode(t, request(t, "POST", "/api/devices/reset-password", fiber.Map{"token": token, "password": "battery staple"}), 200)
+	cookie = sessionCookie(passkeyLogin(t, username, own.assert))
+	if cookie == nil {
+		t.Fatal("passkey login after the reset did not set a session cookie")
+	}
+	if passkeys := decode(t, request(t, "GET", "/api/webauthn/credentials", nil, cookie), 200)["passkeys"].([]any); len(passkeys) != 1 ||
+		passkeys[0].(map[string]any)["id"] != own.rawID() {
+		t.Errorf("passkeys = %v", passkeys)
+	}
+}
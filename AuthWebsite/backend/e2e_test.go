@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRegisterLoginProfileLogout(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+
+	cookie := login(t, username, "correct horse")
+	if !cookie.HttpOnly {
+		t.Error("session cookie is not HttpOnly")
+	}
+	if ttl := time.Until(cookie.Expires); ttl < sessionTTL-time.Minute || ttl > sessionTTL {
+		t.Errorf("session cookie expires in %v, want about %v", ttl, sessionTTL)
+	}
+
+	profile := decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	if profile["username"] != username {
+		t.Errorf("profile username = %v, want %s", profile["username"], username)
+	}
+
+	resp := request(t, "POST", "/api/logout", nil, cookie)
+	decode(t, resp, 200)
+	cleared := sessionCookie(resp)
+	if cleared == nil || cleared.Value != "" || !cleared.Expires.Before(time.Now()) {
+		t.Errorf("logout did not clear the session cookie: %+v", cleared)
+	}
+
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 401)
+}
+
+func TestProfileRequiresSession(t *testing.T) {
+	for name, cookies := range map[string][]*http.Cookie{
+		"no cookie":      nil,
+		"empty cookie":   {{Name: "session_token", Value: ""}},
+		"unknown cookie": {{Name: "session_token", Value: generateToken()}},
+		"other cookie":   {{Name: "impersonator_token", Value: generateToken()}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := decode(t, request(t, "GET", "/api/profile", nil, cookies...), 401)
+			if data["error"] != "Unauthorized" {
+				t.Errorf("error = %v", data["error"])
+			}
+		})
+	}
+}
+
+func TestSessionsAreSeparate(t *testing.T) {
+	alice, bob := newUsername(), newUsername()
+	register(t, alice, "alice password")
+	register(t, bob, "bob password")
+	aliceCookie := login(t, alice, "alice password")
+	bobCookie := login(t, bob, "bob password")
+	if aliceCookie.Value == bobCookie.Value {
+		t.Fatal("two logins got the same session token")
+	}
+
+	decode(t, request(t, "POST", "/api/logout", nil, aliceCookie), 200)
+	profile := decode(t, request(t, "GET", "/api/profile", nil, bobCookie), 200)
+	if profile["username"] != bob {
+		t.Errorf("profile username = %v, want %s", profile["username"], bob)
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+
+	for name, body := range map[string]fiber.Map{
+		"wrong password": {"username": username, "password": "wrong horse"},
+		"unknown user":   {"username": newUsername(), "password": "correct horse"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp := request(t, "POST", "/api/login", body)
+			data := decode(t, resp, 401)
+			if data["error"] != "Invalid credentials" {
+				t.Errorf("error = %v", data["error"])
+			}
+			if sessionCookie(resp) != nil {
+				t.Error("failed login set a session cookie")
+			}
+		})
+	}
+}
+
+func TestDuplicateRegistration(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+
+	tests := []struct {
+		name     string
+		username string
+		status   int
+		error    string
+	}{
+		{"same name", username, 409, "Username is already taken"},
+		{"different case", "USER" + username[len("user"):], 409, "Username is already taken"},
+		{"confusable", "usеr" + username[len("user"):], 409, "Username is too similar to an existing account"},
+		{"reserved", "Admin", 400, "Username is reserved"},
+		{"not a PRECIS username", "two words", 400, "Invalid username"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := request(t, "POST", "/api/register", fiber.Map{"username": tt.username, "password": "another horse"})
+			data := decode(t, resp, tt.status)
+			if data["error"] != tt.error {
+				t.Errorf("error = %v, want %q", data["error"], tt.error)
+			}
+		})
+	}
+
+	// The first account keeps its password.
+	login(t, username, "correct horse")
+	decode(t, request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "another horse"}), 401)
+}
+
+func TestLoginIgnoresUsernameCase(t *testing.T) {
+	username := "Mixed" + newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, "mixed"+username[len("Mixed"):], "correct horse")
+	profile := decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	if profile["username"] != username {
+		t.Errorf("profile username = %v, want the registered spelling %s", profile["username"], username)
+	}
+}
+
+func TestMalformedJSON(t *testing.T) {
+	bodies := map[string]string{
+		"truncated":      `{"username": "x", "password":`,
+		"not an object":  `["x", "y"]`,
+		"wrong type":     `{"username": 5, "password": "correct horse"}`,
+		"missing field":  `{"username": "x"}`,
+		"empty username": `{"username": "", "password": "correct horse"}`,
+		"unknown field":  `{"username": "x", "password": "correct horse", "role": "admin"}`,
+		"empty body":     ``,
+	}
+	for _, path := range []string{"/api/register", "/api/login"} {
+		for name, body := range bodies {
+			t.Run(path+"/"+name, func(t *testing.T) {
+				resp := request(t, "POST", path, body)
+				data := decode(t, resp, 400)
+				if data["error"] != "Invalid request" {
+					t.Errorf("error = %v", data["error"])
+				}
+				if sessionCookie(resp) != nil {
+					t.Error("rejected request set a session cookie")
+				}
+			})
+		}
+	}
+}
+
+// TestConcurrentLoginLogout is mostly for the race detector: sessions of one user
+// are created, used and deleted from many goroutines at once.
+func TestConcurrentLoginLogout(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan string, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := send("POST", "/api/login", fiber.Map{"username": username, "password": "correct horse"})
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			resp.Body.Close()
+			cookie := sessionCookie(resp)
+			if resp.StatusCode != 200 || cookie == nil {
+				errs <- "login: " + resp.Status
+				return
+			}
+			for _, step := range []struct {
+				method, path string
+				status       int
+			}{
+				{"GET", "/api/profile", 200},
+				{"POST", "/api/logout", 200},
+				{"GET", "/api/profile", 401},
+			} {
+				resp, err := send(step.method, step.path, nil, cookie)
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != step.status {
+					errs <- step.method + " " + step.path + ": " + resp.Status
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := len(userSessions(username)); n != 0 {
+		t.Errorf("%d sessions left after every worker logged out", n)
+	}
+}
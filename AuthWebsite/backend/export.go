@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const exportTTL = 24 * time.Hour
+
+// Export job states.
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+// exportSection produces one JSON file of a personal-data export.
+type exportSection struct {
+	File    string
+	Collect func(username string) (any, error)
+}
+
+// exportSections lists everything stored about a user. Features that keep personal
+// data add their tables here.
+var exportSections = []exportSection{
+	{"user.json", exportUserRow},
+	{"sessions.json", exportSessions},
+	{"audit_log.json", exportAuditLog},
+	{"invitations.json", exportInvitations},
+	{"passkeys.json", exportPasskeys},
+	{"identities.json", exportIdentities},
+	{"token_families.json", exportTokenFamilies},
+	{"organizations.json", exportMemberships},
+	{"groups.json", exportGroups},
+	{"devices.json", exportDevices},
+	{"consents.json", exportConsents},
+}
+
+func exportUserRow(username string) (any, error) {
+	var u struct {
+		ID       int64   `json:"id"`
+		Username string  `json:"username"`
+		Role     string  `json:"role"`
+		Profile  profile `json:"profile"`
+	}
+	err := db.QueryRow("SELECT id, username, role FROM users WHERE username = ?", username).Scan(&u.ID, &u.Username, &u.Role)
+	if err != nil {
+		return nil, err
+	}
+	u.Profile, err = loadProfile(username)
+	return u, err
+}
+
+// exportSessions lists session metadata; tokens are identified by a hash, never by value.
+func exportSessions(username string) (any, error) {
+	type sessionInfo struct {
+		TokenSHA256 string    `json:"token_sha256"`
+		CreatedAt   time.Time `json:"created_at"`
+		ExpiresAt   time.Time `json:"expires_at"`
+		IP          string    `json:"ip,omitempty"`
+		Client      string    `json:"client,omitempty"`
+	}
+	result := []sessionInfo{}
+	for id, s := range userSessions(username) {
+		result = append(result, sessionInfo{id, s.CreatedAt, s.ExpiresAt, s.Binding.IP, s.Binding.Client})
+	}
+	return result, nil
+}
+
+func exportAuditLog(username string) (any, error) {
+	rows, err := db.Query("SELECT created_at, action, ip, detail FROM audit_log WHERE username = ? ORDER BY id", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type entry struct {
+		CreatedAt time.Time `json:"created_at"`
+		Action    string    `json:"action"`
+		IP        string    `json:"ip"`
+		Detail    string    `json:"detail"`
+	}
+	result := []entry{}
+	for rows.Next() {
+		var e entry
+		var detail sql.NullString
+		if err := rows.Scan(&e.CreatedAt, &e.Action, &e.IP, &detail); err != nil {
+			return nil, err
+		}
+		e.Detail = detail.String
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// exportInvitations lists invitations the user created, without the codes themselves.
+func exportInvitations(username string) (any, error) {
+	rows, err := db.Query("SELECT role, max_uses, uses, expires_at, created_at FROM invitations WHERE created_by = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type entry struct {
+		Role      string    `json:"role"`
+		MaxUses   int       `json:"max_uses"`
+		Uses      int       `json:"uses"`
+		ExpiresAt time.Time `json:"expires_at"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	result := []entry{}
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.Role, &e.MaxUses, &e.Uses, &e.ExpiresAt, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// buildExport writes every export section of username into a ZIP archive.
+func buildExport(username string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, section := range exportSections {
+		data, err := section.Collect(username)
+		if err != nil {
+			return nil, err
+		}
+		w, err := zw.Create(section.File)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runExport builds the archive for job id in the background and stores the result.
+func runExport(id, username string) {
+	archive, err := buildExport(username)
+	if err != nil {
+		log.Println("export:", err)
+		_, err = db.Exec("UPDATE data_exports SET status = ?, error = ?, pending_for = NULL WHERE id = ?", exportFailed, "export failed", id)
+	} else {
+		_, err = db.Exec("UPDATE data_exports SET status = ?, archive = ?, pending_for = NULL WHERE id = ?", exportReady, archive, id)
+	}
+	if err != nil {
+		log.Println("export:", err)
+	}
+}
+
+func requestExportHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	now := time.Now()
+	if _, err := db.Exec("DELETE FROM data_exports WHERE expires_at < ?", now); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+
+	// pending_for is unique, so of concurrent requests only one queues a job.
+	id := generateID()
+	_, err := db.Exec("INSERT INTO data_exports (id, username, status, pending_for, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, username, exportPending, username, now, now.Add(exportTTL))
+	if isDuplicateKey(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "An export is already being prepared"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(username, "data_export", c.IP(), id)
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runExport(id, username)
+	}()
+	return c.Status(202).JSON(fiber.Map{
+		"id":         id,
+		"status":     exportPending,
+		"status_url": "/api/account/export/" + id,
+	})
+}
+
+func exportStatusHandler(c *fiber.Ctx) error {
+	var status string
+	var errMsg sql.NullString
+	var createdAt, expiresAt time.Time
+	err := db.QueryRow("SELECT status, error, created_at, expires_at FROM data_exports WHERE id = ? AND username = ?",
+		c.Params("id"), c.Locals("username").(string)).Scan(&status, &errMsg, &createdAt, &expiresAt)
+	if err == sql.ErrNoRows || (err == nil && time.Now().After(expiresAt)) {
+		return c.Status(404).JSON(fiber.Map{"error": "Export not found"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+
+	resp := fiber.Map{"id": c.Params("id"), "status": status, "created_at": createdAt, "expires_at": expiresAt}
+	if status == exportReady {
+		resp["download_url"] = "/api/account/export/" + c.Params("id") + "/download"
+	}
+	if errMsg.Valid {
+		resp["error"] = errMsg.String
+	}
+	return c.JSON(resp)
+}
+
+func downloadExportHandler(c *fiber.Ctx) error {
+	var archive []byte
+	var expiresAt time.Time
+	err := db.QueryRow("SELECT archive, expires_at FROM data_exports WHERE id = ? AND username = ? AND status = ?",
+		c.Params("id"), c.Locals("username").(string), exportReady).Scan(&archive, &expiresAt)
+	if err == sql.ErrNoRows || (err == nil && time.Now().After(expiresAt)) {
+		return c.Status(404).JSON(fiber.Map{"error": "Export not found"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+
+	c.Attachment("personal-data-" + time.Now().Format("2006-01-02") + ".zip")
+	return c.Send(archive)
+}
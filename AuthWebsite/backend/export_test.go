@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// holdExports keeps export jobs pending until the returned release is called.
+func holdExports(t *testing.T) (release func()) {
+	t.Helper()
+	gate := make(chan struct{})
+	saved := exportSections
+	exportSections = append(exportSections[:len(exportSections):len(exportSections)], exportSection{"hold.json", func(string) (any, error) {
+		<-gate
+		return nil, nil
+	}})
+	var once sync.Once
+	release = func() { once.Do(func() { close(gate) }) }
+	t.Cleanup(func() {
+		release()
+		background.Wait()
+		exportSections = saved
+	})
+	return release
+}
+
+func TestConcurrentExportRequests(t *testing.T) {
+	holdExports(t)
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+
+	const workers = 8
+	var wg sync.WaitGroup
+	statuses := make(chan int, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := send("POST", "/api/account/export", nil, cookie)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[202] != 1 || counts[409] != workers-1 {
+		t.Errorf("statuses = %v, want one 202 and the rest 409", counts)
+	}
+	var queued int
+	if err := db.QueryRow("SELECT COUNT(*) FROM data_exports WHERE username = ?", username).Scan(&queued); err != nil || queued != 1 {
+		t.Errorf("%d exports queued (%v)", queued, err)
+	}
+}
+
+func TestExportDownload(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+	decode(t, request(t, "PATCH", "/api/profile", fiber.Map{"display_name": "Export Me"}, cookie), 200)
+
+	job := decode(t, request(t, "POST", "/api/account/export", nil, cookie), 202)
+	background.Wait()
+	status := decode(t, request(t, "GET", job["status_url"].(string), nil, cookie), 200)
+	if status["status"] != exportReady || status["download_url"] == nil {
+		t.Fatalf("status = %v", status)
+	}
+
+	resp := request(t, "GET", status["download_url"].(string), nil, cookie)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment") {
+		t.Fatalf("download: status %d, Content-Disposition %q", resp.StatusCode, resp.Header.Get("Content-Disposition"))
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = io.ReadAll(r)
+		r.Close()
+	}
+	for _, section := range exportSections {
+		if _, ok := files[section.File]; !ok {
+			t.Errorf("archive lacks %s", section.File)
+		}
+	}
+	var user struct {
+		Username string  `json:"username"`
+		Profile  profile `json:"profile"`
+	}
+	if err := json.Unmarshal(files["user.json"], &user); err != nil || user.Username != username || user.Profile.DisplayName != "Export Me" {
+		t.Errorf("user.json = %s (%v)", files["user.json"], err)
+	}
+	// Sessions are listed by hash; the token itself is never exported.
+	if bytes.Contains(files["sessions.json"], []byte(cookie.Value)) || !bytes.Contains(files["sessions.json"], []byte(hashToken(cookie.Value))) {
+		t.Errorf("sessions.json = %s", files["sessions.json"])
+	}
+
+	// Another account cannot see the export.
+	other := newUsername()
+	register(t, other, "correct horse")
+	otherCookie := login(t, other, "correct horse")
+	decode(t, request(t, "GET", job["status_url"].(string), nil, otherCookie), 404)
+	decode(t, request(t, "GET", status["download_url"].(string), nil, otherCookie), 404)
+
+	// Nor can an admin impersonating the owner download it.
+	impersonation := request(t, "POST", "/api/admin/impersonate", fiber.Map{"username": username, "reason": "ticket 44"}, admin(t))
+	decode(t, impersonation, 200)
+	decode(t, request(t, "GET", status["download_url"].(string), nil, sessionCookie(impersonation)), 403)
+
+	// The archive is gone once it expires.
+	if _, err := db.Exec("UPDATE data_exports SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute), job["id"]); err != nil {
+		t.Fatal(err)
+	}
+	decode(t, request(t, "GET", job["status_url"].(string), nil, cookie), 404)
+	decode(t, request(t, "GET", status["download_url"].(string), nil, cookie), 404)
+}
+
+func TestExportFailure(t *testing.T) {
+	saved := exportSections
+	exportSections = append(exportSections[:len(exportSections):len(exportSections)], exportSection{"broken.json", func(string) (any, error) {
+		return nil, io.ErrUnexpectedEOF
+	}})
+	t.Cleanup(func() { exportSections = saved })
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+
+	job := decode(t, request(t, "POST", "/api/account/export", nil, cookie), 202)
+	background.Wait()
+	status := decode(t, request(t, "GET", job["status_url"].(string), nil, cookie), 200)
+	if status["status"] != exportFailed || status["error"] != "export failed" || status["download_url"] != nil {
+		t.Errorf("status = %v", status)
+	}
+	decode(t, request(t, "GET", "/api/account/export/"+job["id"].(string)+"/download", nil, cookie), 404)
+	// A failed job does not block the next request.
+	decode(t, request(t, "POST", "/api/account/export", nil, cookie), 202)
+	background.Wait()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"authwebsite/authpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// authServer implements authpb.AuthService on the same session store and users
+// table as the HTTP API.
+type authServer struct {
+	authpb.UnimplementedAuthServiceServer
+}
+
+func sessionProto(id string, s session) *authpb.Session {
+	return &authpb.Session{
+		Id:           id,
+		Username:     s.Username,
+		CreatedAt:    timestamppb.New(s.CreatedAt),
+		ExpiresAt:    timestamppb.New(s.ExpiresAt),
+		Impersonator: s.Impersonator,
+		OrgId:        s.OrgID,
+	}
+}
+
+func loadUserProto(ctx context.Context, username string) (*authpb.User, error) {
+	u := &authpb.User{}
+	err := db.QueryRowContext(ctx, `SELECT id, username, role, display_name, email, avatar_url, locale, timezone, auth_source, active
+            FROM users WHERE username = ?`, username).
+		Scan(&u.Id, &u.Username, &u.Role, &u.DisplayName, &u.Email, &u.AvatarUrl, &u.Locale, &u.Timezone, &u.AuthSource, &u.Active)
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "user not found")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "DB error")
+	}
+	return u, nil
+}
+
+func (authServer) ValidateSession(ctx context.Context, req *authpb.ValidateSessionRequest) (*authpb.ValidateSessionResponse, error) {
+	s, ok := lookupSession(req.Token)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid or expired session")
+	}
+	// The session must be as usable as it would be for the HTTP API.
+	if s.StepUp {
+		return nil, status.Error(codes.FailedPrecondition, "session must be confirmed with the password")
+	}
+	switch err := checkAccountUsable(s.Username); {
+	case errors.Is(err, errAccountDisabled):
+		return nil, status.Error(codes.Unauthenticated, "account is disabled")
+	case errors.Is(err, errPasswordResetRequired):
+		return nil, status.Error(codes.FailedPrecondition, "password reset required")
+	case errors.Is(err, errPasswordExpired):
+		return nil, status.Error(codes.FailedPrecondition, "password expired")
+	case err != nil:
+		return nil, status.Error(codes.Internal, "DB error")
+	}
+	u, err := loadUserProto(ctx, s.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &authpb.ValidateSessionResponse{Session: sessionProto(hashToken(req.Token), s), User: u}, nil
+}
+
+// GetUser and ListUserSessions look users up by their canonical key, like sign-ins.
+func (authServer) GetUser(ctx context.Context, req *authpb.GetUserRequest) (*authpb.User, error) {
+	return loadUserProto(ctx, resolveUsername(req.Username))
+}
+
+func (authServer) RevokeSession(ctx context.Context, req *authpb.RevokeSessionRequest) (*authpb.RevokeSessionResponse, error) {
+	id := req.GetId()
+	if id == "" {
+		id = hashToken(req.GetToken())
+	}
+	s, ok := lookupSessionByID(id)
+	if !ok {
+		return &authpb.RevokeSessionResponse{Revoked: false}, nil
+	}
+	deleteSessionByID(id)
+	audit(s.Username, "session_revoke", "", "grpc")
+	return &authpb.RevokeSessionResponse{Revoked: true}, nil
+}
+
+func (authServer) ListUserSessions(ctx context.Context, req *authpb.ListUserSessionsRequest) (*authpb.ListUserSessionsResponse, error) {
+	resp := &authpb.ListUserSessionsResponse{}
+	for id, s := range userSessions(resolveUsername(req.Username)) {
+		resp.Sessions = append(resp.Sessions, sessionProto(id, s))
+	}
+	return resp, nil
+}
+
+// grpcMetrics records RPCs in the same histogram as HTTP requests.
+func grpcMetrics(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	requestDuration.WithLabelValues("GRPC", info.FullMethod, status.Code(err).String()).
+		Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// grpcToken returns an interceptor that admits only calls carrying the shared
+// secret as "authorization: Bearer <token>" metadata.
+func grpcToken(token string) grpc.UnaryServerInterceptor {
+	want := []byte("Bearer " + token)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, got := range md.Get("authorization") {
+			if subtle.ConstantTimeCompare([]byte(got), want) == 1 {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid credentials")
+	}
+}
+
+// grpcConfig is how the gRPC service secures its transport and authenticates its
+// callers.
+type grpcConfig struct {
+	Creds credentials.TransportCredentials
+	Token string // shared secret callers must present, empty when mTLS vouches for them
+}
+
+// loadGRPCConfig builds the transport security from AUTH_GRPC_CERT and AUTH_GRPC_KEY.
+// Every caller must be authenticated: with AUTH_GRPC_CLIENT_CA by a certificate
+// signed by that CA (mTLS), otherwise by the shared secret AUTH_GRPC_TOKEN.
+// Plaintext is refused unless AUTH_GRPC_INSECURE is "true", for sidecars on a
+// loopback or otherwise private link; the token is still required then.
+func loadGRPCConfig() (grpcConfig, error) {
+	certFile, keyFile := envOr("AUTH_GRPC_CERT", ""), envOr("AUTH_GRPC_KEY", "")
+	caFile := envOr("AUTH_GRPC_CLIENT_CA", "")
+	cfg := grpcConfig{Token: envOr("AUTH_GRPC_TOKEN", "")}
+	if certFile == "" {
+		if caFile != "" {
+			return grpcConfig{}, fmt.Errorf("AUTH_GRPC_CLIENT_CA requires AUTH_GRPC_CERT and AUTH_GRPC_KEY")
+		}
+		if envOr("AUTH_GRPC_INSECURE", "false") != "true" {
+			return grpcConfig{}, fmt.Errorf("AUTH_GRPC_CERT and AUTH_GRPC_KEY are required, or AUTH_GRPC_INSECURE=true for plaintext")
+		}
+		if cfg.Token == "" {
+			return grpcConfig{}, fmt.Errorf("AUTH_GRPC_TOKEN is required without TLS")
+		}
+		log.Println("gRPC server is running without TLS")
+		cfg.Creds = insecure.NewCredentials()
+		return cfg, nil
+	}
+	if caFile == "" && cfg.Token == "" {
+		return grpcConfig{}, fmt.Errorf("AUTH_GRPC_CLIENT_CA or AUTH_GRPC_TOKEN is required to authenticate gRPC callers")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return grpcConfig{}, err
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return grpcConfig{}, err
+		}
+		tlsCfg.ClientCAs = x509.NewCertPool()
+		if !tlsCfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return grpcConfig{}, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	cfg.Creds = credentials.NewTLS(tlsCfg)
+	return cfg, nil
+}
+
+func newGRPCServer(cfg grpcConfig) *grpc.Server {
+	interceptors := []grpc.UnaryServerInterceptor{grpcMetrics}
+	if cfg.Token != "" {
+		interceptors = append(interceptors, grpcToken(cfg.Token))
+	}
+	s := grpc.NewServer(grpc.Creds(cfg.Creds), grpc.ChainUnaryInterceptor(interceptors...))
+	authpb.RegisterAuthServiceServer(s, authServer{})
+	return s
+}
+
+// serveGRPC starts the gRPC service on AUTH_GRPC_ADDR. It returns nil when the
+// address is not set.
+func serveGRPC() (*grpc.Server, error) {
+	addr := envOr("AUTH_GRPC_ADDR", "")
+	if addr == "" {
+		return nil, nil
+	}
+	cfg, err := loadGRPCConfig()
+	if err != nil {
+		return nil, err
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := newGRPCServer(cfg)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			log.Println("grpc server:", err)
+		}
+	}()
+	return s, nil
+}
+
+// stopGRPC waits up to timeout for in-flight RPCs before closing connections.
+func stopGRPC(s *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.Stop()
+	}
+}
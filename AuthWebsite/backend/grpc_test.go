@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"authwebsite/authpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const testGRPCToken = "grpc-s3cret"
+
+// grpcClient serves the gRPC service over an in-memory connection for the rest of
+// the test. Calls carry token as their credentials.
+func grpcClient(t *testing.T, token string) authpb.AuthServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := newGRPCServer(grpcConfig{Creds: insecure.NewCredentials(), Token: testGRPCToken})
+	go s.Serve(lis)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if token != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Stop()
+	})
+	return authpb.NewAuthServiceClient(conn)
+}
+
+func TestGRPCRequiresToken(t *testing.T) {
+	for name, token := range map[string]string{"no token": "", "wrong token": "guess"} {
+		t.Run(name, func(t *testing.T) {
+			_, err := grpcClient(t, token).GetUser(context.Background(), &authpb.GetUserRequest{Username: "nobody"})
+			if status.Code(err) != codes.Unauthenticated {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestGRPCSessions(t *testing.T) {
+	ctx := context.Background()
+	client := grpcClient(t, testGRPCToken)
+	username := newUsername()
+	register(t, username, "correct horse")
+	first, second := login(t, username, "correct horse").Value, login(t, username, "correct horse").Value
+
+	validated, err := client.ValidateSession(ctx, &authpb.ValidateSessionRequest{Token: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validated.User.Username != username || validated.Session.Id != hashToken(first) {
+		t.Errorf("validated = %v", validated)
+	}
+
+	// Usernames are matched by their canonical key, like at sign-in.
+	u, err := client.GetUser(ctx, &authpb.GetUserRequest{Username: strings.ToUpper(username)})
+	if err != nil || u.Username != username {
+		t.Errorf("GetUser = %v, %v", u, err)
+	}
+	listed, err := client.ListUserSessions(ctx, &authpb.ListUserSessionsRequest{Username: strings.ToUpper(username)})
+	if err != nil || len(listed.Sessions) != 2 {
+		t.Fatalf("ListUserSessions = %v, %v", listed, err)
+	}
+	for _, s := range listed.Sessions {
+		if s.Id != hashToken(first) && s.Id != hashToken(second) {
+			t.Errorf("unexpected session id %s", s.Id)
+		}
+	}
+
+	for _, req := range []*authpb.RevokeSessionRequest{
+		{Session: &authpb.RevokeSessionRequest_Id{Id: hashToken(first)}},
+		{Session: &authpb.RevokeSessionRequest_Token{Token: second}},
+	} {
+		revoked, err := client.RevokeSession(ctx, req)
+		if err != nil || !revoked.Revoked {
+			t.Fatalf("RevokeSession(%v) = %v, %v", req, revoked, err)
+		}
+		if revoked, err = client.RevokeSession(ctx, req); err != nil || revoked.Revoked {
+			t.Errorf("second RevokeSession(%v) = %v, %v", req, revoked, err)
+		}
+	}
+	for _, token := range []string{first, second} {
+		if _, err := client.ValidateSession(ctx, &authpb.ValidateSessionRequest{Token: token}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("revoked session validated: %v", err)
+		}
+	}
+}
+
+func TestGRPCValidateSessionChecksAccount(t *testing.T) {
+	ctx := context.Background()
+	client := grpcClient(t, testGRPCToken)
+	tests := []struct {
+		name  string
+		apply func(t *testing.T, username string, cookie *http.Cookie)
+		code  codes.Code
+	}{
+		{"step-up pending", func(t *testing.T, _ string, cookie *http.Cookie) { requireStepUp(t, cookie) }, codes.FailedPrecondition},
+		{"disabled", func(t *testing.T, username string, _ *http.Cookie) {
+			if _, err := db.Exec("UPDATE users SET active = 0 WHERE username = ?", username); err != nil {
+				t.Fatal(err)
+			}
+		}, codes.Unauthenticated},
+		{"password expired", func(t *testing.T, username string, _ *http.Cookie) {
+			saved := passwordPolicy
+			passwordPolicy = passwordPolicyConfig{MaxAge: time.Hour, ExpiringRoles: map[string]bool{"user": true}}
+			t.Cleanup(func() { passwordPolicy = saved })
+			if _, err := db.Exec("UPDATE users SET password_changed_at = ? WHERE username = ?", time.Now().Add(-2*time.Hour), username); err != nil {
+				t.Fatal(err)
+			}
+		}, codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username := newUsername()
+			register(t, username, "correct horse")
+			cookie := login(t, username, "correct horse")
+			tt.apply(t, username, cookie)
+			if _, err := client.ValidateSession(ctx, &authpb.ValidateSessionRequest{Token: cookie.Value}); status.Code(err) != tt.code {
+				t.Errorf("err = %v, want %v", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestGRPCConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{"plaintext without opt-in", map[string]string{"AUTH_GRPC_TOKEN": testGRPCToken}, false},
+		{"plaintext without token", map[string]string{"AUTH_GRPC_INSECURE": "true"}, false},
+		{"plaintext with token", map[string]string{"AUTH_GRPC_INSECURE": "true", "AUTH_GRPC_TOKEN": testGRPCToken}, true},
+		{"TLS without caller authentication", map[string]string{"AUTH_GRPC_CERT": "cert.pem", "AUTH_GRPC_KEY": "key.pem"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, k := range []string{"AUTH_GRPC_CERT", "AUTH_GRPC_KEY", "AUTH_GRPC_CLIENT_CA", "AUTH_GRPC_TOKEN", "AUTH_GRPC_INSECURE"} {
+				t.Setenv(k, tc.env[k])
+			}
+			if _, err := loadGRPCConfig(); (err == nil) != tc.ok {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
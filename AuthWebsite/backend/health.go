@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// shuttingDown flips /readyz to 503 so load balancers stop routing new traffic.
+var shuttingDown atomic.Bool
+
+func healthzHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+func readyzHandler(c *fiber.Ctx) error {
+	if shuttingDown.Load() {
+		return c.Status(503).JSON(fiber.Map{"status": "shutting down"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		// The driver's error can name the database host, so it only goes to the log.
+		log.Println("readyz: database:", err)
+		return c.Status(503).JSON(fiber.Map{"status": "unavailable", "error": "database unavailable"})
+	}
+	if err := checkSessionStore(); err != nil {
+		return c.Status(503).JSON(fiber.Map{"status": "unavailable", "error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"status": "ready"})
+}
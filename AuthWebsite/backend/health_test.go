@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	if data := decode(t, request(t, "GET", "/healthz", nil), 200); data["status"] != "ok" {
+		t.Errorf("healthz = %v", data)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	if data := decode(t, request(t, "GET", "/readyz", nil), 200); data["status"] != "ready" {
+		t.Errorf("readyz = %v", data)
+	}
+
+	t.Run("shutting down", func(t *testing.T) {
+		shuttingDown.Store(true)
+		t.Cleanup(func() { shuttingDown.Store(false) })
+		if data := decode(t, request(t, "GET", "/readyz", nil), 503); data["status"] != "shutting down" {
+			t.Errorf("readyz = %v", data)
+		}
+	})
+
+	t.Run("session store closed", func(t *testing.T) {
+		sessionsClosed.Store(true)
+		t.Cleanup(func() { sessionsClosed.Store(false) })
+		decode(t, request(t, "GET", "/readyz", nil), 503)
+	})
+
+	t.Run("database down", func(t *testing.T) {
+		// Nothing listens on port 1, so the ping fails with an error naming the host.
+		down, err := sql.Open("mysql", "root:secret@tcp(127.0.0.1:1)/passwords_db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := db
+		db = down
+		t.Cleanup(func() {
+			db = saved
+			down.Close()
+		})
+
+		resp := request(t, "GET", "/readyz", nil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 503 || !strings.Contains(string(body), `"database unavailable"`) {
+			t.Errorf("status %d: %s", resp.StatusCode, body)
+		}
+		for _, secret := range []string{"127.0.0.1", "secret"} {
+			if strings.Contains(string(body), secret) {
+				t.Errorf("readyz reveals %q: %s", secret, body)
+			}
+		}
+	})
+}
+
+// TestShutdownFlush runs the steps shutdown takes before closing the database and
+// checks that sessions and queued audit entries reach it.
+func TestShutdownFlush(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+
+	t.Cleanup(func() {
+		sessionsClosed.Store(false)
+		// flushAudit closes the queue for good; give the remaining tests a new one.
+		auditMu.Lock()
+		auditQueue, auditClosed = make(chan auditEntry, 1024), false
+		auditMu.Unlock()
+		startAuditWriter()
+	})
+	if err := flushSessions(); err != nil {
+		t.Fatal(err)
+	}
+	// Queued after the session flush: the test database's transactions would
+	// otherwise undo inserts made while flushSessions runs.
+	audit(username, "shutdown_test", "192.0.2.1", "")
+	flushAudit()
+
+	var stored, audited int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sessions WHERE token = ?", hashToken(cookie.Value)).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE username = ? AND action = 'shutdown_test'", username).Scan(&audited); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 || audited != 1 {
+		t.Errorf("%d sessions and %d audit entries written, want 1 and 1", stored, audited)
+	}
+
+	// Once the sessions are flushed, the service reports itself unready.
+	decode(t, request(t, "GET", "/readyz", nil), 503)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Support staff can act as another user through a separate, short-lived session that
+// records the admin as its Impersonator. The admin's own session is kept in the
+// impersonator_token cookie so that stopping restores it.
+
+var impersonationTTL = 30 * time.Minute
+
+func loadImpersonationConfig() (err error) {
+	impersonationTTL, err = time.ParseDuration(envOr("AUTH_IMPERSONATION_TTL", "30m"))
+	return err
+}
+
+// impersonationAuditMiddleware records every request made in an impersonated session
+// under the admin's name.
+func impersonationAuditMiddleware(c *fiber.Ctx) error {
+	sess := c.Locals("session").(session)
+	if sess.Impersonator != "" {
+		audit(sess.Impersonator, "impersonation_request", c.IP(), c.Method()+" "+c.Path()+" as "+sess.Username)
+	}
+	return c.Next()
+}
+
+// denyImpersonation guards actions that only the account owner may take.
+func denyImpersonation(c *fiber.Ctx) error {
+	if c.Locals("session").(session).Impersonator != "" {
+		return c.Status(403).JSON(fiber.Map{"error": "Not allowed while impersonating"})
+	}
+	return c.Next()
+}
+
+func impersonationInfo(sess session) fiber.Map {
+	if sess.Impersonator == "" {
+		return nil
+	}
+	return fiber.Map{"impersonator": sess.Impersonator, "expires_at": sess.ExpiresAt}
+}
+
+// startImpersonationHandler lets an admin act as a non-admin user. The reason is
+// required and ends up in the audit log of both accounts.
+func startImpersonationHandler(c *fiber.Ctx) error {
+	admin := c.Locals("username").(string)
+	adminSess := c.Locals("session").(session)
+	var data struct {
+		Username string `json:"username"`
+		Reason   string `json:"reason"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	data.Reason = strings.TrimSpace(data.Reason)
+	data.Username = resolveUsername(data.Username)
+	if data.Reason == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "A reason is required"})
+	}
+	if data.Username == admin {
+		return c.Status(400).JSON(fiber.Map{"error": "Cannot impersonate yourself"})
+	}
+
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE username = ?", data.Username).Scan(&role)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if role == "admin" {
+		return c.Status(403).JSON(fiber.Map{"error": "Admins cannot be impersonated"})
+	}
+
+	// The support session never outlives the admin's own.
+	ttl := impersonationTTL
+	if remaining := time.Until(adminSess.ExpiresAt); remaining < ttl {
+		ttl = remaining
+	}
+	token, sess := createSession(session{Username: data.Username, Impersonator: admin, Binding: requestBinding(c)}, ttl)
+	audit(admin, "impersonation_start", c.IP(), data.Username+": "+data.Reason)
+	audit(data.Username, "impersonated", c.IP(), "by "+admin+": "+data.Reason)
+
+	// The token goes only into an HttpOnly cookie, never into the response body,
+	// where scripts and logs could pick it up.
+	if cookie := c.Cookies("session_token"); cookie != "" {
+		c.Cookie(&fiber.Cookie{
+			Name:     "impersonator_token",
+			Value:    cookie,
+			Expires:  adminSess.ExpiresAt,
+			HTTPOnly: true,
+			Secure:   secureCookies,
+		})
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     "session_token",
+		Value:    token,
+		Expires:  sess.ExpiresAt,
+		HTTPOnly: true,
+		Secure:   secureCookies,
+	})
+	return c.JSON(fiber.Map{
+		"message":    "Impersonating " + data.Username,
+		"username":   data.Username,
+		"expires_at": sess.ExpiresAt,
+	})
+}
+
+// stopImpersonationHandler ends the support session and, for browser sessions,
+// switches the cookie back to the admin's own session.
+func stopImpersonationHandler(c *fiber.Ctx) error {
+	sess := c.Locals("session").(session)
+	if sess.Impersonator == "" {
+		return c.Status(409).JSON(fiber.Map{"error": "Not impersonating"})
+	}
+	deleteSession(c.Locals("token").(string))
+	audit(sess.Impersonator, "impersonation_stop", c.IP(), sess.Username)
+
+	if own := c.Cookies("impersonator_token"); own != "" {
+		c.Cookie(&fiber.Cookie{
+			Name:     "impersonator_token",
+			Value:    "",
+			Expires:  time.Now().Add(-1 * time.Hour),
+			HTTPOnly: true,
+			Secure:   secureCookies,
+		})
+		restored, ok := lookupSession(own)
+		if ok && restored.Username == sess.Impersonator && restored.Impersonator == "" {
+			c.Cookie(&fiber.Cookie{
+				Name:     "session_token",
+				Value:    own,
+				Expires:  restored.ExpiresAt,
+				HTTPOnly: true,
+				Secure:   secureCookies,
+			})
+		} else {
+			c.Cookie(&fiber.Cookie{
+				Name:     "session_token",
+				Value:    "",
+				Expires:  time.Now().Add(-1 * time.Hour),
+				HTTPOnly: true,
+				Secure:   secureCookies,
+			})
+		}
+	}
+	return c.JSON(fiber.Map{"message": "Impersonation ended", "username": sess.Impersonator})
+}
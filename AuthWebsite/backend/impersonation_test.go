@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestImpersonationSessionRestrictions(t *testing.T) {
+	_, owner := newOrg(t)
+	username := newUsername()
+	register(t, username, "correct horse")
+	inv := decode(t, request(t, "POST", "/api/orgs/current/invitations", fiber.Map{"username": username}, owner), 201)
+
+	resp := request(t, "POST", "/api/admin/impersonate", fiber.Map{"username": username, "reason": "ticket 42"}, admin(t))
+	body := decode(t, resp, 200)
+	if _, ok := body["token"]; ok {
+		t.Error("impersonation response carries the session token")
+	}
+	cookie := sessionCookie(resp)
+	if cookie == nil {
+		t.Fatal("no session cookie for the impersonation session")
+	}
+	if me := decode(t, request(t, "GET", "/api/profile", nil, cookie), 200); me["username"] != username {
+		t.Fatalf("impersonating as %v", me["username"])
+	}
+
+	for _, r := range []struct{ method, path string }{
+		{"PATCH", "/api/profile"},
+		{"POST", "/api/orgs/invitations/" + inv["id"].(string) + "/accept"},
+	} {
+		got := decode(t, request(t, r.method, r.path, fiber.Map{}, cookie), 403)
+		if got["error"] != "Not allowed while impersonating" {
+			t.Errorf("%s %s: %v", r.method, r.path, got["error"])
+		}
+	}
+}
+
+func TestImpersonationCannotManageOrgs(t *testing.T) {
+	slug, owner := newOrg(t)
+	username := decode(t, request(t, "GET", "/api/profile", nil, owner), 200)["username"].(string)
+	member := newUsername()
+	register(t, member, "correct horse")
+
+	resp := request(t, "POST", "/api/admin/impersonate", fiber.Map{"username": strings.ToUpper(username), "reason": "ticket 43"}, admin(t))
+	decode(t, resp, 200)
+	cookie := sessionCookie(resp)
+	if cookie == nil {
+		t.Fatal("no session cookie for the impersonation session")
+	}
+
+	for _, r := range []struct {
+		method, path string
+		body         fiber.Map
+	}{
+		{"POST", "/api/orgs", fiber.Map{"slug": "org-" + member, "name": "Org " + member}},
+		{"POST", "/api/orgs/switch", fiber.Map{"slug": slug}},
+		{"POST", "/api/orgs/current/invitations", fiber.Map{"username": member}},
+		{"PATCH", "/api/orgs/current/members/" + username, fiber.Map{"role": "member"}},
+		{"DELETE", "/api/orgs/current/members/" + username, nil},
+		{"GET", "/api/account/export/1/download", nil},
+	} {
+		got := decode(t, request(t, r.method, r.path, r.body, cookie), 403)
+		if got["error"] != "Not allowed while impersonating" {
+			t.Errorf("%s %s: %v", r.method, r.path, got["error"])
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Registration modes.
+const (
+	registrationOpen       = "open"
+	registrationInviteOnly = "invite-only"
+	registrationClosed     = "closed"
+)
+
+var roles = map[string]bool{"user": true, "admin": true}
+
+var errInvalidInvitation = errors.New("invitation code is invalid, expired or used up")
+
+// registrationMode returns the mode set by an admin, falling back to AUTH_REGISTRATION_MODE.
+func registrationMode() (string, error) {
+	return getSetting("registration_mode", envOr("AUTH_REGISTRATION_MODE", registrationOpen))
+}
+
+// redeemInvitation consumes one use of code inside tx and returns the role it grants.
+func redeemInvitation(tx *sql.Tx, code string) (string, error) {
+	res, err := tx.Exec("UPDATE invitations SET uses = uses + 1 WHERE code = ? AND uses < max_uses AND expires_at > ?",
+		code, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", errInvalidInvitation
+	}
+
+	var role string
+	err = tx.QueryRow("SELECT role FROM invitations WHERE code = ?", code).Scan(&role)
+	return role, err
+}
+
+func getRegistrationModeHandler(c *fiber.Ctx) error {
+	mode, err := registrationMode()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(fiber.Map{"mode": mode})
+}
+
+func setRegistrationModeHandler(c *fiber.Ctx) error {
+	var data struct {
+		Mode string `json:"mode"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	switch data.Mode {
+	case registrationOpen, registrationInviteOnly, registrationClosed:
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "Mode must be open, invite-only or closed"})
+	}
+	if err := setSetting("registration_mode", data.Mode); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(c.Locals("username").(string), "registration_mode", c.IP(), data.Mode)
+	return c.JSON(fiber.Map{"mode": data.Mode})
+}
+
+type invitation struct {
+	Code      string    `json:"code"`
+	Role      string    `json:"role"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func createInvitationHandler(c *fiber.Ctx) error {
+	data := struct {
+		Role           string `json:"role"`
+		MaxUses        int    `json:"max_uses"`
+		ExpiresInHours int    `json:"expires_in_hours"`
+	}{Role: "user", MaxUses: 1, ExpiresInHours: 72}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if !roles[data.Role] {
+		return c.Status(400).JSON(fiber.Map{"error": "Unknown role"})
+	}
+	if data.MaxUses < 1 || data.ExpiresInHours < 1 {
+		return c.Status(400).JSON(fiber.Map{"error": "max_uses and expires_in_hours must be positive"})
+	}
+
+	now := time.Now()
+	inv := invitation{
+		Code:      generateToken(),
+		Role:      data.Role,
+		MaxUses:   data.MaxUses,
+		ExpiresAt: now.Add(time.Duration(data.ExpiresInHours) * time.Hour),
+		CreatedBy: c.Locals("username").(string),
+		CreatedAt: now,
+	}
+	_, err := db.Exec(`INSERT INTO invitations (code, role, max_uses, expires_at, created_by, created_at)
+            VALUES (?, ?, ?, ?, ?, ?)`, inv.Code, inv.Role, inv.MaxUses, inv.ExpiresAt, inv.CreatedBy, inv.CreatedAt)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(inv.CreatedBy, "invitation_create", c.IP(), inv.Role)
+	return c.Status(201).JSON(inv)
+}
+
+func listInvitationsHandler(c *fiber.Ctx) error {
+	rows, err := db.Query("SELECT code, role, max_uses, uses, expires_at, created_by, created_at FROM invitations ORDER BY created_at DESC")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer rows.Close()
+	invitations := []invitation{}
+	for rows.Next() {
+		var inv invitation
+		if err := rows.Scan(&inv.Code, &inv.Role, &inv.MaxUses, &inv.Uses, &inv.ExpiresAt, &inv.CreatedBy, &inv.CreatedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		}
+		invitations = append(invitations, inv)
+	}
+	return c.JSON(fiber.Map{"invitations": invitations})
+}
+
+func deleteInvitationHandler(c *fiber.Ctx) error {
+	res, err := db.Exec("DELETE FROM invitations WHERE code = ?", c.Params("code"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Invitation not found"})
+	}
+	audit(c.Locals("username").(string), "invitation_delete", c.IP(), "")
+	return c.JSON(fiber.Map{"message": "Invitation revoked"})
+}
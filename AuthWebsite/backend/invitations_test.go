@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setRegistrationMode switches the mode for one test and reopens registration afterwards.
+func setRegistrationMode(t *testing.T, adminCookie *http.Cookie, mode string) {
+	t.Helper()
+	decode(t, request(t, "PUT", "/api/admin/registration-mode", fiber.Map{"mode": mode}, adminCookie), 200)
+	t.Cleanup(func() {
+		if err := setSetting("registration_mode", registrationOpen); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func createInvitation(t *testing.T, adminCookie *http.Cookie, body fiber.Map) string {
+	t.Helper()
+	inv := decode(t, request(t, "POST", "/api/admin/invitations", body, adminCookie), 201)
+	code, _ := inv["code"].(string)
+	if code == "" {
+		t.Fatalf("invitation has no code: %v", inv)
+	}
+	return code
+}
+
+func TestInviteOnlyRegistration(t *testing.T) {
+	adminCookie := admin(t)
+	setRegistrationMode(t, adminCookie, registrationInviteOnly)
+	if got := decode(t, request(t, "GET", "/api/registration-mode", nil), 200)["mode"]; got != registrationInviteOnly {
+		t.Fatalf("mode = %v", got)
+	}
+
+	resp := request(t, "POST", "/api/register", fiber.Map{"username": newUsername(), "password": "correct horse"})
+	if data := decode(t, resp, 403); data["error"] != "An invitation code is required to register" {
+		t.Errorf("without a code: %v", data)
+	}
+	resp = request(t, "POST", "/api/register", fiber.Map{"username": newUsername(), "password": "correct horse", "invite_code": "bogus"})
+	decode(t, resp, 403)
+
+	code := createInvitation(t, adminCookie, fiber.Map{"role": "admin", "max_uses": 1})
+	username := newUsername()
+	resp = request(t, "POST", "/api/register", fiber.Map{"username": username, "password": "correct horse", "invite_code": code})
+	decode(t, resp, 200)
+	var role string
+	if err := db.QueryRow("SELECT role FROM users WHERE username = ?", username).Scan(&role); err != nil || role != "admin" {
+		t.Errorf("role = %q (%v), want the invitation's admin", role, err)
+	}
+
+	// The single use is spent.
+	resp = request(t, "POST", "/api/register", fiber.Map{"username": newUsername(), "password": "correct horse", "invite_code": code})
+	decode(t, resp, 403)
+}
+
+func TestExpiredInvitation(t *testing.T) {
+	adminCookie := admin(t)
+	setRegistrationMode(t, adminCookie, registrationInviteOnly)
+	code := createInvitation(t, adminCookie, fiber.Map{})
+	if _, err := db.Exec("UPDATE invitations SET expires_at = ? WHERE code = ?", time.Now().Add(-time.Minute), code); err != nil {
+		t.Fatal(err)
+	}
+	resp := request(t, "POST", "/api/register", fiber.Map{"username": newUsername(), "password": "correct horse", "invite_code": code})
+	decode(t, resp, 403)
+}
+
+func TestClosedRegistration(t *testing.T) {
+	adminCookie := admin(t)
+	setRegistrationMode(t, adminCookie, registrationClosed)
+	code := createInvitation(t, adminCookie, fiber.Map{})
+	resp := request(t, "POST", "/api/register", fiber.Map{"username": newUsername(), "password": "correct horse", "invite_code": code})
+	if data := decode(t, resp, 403); data["error"] != "Registration is closed" {
+		t.Errorf("closed registration: %v", data)
+	}
+}
+
+func TestManageInvitations(t *testing.T) {
+	adminCookie := admin(t)
+	decode(t, request(t, "PUT", "/api/admin/registration-mode", fiber.Map{"mode": "members-only"}, adminCookie), 400)
+	decode(t, request(t, "POST", "/api/admin/invitations", fiber.Map{"role": "owner"}, adminCookie), 400)
+	decode(t, request(t, "POST", "/api/admin/invitations", fiber.Map{"max_uses": 0}, adminCookie), 400)
+
+	code := createInvitation(t, adminCookie, fiber.Map{"max_uses": 3, "expires_in_hours": 1})
+	listed := false
+	for _, inv := range decode(t, request(t, "GET", "/api/admin/invitations", nil, adminCookie), 200)["invitations"].([]any) {
+		if inv := inv.(map[string]any); inv["code"] == code {
+			listed = inv["role"] == "user" && inv["max_uses"] == float64(3) && inv["uses"] == float64(0)
+		}
+	}
+	if !listed {
+		t.Error("new invitation is not listed with its defaults")
+	}
+
+	decode(t, request(t, "DELETE", "/api/admin/invitations/"+code, nil, adminCookie), 200)
+	decode(t, request(t, "DELETE", "/api/admin/invitations/"+code, nil, adminCookie), 404)
+
+	username := newUsername()
+	register(t, username, "correct horse")
+	decode(t, request(t, "POST", "/api/admin/invitations", fiber.Map{}, login(t, username, "correct horse")), 403)
+}
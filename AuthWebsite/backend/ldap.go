@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+type ldapConfig struct {
+	URL                string // ldap:// or ldaps://
+	StartTLS           bool
+	InsecureSkipVerify bool
+	CAFile             string
+	BindDN             string // service account used for the user search
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string            // %s is replaced by the escaped username
+	GroupRoles         map[string]string // lower-cased group DN → role
+}
+
+// loadLDAPConfig reads the AUTH_LDAP_* variables. AUTH_LDAP_GROUP_ROLES holds
+// "role:groupDN" pairs separated by semicolons.
+func loadLDAPConfig() ldapConfig {
+	cfg := ldapConfig{
+		URL:                envOr("AUTH_LDAP_URL", "ldap://127.0.0.1:389"),
+		StartTLS:           envOr("AUTH_LDAP_STARTTLS", "") == "true",
+		InsecureSkipVerify: envOr("AUTH_LDAP_INSECURE_SKIP_VERIFY", "") == "true",
+		CAFile:             envOr("AUTH_LDAP_CA_FILE", ""),
+		BindDN:             envOr("AUTH_LDAP_BIND_DN", ""),
+		BindPassword:       envOr("AUTH_LDAP_BIND_PASSWORD", ""),
+		BaseDN:             envOr("AUTH_LDAP_BASE_DN", ""),
+		UserFilter:         envOr("AUTH_LDAP_USER_FILTER", "(&(objectClass=person)(uid=%s))"),
+		GroupRoles:         make(map[string]string),
+	}
+	for _, pair := range strings.Split(envOr("AUTH_LDAP_GROUP_ROLES", ""), ";") {
+		role, dn, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok {
+			cfg.GroupRoles[strings.ToLower(strings.TrimSpace(dn))] = strings.TrimSpace(role)
+		}
+	}
+	return cfg
+}
+
+// ldapConn is the part of *ldap.Conn the authenticator uses, so tests can stand in a directory.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// ldapAuthenticator does a search-then-bind: it finds the user's entry with the
+// service account and then binds as that entry with the supplied password.
+type ldapAuthenticator struct {
+	cfg  ldapConfig
+	dial func() (ldapConn, error)
+}
+
+func newLDAPAuthenticator(cfg ldapConfig) (*ldapAuthenticator, error) {
+	if cfg.BaseDN == "" {
+		return nil, errors.New("AUTH_LDAP_BASE_DN must be set when the ldap authenticator is enabled")
+	}
+	for dn, role := range cfg.GroupRoles {
+		if !roles[role] {
+			return nil, fmt.Errorf("ldap group %q maps to unknown role %q", dn, role)
+		}
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+
+	a := &ldapAuthenticator{cfg: cfg}
+	a.dial = func() (ldapConn, error) {
+		conn, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSConfig(tlsConfig))
+		if err != nil {
+			return nil, err
+		}
+		if cfg.StartTLS {
+			if err := conn.StartTLS(tlsConfig); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+	return a, nil
+}
+
+func (a *ldapAuthenticator) Name() string { return "ldap" }
+
+func (a *ldapAuthenticator) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	// An empty password would turn the user bind into an unauthenticated bind, which succeeds.
+	if password == "" {
+		return Identity{}, errInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", errBackendUnavailable, err)
+	}
+	defer conn.Close()
+
+	if a.cfg.BindDN != "" {
+		if err := conn.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+			return Identity{}, fmt.Errorf("%w: service bind: %v", errBackendUnavailable, err)
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.cfg.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", "mail", "displayName", "cn", "memberOf"},
+		nil,
+	))
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: search: %v", errBackendUnavailable, err)
+	}
+	if len(res.Entries) != 1 {
+		return Identity{}, errUnknownUser
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Identity{}, errInvalidCredentials
+		}
+		return Identity{}, fmt.Errorf("%w: user bind: %v", errBackendUnavailable, err)
+	}
+
+	id := Identity{
+		Username:    username,
+		Source:      "ldap",
+		Role:        "user",
+		Email:       entry.GetAttributeValue("mail"),
+		DisplayName: entry.GetAttributeValue("displayName"),
+	}
+	if id.DisplayName == "" {
+		id.DisplayName = entry.GetAttributeValue("cn")
+	}
+	for _, group := range entry.GetAttributeValues("memberOf") {
+		if role, ok := a.cfg.GroupRoles[strings.ToLower(group)]; ok && (role == "admin" || id.Role == "user") {
+			id.Role = role
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/gofiber/fiber/v2"
+)
+
+// fakeDirectory stands in for an LDAP server behind the ldapConn interface.
+type fakeDirectory struct {
+	mu        sync.Mutex
+	passwords map[string]string // DN → password, including the service account
+	entries   []*ldap.Entry
+	down      bool
+	filters   []string // every search filter received
+}
+
+func newFakeDirectory() *fakeDirectory {
+	return &fakeDirectory{
+		passwords: map[string]string{"cn=svc,dc=example,dc=com": "svc password"},
+	}
+}
+
+// addUser adds a person whose uid is uid.
+func (d *fakeDirectory) addUser(uid, password string, attrs map[string][]string) {
+	dn := "uid=" + uid + ",ou=people,dc=example,dc=com"
+	attrs["uid"] = []string{uid}
+	d.passwords[dn] = password
+	d.entries = append(d.entries, ldap.NewEntry(dn, attrs))
+}
+
+func (d *fakeDirectory) Bind(dn, password string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if want, ok := d.passwords[dn]; !ok || want != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+// Search matches entries whose uid appears, escaped, in the filter.
+func (d *fakeDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.filters = append(d.filters, req.Filter)
+	res := &ldap.SearchResult{}
+	for _, e := range d.entries {
+		if strings.Contains(req.Filter, "(uid="+ldap.EscapeFilter(e.GetAttributeValue("uid"))+")") {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return res, nil
+}
+
+func (d *fakeDirectory) Close() error { return nil }
+
+func (d *fakeDirectory) authenticator(t *testing.T) *ldapAuthenticator {
+	t.Helper()
+	a, err := newLDAPAuthenticator(ldapConfig{
+		BindDN:       "cn=svc,dc=example,dc=com",
+		BindPassword: "svc password",
+		BaseDN:       "dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid=%s))",
+		GroupRoles:   map[string]string{"cn=admins,ou=groups,dc=example,dc=com": "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.dial = func() (ldapConn, error) {
+		if d.down {
+			return nil, errors.New("connection refused")
+		}
+		return d, nil
+	}
+	return a
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	dir := newFakeDirectory()
+	dir.addUser("alice", "alice password", map[string][]string{
+		"mail":        {"alice@example.com"},
+		"displayName": {"Alice Liddell"},
+		"memberOf":    {"CN=Admins,OU=Groups,DC=example,DC=com"},
+	})
+	dir.addUser("bob", "bob password", map[string][]string{"cn": {"Bob"}})
+	a := dir.authenticator(t)
+
+	id, err := a.Authenticate(context.Background(), "alice", "alice password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{Username: "alice", Source: "ldap", Role: "admin", Email: "alice@example.com", DisplayName: "Alice Liddell"}
+	if id != want {
+		t.Errorf("alice = %+v, want %+v", id, want)
+	}
+
+	id, err = a.Authenticate(context.Background(), "bob", "bob password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Role != "user" || id.DisplayName != "Bob" {
+		t.Errorf("bob = %+v, want role user and display name from cn", id)
+	}
+}
+
+func TestLDAPAuthenticateFailures(t *testing.T) {
+	dir := newFakeDirectory()
+	dir.addUser("alice", "alice password", map[string][]string{})
+	// Two entries for one uid are ambiguous.
+	dir.addUser("twin", "twin password", map[string][]string{})
+	dir.entries = append(dir.entries, ldap.NewEntry("uid=twin,ou=other,dc=example,dc=com", map[string][]string{"uid": {"twin"}}))
+	a := dir.authenticator(t)
+
+	tests := []struct {
+		name, username, password string
+		want                     error
+	}{
+		{"wrong password", "alice", "wrong", errInvalidCredentials},
+		{"empty password", "alice", "", errInvalidCredentials},
+		{"unknown user", "carol", "whatever", errUnknownUser},
+		{"ambiguous user", "twin", "twin password", errUnknownUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := a.Authenticate(context.Background(), tt.username, tt.password); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("service bind refused", func(t *testing.T) {
+		broken := dir.authenticator(t)
+		broken.cfg.BindPassword = "stale"
+		if _, err := broken.Authenticate(context.Background(), "alice", "alice password"); !errors.Is(err, errBackendUnavailable) {
+			t.Errorf("err = %v, want %v", err, errBackendUnavailable)
+		}
+	})
+	t.Run("server down", func(t *testing.T) {
+		dir.down = true
+		defer func() { dir.down = false }()
+		if _, err := a.Authenticate(context.Background(), "alice", "alice password"); !errors.Is(err, errBackendUnavailable) {
+			t.Errorf("err = %v, want %v", err, errBackendUnavailable)
+		}
+	})
+}
+
+func TestLDAPFilterEscaping(t *testing.T) {
+	dir := newFakeDirectory()
+	dir.addUser("alice", "alice password", map[string][]string{})
+	a := dir.authenticator(t)
+
+	if _, err := a.Authenticate(context.Background(), "*)(uid=alice", "alice password"); !errors.Is(err, errUnknownUser) {
+		t.Errorf("err = %v, want %v", err, errUnknownUser)
+	}
+	if got := dir.filters[len(dir.filters)-1]; got != `(&(objectClass=person)(uid=\2a\29\28uid=alice))` {
+		t.Errorf("filter = %s", got)
+	}
+}
+
+// TestLDAPLogin signs in through the HTTP API with an LDAP backend in front of the
+// local one: directory users are provisioned, local users fall through.
+func TestLDAPLogin(t *testing.T) {
+	dir := newFakeDirectory()
+	ldapUser := newUsername()
+	dir.addUser(ldapUser, "directory password", map[string][]string{"mail": {ldapUser + "@example.com"}})
+	saved := authChain
+	authChain = []Authenticator{dir.authenticator(t), localAuthenticator{}}
+	t.Cleanup(func() { authChain = saved })
+
+	cookie := login(t, ldapUser, "directory password")
+	profile := decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	if profile["username"] != ldapUser {
+		t.Errorf("profile = %v", profile)
+	}
+	var source, hash string
+	if err := db.QueryRow("SELECT auth_source, password_hash FROM users WHERE username = ?", ldapUser).Scan(&source, &hash); err != nil {
+		t.Fatal(err)
+	}
+	if source != "ldap" || hash != "!" {
+		t.Errorf("provisioned user has auth_source %q and password hash %q", source, hash)
+	}
+	decode(t, request(t, "POST", "/api/login", fiber.Map{"username": ldapUser, "password": "wrong"}), 401)
+
+	localUser := newUsername()
+	register(t, localUser, "correct horse")
+	login(t, localUser, "correct horse")
+}
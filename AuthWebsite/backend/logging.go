@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Logs are written as JSON lines through log/slog. The standard log package is
+// routed through the same handler, so existing log.Println calls end up as
+// info-level entries.
+
+const headerTraceparent = "traceparent"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// traceparentPattern matches a W3C trace context header of version 00.
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+const redacted = "[REDACTED]"
+
+// logOutput is where log lines are written.
+var logOutput io.Writer = os.Stdout
+
+// loadLogger installs the JSON logger. AUTH_LOG_LEVEL is debug, info, warn or
+// error; at debug, request bodies and cookies are logged with secrets redacted.
+func loadLogger() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(envOr("AUTH_LOG_LEVEL", "info"))); err != nil {
+		return fmt.Errorf("AUTH_LOG_LEVEL: %w", err)
+	}
+	handler := slog.NewJSONHandler(logOutput, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if sensitiveKey(a.Key) {
+				return slog.String(a.Key, redacted)
+			}
+			return a
+		},
+	})
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// sensitiveKey reports whether a field of that name holds a credential.
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"password", "token", "secret", "nonce", "signature", "authorization"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return key == "code" || key == "invite_code" || key == "state"
+}
+
+// traceContext is the W3C trace context of a request. SpanID identifies this
+// server's part of the trace; ParentID is the caller's span, if any.
+type traceContext struct {
+	TraceID  string
+	ParentID string
+	SpanID   string
+	Flags    string
+}
+
+func (t traceContext) String() string {
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + t.Flags
+}
+
+// parseTraceparent continues the caller's trace or starts a new one.
+func parseTraceparent(header string) traceContext {
+	span := hex.EncodeToString(randomBytes(8))
+	m := traceparentPattern.FindStringSubmatch(header)
+	if m == nil || m[1] == strings.Repeat("0", 32) || m[2] == strings.Repeat("0", 16) {
+		return traceContext{TraceID: hex.EncodeToString(randomBytes(16)), SpanID: span, Flags: "00"}
+	}
+	return traceContext{TraceID: m[1], ParentID: m[2], SpanID: span, Flags: m[3]}
+}
+
+// requestLogger assigns every request an ID and trace context, echoes both in the
+// response and logs one line per request once it has been handled.
+func requestLogger(c *fiber.Ctx) error {
+	start := time.Now()
+	requestID := c.Get(fiber.HeaderXRequestID)
+	if !requestIDPattern.MatchString(requestID) {
+		requestID = generateID()
+	}
+	trace := parseTraceparent(c.Get(headerTraceparent))
+	c.Locals("request_id", requestID)
+	c.Locals("trace", trace)
+	c.Set(fiber.HeaderXRequestID, requestID)
+	c.Set(headerTraceparent, trace.String())
+
+	err := c.Next()
+
+	status := responseStatus(c, err)
+	attrs := []slog.Attr{
+		slog.String("request_id", requestID),
+		slog.String("trace_id", trace.TraceID),
+		slog.String("span_id", trace.SpanID),
+		slog.String("method", c.Method()),
+		slog.String("path", c.Path()),
+		slog.String("route", c.Route().Path),
+		slog.Int("status", status),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("ip", c.IP()),
+	}
+	if trace.ParentID != "" {
+		attrs = append(attrs, slog.String("parent_span_id", trace.ParentID))
+	}
+	if username, ok := c.Locals("username").(string); ok {
+		attrs = append(attrs, slog.String("user", username))
+	}
+	if sess, ok := c.Locals("session").(session); ok && sess.Impersonator != "" {
+		attrs = append(attrs, slog.String("impersonator", sess.Impersonator))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+
+	logger := slog.Default()
+	if logger.Enabled(c.Context(), slog.LevelDebug) {
+		if body := c.Request().Body(); len(body) > 0 {
+			attrs = append(attrs, slog.Any("body", redactBody(string(c.Request().Header.ContentType()), body)))
+		}
+		if cookies := redactCookies(c); len(cookies) > 0 {
+			attrs = append(attrs, slog.Any("cookies", cookies))
+		}
+	}
+
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+	logger.LogAttrs(c.Context(), level, "request", attrs...)
+	return err
+}
+
+// redactBody decodes a JSON or form body and blanks out every credential in it.
+// Other bodies are only described by their size.
+func redactBody(contentType string, body []byte) any {
+	switch {
+	case strings.HasPrefix(contentType, fiber.MIMEApplicationJSON), strings.HasPrefix(contentType, "application/scim+json"):
+		var v any
+		if err := json.Unmarshal(body, &v); err != nil {
+			return fmt.Sprintf("<%d bytes of invalid JSON>", len(body))
+		}
+		return redactValue(v)
+	case strings.HasPrefix(contentType, fiber.MIMEApplicationForm):
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return fmt.Sprintf("<%d bytes of invalid form data>", len(body))
+		}
+		out := map[string]any{}
+		for key, values := range form {
+			if sensitiveKey(key) {
+				out[key] = redacted
+			} else {
+				out[key] = values
+			}
+		}
+		return out
+	}
+	return fmt.Sprintf("<%d bytes>", len(body))
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if sensitiveKey(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redactValue(value)
+		}
+	}
+	return v
+}
+
+// redactCookies lists the request's cookies. Every value is hidden, since all
+// cookies this server sets are credentials.
+func redactCookies(c *fiber.Ctx) map[string]string {
+	cookies := map[string]string{}
+	c.Request().Header.VisitAllCookie(func(key, _ []byte) {
+		cookies[string(key)] = redacted
+	})
+	return cookies
+}
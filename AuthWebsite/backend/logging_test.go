@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// logBuffer collects log lines written from any goroutine.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries returns the request log lines for path.
+func (b *logBuffer) entries(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %s", line)
+		}
+		if entry["msg"] == "request" && entry["path"] == path {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// captureLogs logs at debug level into a buffer for the rest of the test.
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	b := &logBuffer{}
+	logOutput = b
+	os.Setenv("AUTH_LOG_LEVEL", "debug")
+	t.Cleanup(func() {
+		logOutput = os.Stdout
+		os.Setenv("AUTH_LOG_LEVEL", testEnv["AUTH_LOG_LEVEL"])
+		if err := loadLogger(); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := loadLogger(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRequestLogRedaction(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	logs := captureLogs(t)
+
+	resp := request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "correct horse"})
+	decode(t, resp, 200)
+	cookie := sessionCookie(resp)
+	decode(t, request(t, "POST", "/api/token/revoke", fiber.Map{"refresh_token": "refresh-secret-value"}), 200)
+	body := fiber.Map{"current_password": "wrong horse", "new_password": "battery staple"}
+	decode(t, request(t, "POST", "/api/account/password", body, cookie), 401)
+
+	logs.mu.Lock()
+	raw := logs.buf.String()
+	logs.mu.Unlock()
+	for _, secret := range []string{"correct horse", "wrong horse", "battery staple", cookie.Value, "refresh-secret-value"} {
+		if strings.Contains(raw, secret) {
+			t.Errorf("log contains %q", secret)
+		}
+	}
+
+	entries := logs.entries(t, "/api/login")
+	if len(entries) != 1 {
+		t.Fatalf("%d log lines for /api/login", len(entries))
+	}
+	if body, _ := entries[0]["body"].(map[string]any); body["username"] != username || body["password"] != redacted {
+		t.Errorf("logged login body = %v", entries[0]["body"])
+	}
+	if entries[0]["request_id"] == "" || entries[0]["trace_id"] == "" || entries[0]["status"] != float64(200) {
+		t.Errorf("log line = %v", entries[0])
+	}
+
+	entries = logs.entries(t, "/api/token/revoke")
+	if len(entries) != 1 {
+		t.Fatalf("%d log lines for /api/token/revoke", len(entries))
+	}
+	if body, _ := entries[0]["body"].(map[string]any); body["refresh_token"] != redacted {
+		t.Errorf("logged revoke body = %v", entries[0]["body"])
+	}
+
+	entries = logs.entries(t, "/api/account/password")
+	if len(entries) != 1 {
+		t.Fatalf("%d log lines for /api/account/password", len(entries))
+	}
+	if body, _ := entries[0]["body"].(map[string]any); body["current_password"] != redacted || body["new_password"] != redacted {
+		t.Errorf("logged password change body = %v", entries[0]["body"])
+	}
+	if cookies, _ := entries[0]["cookies"].(map[string]any); cookies["session_token"] != redacted {
+		t.Errorf("logged cookies = %v", entries[0]["cookies"])
+	}
+	if entries[0]["user"] != username {
+		t.Errorf("logged user = %v", entries[0]["user"])
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	got := redactBody("application/json; charset=utf-8", []byte(`{"user": {"new_password": "a", "name": "b"}, "items": [{"access_token": "c"}], "code": "d"}`))
+	want := map[string]any{
+		"user":  map[string]any{"new_password": redacted, "name": "b"},
+		"items": []any{map[string]any{"access_token": redacted}},
+		"code":  redacted,
+	}
+	if gotJSON, wantJSON := mustJSON(t, got), mustJSON(t, want); gotJSON != wantJSON {
+		t.Errorf("JSON body = %s, want %s", gotJSON, wantJSON)
+	}
+
+	got = redactBody(fiber.MIMEApplicationForm, []byte("grant_type=refresh_token&refresh_token=e&client_secret=f"))
+	want = map[string]any{"grant_type": []string{"refresh_token"}, "refresh_token": redacted, "client_secret": redacted}
+	if gotJSON, wantJSON := mustJSON(t, got), mustJSON(t, want); gotJSON != wantJSON {
+		t.Errorf("form body = %s, want %s", gotJSON, wantJSON)
+	}
+
+	if got := redactBody("application/json", []byte(`{"password": "g"`)); got != "<16 bytes of invalid JSON>" {
+		t.Errorf("invalid JSON body = %v", got)
+	}
+	if got := redactBody("application/octet-stream", []byte("password=h")); got != "<10 bytes>" {
+		t.Errorf("binary body = %v", got)
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set(fiber.HeaderXRequestID, "req-123")
+	req.Header.Set(headerTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := testApp.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(fiber.HeaderXRequestID); got != "req-123" {
+		t.Errorf("X-Request-ID = %q", got)
+	}
+	trace := parseTraceparent(resp.Header.Get(headerTraceparent))
+	if trace.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || trace.ParentID == "00f067aa0ba902b7" || trace.Flags != "01" {
+		t.Errorf("traceparent = %q", resp.Header.Get(headerTraceparent))
+	}
+
+	// Request IDs that could forge log lines are replaced.
+	req = httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set(fiber.HeaderXRequestID, "bad id\n")
+	if resp, err = testApp.Test(req, -1); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(fiber.HeaderXRequestID); got == "" || got == "bad id\n" {
+		t.Errorf("X-Request-ID = %q", got)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
@@ -1,92 +1,368 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
 )
 
 var db *sql.DB
-var sessions = make(map[string]string) // sessionToken → username
+
+// background tracks worker goroutines that must finish before the database is closed.
+var background sync.WaitGroup
 
 func main() {
 	var err error
+	if err = loadLogger(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Connect to MySQL
-	dsn := "root:347347@tcp(127.0.0.1:3306)/passwords_db"
-	db, err = sql.Open("mysql", dsn)
+	db, err = sql.Open("mysql", envOr("AUTH_DB_DSN", "root:347347@tcp(127.0.0.1:3306)/passwords_db?parseTime=true"))
 	if err != nil {
 		log.Fatal(err)
 	}
 	if err = db.Ping(); err != nil {
 		log.Fatal(err)
 	}
+	if err = setupDatabase(); err != nil {
+		log.Fatal(err)
+	}
+	startAuditWriter()
+	if err = loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	workers, stopWorkers := context.WithCancel(context.Background())
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runWebhookWorker(workers, webhooks)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runSweeper(workers)
+	}()
+
+	initMetrics()
+	app := newApp()
+	metricsApp := serveMetrics(app)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	addr := envOr("AUTH_ADDR", ":8080")
+	go func() {
+		if err := listen(app, addr); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	redirectApp := serveRedirect(addr)
 
-	// Create users table if not exists
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS users (
-            id INT AUTO_INCREMENT PRIMARY KEY,
-            username VARCHAR(255) UNIQUE NOT NULL,
-            password_hash VARCHAR(255) NOT NULL
-        )
-    `)
+	grpcServer, err := serveGRPC()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	<-ctx.Done()
+	shutdown(app, metricsApp, redirectApp, grpcServer, stopWorkers)
+}
+
+// setupDatabase creates missing tables and columns, applies AUTH_ADMIN_USERS and
+// restores the sessions saved at the last shutdown.
+func setupDatabase() error {
+	if err := migrate(db); err != nil {
+		return err
+	}
+	if err := bootstrapAdmins(); err != nil {
+		return err
+	}
+	return loadSessions()
+}
+
+// loadConfig reads every AUTH_* setting besides the logger's.
+func loadConfig() error {
+	var err error
+	rp = loadRelyingParty()
+	for _, load := range []func() error{
+		loadTokenConfig,
+		loadImpersonationConfig,
+		loadDeviceConfig,
+		loadPowConfig,
+		loadOpenAPI,
+		loadTLSConfig,
+		loadPasswordPolicy,
+		loadSessionBinding,
+	} {
+		if err = load(); err != nil {
+			return err
+		}
+	}
+	loadReservedUsernames()
+	if notifier, err = loadNotifier(); err != nil {
+		return err
+	}
+	if authChain, err = loadAuthChain(); err != nil {
+		return err
+	}
+	if oidcProviders, err = loadOIDCProviders(context.Background()); err != nil {
+		return err
+	}
+	webhooks, err = loadWebhookConfig()
+	return err
+}
+
+// newApp builds the HTTP application: middleware, API routes, SCIM and the
+// frontend. The metrics endpoint is added by serveMetrics.
+func newApp() *fiber.App {
 	// Fiber app
 	app := fiber.New()
-	app.Use(logger.New())
+	app.Use(requestLogger)
+	app.Use(securityHeaders)
+	app.Use(metricsMiddleware)
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://127.0.0.1:8080", // Svelte dev server
-		AllowHeaders:     "Origin, Content-Type, Accept",
+		AllowHeaders:     "Origin, Content-Type, Accept, X-Request-ID, traceparent",
+		ExposeHeaders:    "X-Request-ID, traceparent",
 		AllowCredentials: true,
 	}))
 
+	app.Get("/healthz", healthzHandler)
+	app.Get("/readyz", readyzHandler)
+
 	// API routes
 	api := app.Group("/api")
-	api.Post("/register", registerHandler)
-	api.Post("/login", loginHandler)
+	api.Get("/openapi.json", openAPIHandler)
+	api.Post("/register", validateBody("RegisterRequest"), registerHandler)
+	api.Post("/login", validateBody("LoginRequest"), loginHandler)
+	api.Get("/registration-mode", getRegistrationModeHandler)
+	api.Get("/register/challenge", powChallengeHandler)
+	api.Get("/policies", listPoliciesHandler)
+	api.Get("/policies/:kind/:version", getPolicyHandler)
+	api.Post("/webauthn/login/begin", beginPasskeyLoginHandler)
+	api.Post("/webauthn/login/finish", finishPasskeyLoginHandler)
+	api.Post("/token", tokenHandler)
+	api.Post("/token/revoke", revokeTokenHandler)
+	api.Post("/devices/not-me", notMeHandler)
+	api.Post("/devices/reset-password", deviceResetPasswordHandler)
+	api.Get("/oidc/providers", listOIDCProvidersHandler)
+	api.Get("/oidc/:provider/login", oidcLoginHandler)
+	api.Get("/oidc/:provider/callback", oidcCallbackHandler)
 
-	protected := api.Group("/", authMiddleware)
+	protected := api.Group("/", authMiddleware, sessionBindingMiddleware, impersonationAuditMiddleware, orgContextMiddleware, consentMiddleware)
 	protected.Get("/profile", profileHandler)
+	protected.Patch("/profile", denyImpersonation, updateProfileHandler)
+	protected.Post("/profile/username", denyImpersonation, changeUsernameHandler)
+	protected.Post("/account/password", denyImpersonation, validateBody("ChangePasswordRequest"), changePasswordHandler)
+	protected.Delete("/account", denyImpersonation, deleteAccountHandler)
+	protected.Post("/account/export", denyImpersonation, requestExportHandler)
+	protected.Get("/account/export/:id", exportStatusHandler)
+	protected.Get("/account/export/:id/download", denyImpersonation, downloadExportHandler)
+	protected.Get("/webauthn/credentials", listPasskeysHandler)
+	protected.Delete("/webauthn/credentials/:id", denyImpersonation, deletePasskeyHandler)
+	protected.Post("/webauthn/register/begin", denyImpersonation, beginPasskeyRegistrationHandler)
+	protected.Post("/webauthn/register/finish", denyImpersonation, finishPasskeyRegistrationHandler)
+	protected.Get("/oidc/identities", listIdentitiesHandler)
+	protected.Delete("/oidc/identities/:provider", denyImpersonation, unlinkIdentityHandler)
+	protected.Get("/orgs", listOrgsHandler)
+	protected.Post("/orgs", denyImpersonation, createOrgHandler)
+	protected.Post("/orgs/switch", denyImpersonation, switchOrgHandler)
+	protected.Get("/orgs/invitations", listOrgInvitationsHandler)
+	protected.Post("/orgs/invitations/:id/accept", denyImpersonation, acceptOrgInvitationHandler)
+	protected.Get("/orgs/current/members", listOrgMembersHandler)
+	protected.Patch("/orgs/current/members/:username", denyImpersonation, updateOrgMemberHandler)
+	protected.Delete("/orgs/current/members/:username", denyImpersonation, removeOrgMemberHandler)
+	protected.Post("/orgs/current/invitations", denyImpersonation, inviteOrgMemberHandler)
+	protected.Post("/impersonation/stop", stopImpersonationHandler)
+	protected.Get("/consent", consentStatusHandler)
+	protected.Post("/consent", denyImpersonation, giveConsentHandler)
 	protected.Post("/logout", logoutHandler)
+	protected.Post("/session/step-up", denyImpersonation, validateBody("StepUpRequest"), stepUpHandler)
+
+	admin := protected.Group("/admin", denyImpersonation, adminMiddleware)
+	admin.Get("/webhooks/deliveries", listDeliveriesHandler)
+	admin.Get("/webhooks/deliveries/:id", getDeliveryHandler)
+	admin.Post("/webhooks/deliveries/:id/replay", replayDeliveryHandler)
+	admin.Put("/registration-mode", setRegistrationModeHandler)
+	admin.Get("/invitations", listInvitationsHandler)
+	admin.Post("/invitations", createInvitationHandler)
+	admin.Delete("/invitations/:code", deleteInvitationHandler)
+	admin.Post("/impersonate", startImpersonationHandler)
+	admin.Get("/policies", listPolicyVersionsHandler)
+	admin.Post("/policies", publishPolicyHandler)
+
+	scimRoutes(app)
 
 	// Serve static files from Svelte build
 	app.Static("/", "../frontend/dist")
+	return app
+}
+
+// sweepers drop expired entries from the in-memory stores that requests add to.
+var sweepers = []func(now time.Time){expireSessions, expireChallenges, expireOIDCLogins, expireSpentProofs}
+
+// runSweeper runs every sweeper once a minute until ctx is cancelled.
+func runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, sweep := range sweepers {
+				sweep(now)
+			}
+		}
+	}
+}
+
+// shutdown stops accepting connections, drains in-flight requests and then
+// stops background workers and persists sessions and pending audit entries
+// before closing the database.
+func shutdown(app, metricsApp, redirectApp *fiber.App, grpcServer *grpc.Server, stopWorkers context.CancelFunc) {
+	log.Println("Shutting down")
+	shuttingDown.Store(true)
 
-	log.Println("Server running on http://localhost:8080")
-	log.Fatal(app.Listen(":8080"))
+	timeout, err := time.ParseDuration(envOr("AUTH_SHUTDOWN_TIMEOUT", "15s"))
+	if err != nil {
+		log.Println("invalid AUTH_SHUTDOWN_TIMEOUT:", err)
+		timeout = 15 * time.Second
+	}
+	if err := app.ShutdownWithTimeout(timeout); err != nil {
+		log.Println("shutdown:", err)
+	}
+	if metricsApp != nil {
+		metricsApp.ShutdownWithTimeout(timeout)
+	}
+	if redirectApp != nil {
+		redirectApp.ShutdownWithTimeout(timeout)
+	}
+	if grpcServer != nil {
+		stopGRPC(grpcServer, timeout)
+	}
+	stopWorkers()
+	background.Wait()
+
+	if err := flushSessions(); err != nil {
+		log.Println("flush sessions:", err)
+	}
+	flushAudit()
+	if err := db.Close(); err != nil {
+		log.Println("close db:", err)
+	}
+	log.Println("Shutdown complete")
 }
 
 func registerHandler(c *fiber.Ctx) error {
 	var data struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		InviteCode string `json:"invite_code"`
+		Challenge  string `json:"pow_challenge"`
+		Nonce      string `json:"pow_nonce"`
+		// Accepted maps each policy kind to the version shown on the form.
+		Accepted map[string]string `json:"accepted_policies"`
 	}
 	if err := c.BodyParser(&data); err != nil {
+		registrations.WithLabelValues("invalid_request").Inc()
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
+	mode, err := registrationMode()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	switch {
+	case mode == registrationClosed:
+		registrations.WithLabelValues("closed").Inc()
+		return c.Status(403).JSON(fiber.Map{"error": "Registration is closed"})
+	case mode == registrationInviteOnly && data.InviteCode == "":
+		registrations.WithLabelValues("invitation_required").Inc()
+		return c.Status(403).JSON(fiber.Map{"error": "An invitation code is required to register"})
+	}
+	// Checked before the bcrypt hash so that bots cannot make us do the expensive work.
+	if err := verifyProof(data.Challenge, data.Nonce); err != nil {
+		registrations.WithLabelValues("invalid_proof").Inc()
+		return c.Status(400).JSON(fiber.Map{"error": "Proof of work is missing, invalid or expired"})
+	}
+	data.Username, err = normalizeUsername(data.Username)
+	if err != nil {
+		registrations.WithLabelValues("invalid_username").Inc()
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid username"})
+	}
+	if status, msg := usernameRejection(checkNewUsername(data.Username, "")); status != 0 {
+		registrations.WithLabelValues("rejected_username").Inc()
+		return c.Status(status).JSON(fiber.Map{"error": msg})
+	}
+
 	// Hash password
-	hash, err := bcrypt.GenerateFromPassword([]byte(data.Password), bcrypt.DefaultCost)
+	hash, err := hashPassword(data.Password)
 	if err != nil {
+		registrations.WithLabelValues("hash_error").Inc()
 		return c.Status(500).JSON(fiber.Map{"error": "Error hashing password"})
 	}
 
-	_, err = db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", data.Username, string(hash))
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer tx.Rollback()
+
+	role := "user"
+	if data.InviteCode != "" {
+		role, err = redeemInvitation(tx, data.InviteCode)
+		if err == errInvalidInvitation {
+			registrations.WithLabelValues("invalid_invitation").Inc()
+			return c.Status(403).JSON(fiber.Map{"error": "Invitation code is invalid, expired or used up"})
+		} else if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		}
+	}
+
+	key := usernameKey(data.Username)
+	_, err = tx.Exec("INSERT INTO users (username, username_canonical, username_skeleton, password_hash, role) VALUES (?, ?, ?, ?, ?)",
+		data.Username, key, usernameSkeleton(key), string(hash), role)
+	if isDuplicateKey(err) {
+		registrations.WithLabelValues("username_taken").Inc()
+		return c.Status(409).JSON(fiber.Map{"error": "Username is already taken"})
+	} else if err != nil {
+		registrations.WithLabelValues("db_error").Inc()
+		return c.Status(500).JSON(fiber.Map{"error": "User already exists or DB error"})
+	}
+	missing, err := acceptPolicies(tx, data.Username, data.Accepted, c.IP())
 	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if len(missing) > 0 {
+		registrations.WithLabelValues("consent_required").Inc()
+		return c.Status(400).JSON(fiber.Map{"error": "Consent required", "policies": missing})
+	}
+	if err := tx.Commit(); err != nil {
+		registrations.WithLabelValues("db_error").Inc()
 		return c.Status(500).JSON(fiber.Map{"error": "User already exists or DB error"})
 	}
 
+	registrations.WithLabelValues("success").Inc()
+	recordRegistration()
+	audit(data.Username, "register", c.IP(), "")
+	emitEvent(eventUserRegistered, fiber.Map{"username": data.Username})
 	return c.JSON(fiber.Map{"message": "User registered successfully"})
 }
 
@@ -96,59 +372,131 @@ func loginHandler(c *fiber.Ctx) error {
 		Password string `json:"password"`
 	}
 	if err := c.BodyParser(&data); err != nil {
+		loginAttempts.WithLabelValues("failure", "invalid_request").Inc()
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	var storedHash string
-	err := db.QueryRow("SELECT password_hash FROM users WHERE username = ?", data.Username).Scan(&storedHash)
-	if err != nil {
+	id, err := authenticate(c.Context(), authChain, data.Username, data.Password)
+	switch {
+	case errors.Is(err, errUnknownUser):
+		loginAttempts.WithLabelValues("failure", "unknown_user").Inc()
+		audit(data.Username, "login_failure", c.IP(), "unknown user")
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	case errors.Is(err, errInvalidCredentials):
+		loginAttempts.WithLabelValues("failure", "bad_password").Inc()
+		audit(data.Username, "login_failure", c.IP(), "bad password")
 		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	case errors.Is(err, errPasswordResetRequired):
+		loginAttempts.WithLabelValues("failure", "reset_required").Inc()
+		return c.Status(403).JSON(fiber.Map{"error": "Password reset required"})
+	case err != nil:
+		loginAttempts.WithLabelValues("failure", "backend_error").Inc()
+		return c.Status(503).JSON(fiber.Map{"error": "Authentication service unavailable"})
 	}
 
-	// Verify password
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(data.Password)); err != nil {
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	// Just-in-time provisioning of directory users
+	if err := provisionUser(id); err != nil {
+		log.Println("provision user:", err)
+		loginAttempts.WithLabelValues("failure", "provisioning").Inc()
+		return c.Status(403).JSON(fiber.Map{"error": "Account cannot be used with this sign-in method"})
+	}
+
+	if err := startSession(c, id.Username, id.Source); err != nil {
+		return sessionRefused(c, err)
+	}
+	return c.JSON(fiber.Map{"message": "Login successful"})
+}
+
+// startSession logs username in after any successful authentication method and
+// sets the session cookie on the response. It refuses deactivated accounts and
+// accounts waiting for a password reset.
+func startSession(c *fiber.Ctx, username, method string) error {
+	if err := checkSignIn(username); err != nil {
+		return err
 	}
 
 	// Create a secure session token
-	token := generateToken()
-	sessions[token] = data.Username
+	token, sess := createSession(session{Username: username, Binding: requestBinding(c)}, sessionTTL)
+	checkDevice(c, username)
+	loginAttempts.WithLabelValues("success", "").Inc()
+	audit(username, "login", c.IP(), method)
+	emitEvent(eventUserLoggedIn, fiber.Map{"username": username, "ip": c.IP(), "method": method})
 
 	// Set cookie
 	c.Cookie(&fiber.Cookie{
 		Name:     "session_token",
 		Value:    token,
-		Expires:  time.Now().Add(24 * time.Hour),
+		Expires:  sess.ExpiresAt,
 		HTTPOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
+		Secure:   secureCookies,
 	})
+	return nil
+}
 
-	return c.JSON(fiber.Map{"message": "Login successful"})
+// sessionRefused answers a sign-in refused by startSession or checkAccountUsable.
+func sessionRefused(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errAccountDisabled):
+		loginAttempts.WithLabelValues("failure", "disabled").Inc()
+		return c.Status(403).JSON(fiber.Map{"error": "Account is disabled"})
+	case errors.Is(err, errPasswordResetRequired):
+		loginAttempts.WithLabelValues("failure", "reset_required").Inc()
+		return c.Status(403).JSON(fiber.Map{"error": "Password reset required"})
+	case errors.Is(err, errPasswordExpired):
+		loginAttempts.WithLabelValues("failure", "password_expired").Inc()
+		return c.Status(403).JSON(fiber.Map{"error": "Password expired"})
+	}
+	return c.Status(500).JSON(fiber.Map{"error": "DB error"})
 }
 
 func authMiddleware(c *fiber.Ctx) error {
-	token := c.Cookies("session_token")
-	username, exists := sessions[token]
+	token := requestToken(c)
+	sess, exists := lookupSession(token)
 	if !exists {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 
+	expired, err := passwordExpired(sess.Username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if expired && !allowedWithExpiredPassword(c) {
+		return c.Status(403).JSON(fiber.Map{"error": "Password expired"})
+	}
+
 	// Store username in context
-	c.Locals("username", username)
+	c.Locals("username", sess.Username)
+	c.Locals("session", sess)
+	c.Locals("token", token)
 	return c.Next()
 }
 
+// requestToken returns the bearer access token of an API client, or else the session cookie.
+func requestToken(c *fiber.Ctx) string {
+	if token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		return token
+	}
+	return c.Cookies("session_token")
+}
+
 func profileHandler(c *fiber.Ctx) error {
 	username := c.Locals("username").(string)
+	p, err := loadProfile(username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
 	return c.JSON(fiber.Map{
-		"message":  "Welcome to your profile",
-		"username": username,
+		"message":       "Welcome to your profile",
+		"username":      username,
+		"profile":       p,
+		"organization":  currentOrg(c),
+		"impersonation": impersonationInfo(c.Locals("session").(session)),
 	})
 }
 
 func logoutHandler(c *fiber.Ctx) error {
-	token := c.Cookies("session_token")
-	delete(sessions, token)
+	deleteSession(requestToken(c))
+	audit(c.Locals("username").(string), "logout", c.IP(), "")
 
 	// Clear cookie
 	c.Cookie(&fiber.Cookie{
@@ -156,6 +504,7 @@ func logoutHandler(c *fiber.Ctx) error {
 		Value:    "",
 		Expires:  time.Now().Add(-1 * time.Hour),
 		HTTPOnly: true,
+		Secure:   secureCookies,
 	})
 
 	return c.JSON(fiber.Map{"message": "Logged out successfully"})
@@ -166,3 +515,16 @@ func generateToken() string {
 	rand.Read(b)
 	return base64.URLEncoding.EncodeToString(b)
 }
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// generateID returns a random identifier for rows that are looked up by the user.
+func generateID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	gms "github.com/dolthub/go-mysql-server/sql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The end-to-end tests drive the application built by newApp through app.Test. Its
+// database is an in-process, MySQL-compatible server (go-mysql-server with in-memory
+// tables) listening on a loopback port, reached through the same driver and
+// migrations as production. The database lives for one test binary run; tests
+// keep out of each other's way by using their own usernames.
+
+var testApp *fiber.App
+
+// testEnv is the configuration the tests run with: no proof of work, so that
+// registration is a single request, and quiet logs.
+var testEnv = map[string]string{
+	"AUTH_POW_DIFFICULTY":         "0",
+	"AUTH_LOG_LEVEL":              "error",
+	"AUTH_NEW_DEVICE_SENSITIVITY": "off",
+	"AUTH_PASSWORD_HISTORY":       "0",
+	"AUTH_SCIM_TOKEN":             testSCIMToken,
+}
+
+func TestMain(m *testing.M) {
+	for k, v := range testEnv {
+		os.Setenv(k, v)
+	}
+	stop, err := startTestDatabase()
+	if err != nil {
+		log.Fatal("test database: ", err)
+	}
+	if err = loadLogger(); err == nil {
+		err = setupDatabase()
+	}
+	if err == nil {
+		err = loadConfig()
+	}
+	if err != nil {
+		stop()
+		log.Fatal(err)
+	}
+	startAuditWriter()
+	testApp = newApp()
+
+	code := m.Run()
+	flushAudit()
+	db.Close()
+	stop()
+	os.Exit(code)
+}
+
+// startTestDatabase serves an empty passwords_db on a free loopback port and
+// points db at it.
+func startTestDatabase() (stop func(), err error) {
+	provider := memory.NewDBProvider(memory.NewDatabase("passwords_db"))
+	engine := sqle.NewDefault(provider)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv, err := server.NewServer(server.Config{Protocol: "tcp", Listener: ln}, engine, gms.NewContext, memory.NewSessionBuilder(provider), nil)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	go srv.Start()
+
+	db, err = sql.Open("mysql", fmt.Sprintf("root@tcp(%s)/passwords_db?parseTime=true", ln.Addr()))
+	if err == nil {
+		err = db.PingContext(context.Background())
+	}
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return func() { srv.Close() }, nil
+}
+
+var userSeq atomic.Int64
+
+// newUsername returns a name no other test uses.
+func newUsername() string {
+	return fmt.Sprintf("user%d", userSeq.Add(1))
+}
+
+// request sends a request with a JSON body (a string is sent as is) and the given
+// cookies to the test app.
+func request(t *testing.T, method, path string, body any, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+	resp, err := send(method, path, body, cookies...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// send is request for goroutines, which must not call t.Fatal.
+func send(method, path string, body any, cookies ...*http.Cookie) (*http.Response, error) {
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(b)
+	default:
+		payload, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(payload)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return testApp.Test(req, -1)
+}
+
+// decode reads a JSON object response and checks its status.
+func decode(t *testing.T, resp *http.Response, status int) map[string]any {
+	t.Helper()
+	defer resp.Body.Close()
+	var data map[string]any
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &data); err != nil {
+			t.Fatalf("%d response is not a JSON object: %s", resp.StatusCode, raw)
+		}
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("status %d, want %d: %s", resp.StatusCode, status, raw)
+	}
+	return data
+}
+
+func register(t *testing.T, username, password string) {
+	t.Helper()
+	decode(t, request(t, "POST", "/api/register", fiber.Map{"username": username, "password": password}), 200)
+}
+
+// login signs in and returns the session cookie.
+func login(t *testing.T, username, password string) *http.Cookie {
+	t.Helper()
+	resp := request(t, "POST", "/api/login", fiber.Map{"username": username, "password": password})
+	decode(t, resp, 200)
+	cookie := sessionCookie(resp)
+	if cookie == nil || cookie.Value == "" {
+		t.Fatal("login did not set session_token")
+	}
+	return cookie
+}
+
+// admin registers an account with the admin role and returns its session cookie.
+func admin(t *testing.T) *http.Cookie {
+	t.Helper()
+	username := newUsername()
+	register(t, username, "admin password")
+	if _, err := db.Exec("UPDATE users SET role = 'admin' WHERE username = ?", username); err != nil {
+		t.Fatal(err)
+	}
+	return login(t, username, "admin password")
+}
+
+func sessionCookie(resp *http.Response) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == "session_token" {
+			return c
+		}
+	}
+	return nil
+}
+
+// recordingNotifier keeps the notifications it is given.
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (r *recordingNotifier) Send(_ context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+// useRecordingNotifier records notifications for the rest of the test.
+func useRecordingNotifier(t *testing.T) *recordingNotifier {
+	r := &recordingNotifier{}
+	saved := notifier
+	notifier = r
+	t.Cleanup(func() {
+		background.Wait()
+		notifier = saved
+	})
+	return r
+}
+
+// waitFor returns the first notification to address, which notify sends in the background.
+func (r *recordingNotifier) waitFor(t *testing.T, to string) Notification {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		r.mu.Lock()
+		for _, n := range r.sent {
+			if n.To == to {
+				r.mu.Unlock()
+				return n
+			}
+		}
+		r.mu.Unlock()
+	}
+	t.Fatalf("no notification to %s", to)
+	return Notification{}
+}
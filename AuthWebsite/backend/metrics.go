@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	loginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_login_attempts_total",
+		Help: "Login attempts by result and failure reason.",
+	}, []string{"result", "reason"})
+
+	registrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_registrations_total",
+		Help: "Registration attempts by result.",
+	}, []string{"result"})
+
+	bcryptDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "auth_bcrypt_duration_seconds",
+		Help:    "Time spent hashing and comparing passwords with bcrypt.",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"op"})
+
+	sessionBindingActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_session_binding_actions_total",
+		Help: "Sessions challenged or revoked because their client fingerprint changed, by action and reason.",
+	}, []string{"action", "reason"})
+
+	activeSessions = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "auth_active_sessions",
+		Help: "Number of sessions currently held in memory.",
+	}, func() float64 { return float64(sessionCount()) })
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func initMetrics() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, "passwords_db"),
+		requestDuration,
+		loginAttempts,
+		registrations,
+		bcryptDuration,
+		sessionBindingActions,
+		activeSessions,
+	)
+}
+
+// metricsMiddleware records the latency of every request under its route pattern.
+func metricsMiddleware(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	// Label values outlive the request, so the method must not share fasthttp's buffer.
+	requestDuration.WithLabelValues(utils.CopyString(c.Method()), c.Route().Path, strconv.Itoa(responseStatus(c, err))).
+		Observe(time.Since(start).Seconds())
+	return err
+}
+
+// responseStatus is the status the client will see for a request that returned err:
+// the code of a *fiber.Error, 500 for any other error, else the response's status.
+func responseStatus(c *fiber.Ctx, err error) int {
+	if fe, ok := err.(*fiber.Error); ok {
+		return fe.Code
+	} else if err != nil {
+		return fiber.StatusInternalServerError
+	}
+	return c.Response().StatusCode()
+}
+
+// serveMetrics exposes /metrics. With AUTH_METRICS_TOKEN set the endpoint is mounted on
+// the main app behind a bearer token; otherwise it gets its own listener on
+// AUTH_METRICS_ADDR, which defaults to loopback only and is returned for shutdown.
+func serveMetrics(app *fiber.App) *fiber.App {
+	handler := adaptor.HTTPHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	if token := envOr("AUTH_METRICS_TOKEN", ""); token != "" {
+		app.Get("/metrics", func(c *fiber.Ctx) error {
+			expected := []byte("Bearer " + token)
+			if subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), expected) != 1 {
+				return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+			}
+			return handler(c)
+		})
+		return nil
+	}
+
+	addr := envOr("AUTH_METRICS_ADDR", "127.0.0.1:9100")
+	metricsApp := fiber.New(fiber.Config{DisableStartupMessage: true})
+	metricsApp.Get("/metrics", handler)
+	go func() {
+		log.Println("Metrics available on http://" + addr + "/metrics")
+		if err := metricsApp.Listen(addr); err != nil {
+			log.Println("metrics listener:", err)
+		}
+	}()
+	return metricsApp
+}
+
+func hashPassword(password string) ([]byte, error) {
+	start := time.Now()
+	defer func() { bcryptDuration.WithLabelValues("hash").Observe(time.Since(start).Seconds()) }()
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+func comparePassword(hash, password string) error {
+	start := time.Now()
+	defer func() { bcryptDuration.WithLabelValues("compare").Observe(time.Since(start).Seconds()) }()
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
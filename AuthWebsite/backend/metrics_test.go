@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testMetricsToken = "test-metrics-token"
+
+var registerMetrics sync.Once
+
+// metricsApp mounts /metrics behind testMetricsToken on an app of its own.
+func metricsApp(t *testing.T) *fiber.App {
+	t.Helper()
+	registerMetrics.Do(initMetrics)
+	t.Setenv("AUTH_METRICS_TOKEN", testMetricsToken)
+	app := fiber.New()
+	if serveMetrics(app) != nil {
+		t.Fatal("metrics got a listener of their own despite AUTH_METRICS_TOKEN")
+	}
+	return app
+}
+
+func TestMetricsToken(t *testing.T) {
+	app := metricsApp(t)
+	for name, header := range map[string]string{
+		"no token":    "",
+		"wrong token": "Bearer not-" + testMetricsToken,
+		"bare token":  testMetricsToken,
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 401 {
+			t.Errorf("%s: status %d", name, resp.StatusCode)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+testMetricsToken)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	for _, name := range []string{"auth_active_sessions", "go_goroutines", "go_sql_max_open_connections"} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("metrics lack %s", name)
+		}
+	}
+}
+
+// counterDelta returns how much c grows while f runs.
+func counterDelta(c prometheus.Collector, f func()) float64 {
+	before := testutil.ToFloat64(c)
+	f()
+	return testutil.ToFloat64(c) - before
+}
+
+func TestAuthCounters(t *testing.T) {
+	username := newUsername()
+	if d := counterDelta(registrations.WithLabelValues("success"), func() { register(t, username, "correct horse") }); d != 1 {
+		t.Errorf("successful registrations grew by %v", d)
+	}
+	if d := counterDelta(registrations.WithLabelValues("username_taken"), func() {
+		decode(t, request(t, "POST", "/api/register", fiber.Map{"username": username, "password": "correct horse"}), 409)
+	}); d != 1 {
+		t.Errorf("taken-username registrations grew by %v", d)
+	}
+
+	if d := counterDelta(loginAttempts.WithLabelValues("success", ""), func() { login(t, username, "correct horse") }); d != 1 {
+		t.Errorf("successful logins grew by %v", d)
+	}
+	if d := counterDelta(loginAttempts.WithLabelValues("failure", "bad_password"), func() {
+		decode(t, request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "wrong"}), 401)
+	}); d != 1 {
+		t.Errorf("bad-password logins grew by %v", d)
+	}
+}
+
+func TestActiveSessionsGauge(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	var cookie *http.Cookie
+	if d := counterDelta(activeSessions, func() { cookie = login(t, username, "correct horse") }); d != 1 {
+		t.Errorf("active sessions grew by %v on login", d)
+	}
+	if d := counterDelta(activeSessions, func() { decode(t, request(t, "POST", "/api/logout", nil, cookie), 200) }); d != -1 {
+		t.Errorf("active sessions changed by %v on logout", d)
+	}
+}
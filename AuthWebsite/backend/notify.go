@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notification is a message to one user, usually sent by email.
+type Notification struct {
+	Username string
+	To       string // empty when the user has no email address on file
+	Subject  string
+	Body     string
+	Secrets  []string // one-time codes in Body, which must not end up in logs
+}
+
+// Notifier delivers notifications to users.
+type Notifier interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// logNotifier writes notifications to the server log; useful in development. The
+// secrets of a notification are redacted, as anyone reading the log could use them.
+type logNotifier struct{}
+
+func (logNotifier) Send(_ context.Context, n Notification) error {
+	log.Printf("notification for %s <%s>: %s\n%s", n.Username, n.To, n.Subject, redactSecrets(n.Body, n.Secrets))
+	return nil
+}
+
+func redactSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, "[redacted]")
+		}
+	}
+	return s
+}
+
+// smtpNotifier sends plain-text email through an SMTP relay.
+type smtpNotifier struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (s smtpNotifier) Send(ctx context.Context, n Notification) error {
+	if n.To == "" {
+		log.Printf("notification for %s dropped: no email address", n.Username)
+		return nil
+	}
+	if strings.ContainsAny(n.To+n.Subject, "\r\n") {
+		return fmt.Errorf("invalid header value in notification for %s", n.Username)
+	}
+	msg := "From: " + s.From + "\r\n" +
+		"To: " + n.To + "\r\n" +
+		"Subject: " + n.Subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.ReplaceAll(n.Body, "\n", "\r\n")
+
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.Addr, s.Auth, s.From, []string{n.To}, []byte(msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var notifier Notifier = logNotifier{}
+
+// loadNotifier picks the sender from AUTH_NOTIFIER ("log" or "smtp").
+func loadNotifier() (Notifier, error) {
+	switch name := envOr("AUTH_NOTIFIER", "log"); name {
+	case "log":
+		return logNotifier{}, nil
+	case "smtp":
+		s := smtpNotifier{Addr: envOr("AUTH_SMTP_ADDR", "localhost:25"), From: envOr("AUTH_SMTP_FROM", "")}
+		if s.From == "" {
+			return nil, fmt.Errorf("AUTH_SMTP_FROM is required for the smtp notifier")
+		}
+		if user := envOr("AUTH_SMTP_USERNAME", ""); user != "" {
+			host, _, err := net.SplitHostPort(s.Addr)
+			if err != nil {
+				return nil, err
+			}
+			s.Auth = smtp.PlainAuth("", user, envOr("AUTH_SMTP_PASSWORD", ""), host)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", name)
+	}
+}
+
+// notify sends n in the background so that logins do not wait on the mail relay.
+func notify(n Notification) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := notifier.Send(ctx, n); err != nil {
+			log.Printf("notify %s: %v", n.Username, err)
+		}
+	}()
+}
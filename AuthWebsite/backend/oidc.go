@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect / OAuth2 relying party. Providers with an issuer are configured by
+// discovery and must return a signed ID token; plain OAuth2 providers are given
+// explicit endpoints and identify the user through their userinfo endpoint.
+
+type oidcProvider struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+
+	AuthURL     string
+	TokenURL    string
+	UserinfoURL string
+	JWKSURL     string
+
+	// Claim names for OAuth2 providers whose userinfo is not OIDC shaped.
+	SubjectClaim  string
+	EmailClaim    string
+	UsernameClaim string
+
+	// LinkByEmail signs a new identity in to the local account with the same
+	// verified email. Only set it for providers whose email claims are trusted.
+	LinkByEmail bool
+
+	client *http.Client
+	keysMu sync.Mutex
+	keys   map[string]crypto.PublicKey // by kid
+}
+
+var oidcProviders = map[string]*oidcProvider{}
+
+// loadOIDCProviders reads AUTH_OIDC_PROVIDERS, a comma-separated list of names, and
+// AUTH_OIDC_<NAME>_* settings for each. Discovery runs once at startup.
+func loadOIDCProviders(ctx context.Context) (map[string]*oidcProvider, error) {
+	providers := map[string]*oidcProvider{}
+	publicURL := strings.TrimRight(envOr("AUTH_PUBLIC_URL", "http://localhost:8080"), "/")
+	for _, name := range strings.Split(envOr("AUTH_OIDC_PROVIDERS", ""), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "AUTH_OIDC_" + strings.ToUpper(name) + "_"
+		p := &oidcProvider{
+			Name:          name,
+			DisplayName:   envOr(prefix+"DISPLAY_NAME", name),
+			Issuer:        envOr(prefix+"ISSUER", ""),
+			ClientID:      envOr(prefix+"CLIENT_ID", ""),
+			ClientSecret:  envOr(prefix+"CLIENT_SECRET", ""),
+			Scopes:        strings.Fields(envOr(prefix+"SCOPES", "openid email profile")),
+			RedirectURL:   publicURL + "/api/oidc/" + name + "/callback",
+			AuthURL:       envOr(prefix+"AUTH_URL", ""),
+			TokenURL:      envOr(prefix+"TOKEN_URL", ""),
+			UserinfoURL:   envOr(prefix+"USERINFO_URL", ""),
+			SubjectClaim:  envOr(prefix+"SUBJECT_CLAIM", "sub"),
+			EmailClaim:    envOr(prefix+"EMAIL_CLAIM", "email"),
+			UsernameClaim: envOr(prefix+"USERNAME_CLAIM", "preferred_username"),
+			LinkByEmail:   envOr(prefix+"LINK_BY_EMAIL", "") == "true",
+			client:        &http.Client{Timeout: 10 * time.Second},
+		}
+		if p.ClientID == "" {
+			return nil, fmt.Errorf("oidc provider %s: client ID is required", name)
+		}
+		if p.Issuer != "" {
+			if err := p.discover(ctx); err != nil {
+				return nil, fmt.Errorf("oidc provider %s: %w", name, err)
+			}
+		} else if p.AuthURL == "" || p.TokenURL == "" || p.UserinfoURL == "" {
+			return nil, fmt.Errorf("oidc provider %s: set an issuer or auth, token and userinfo URLs", name)
+		}
+		providers[name] = p
+	}
+	return providers, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, rawURL, bearer string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover fills in endpoints from the issuer's OpenID configuration; explicit settings win.
+func (p *oidcProvider) discover(ctx context.Context) error {
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(ctx, strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", "", &doc); err != nil {
+		return err
+	}
+	if doc.Issuer != p.Issuer {
+		return fmt.Errorf("discovery returned issuer %q", doc.Issuer)
+	}
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&p.AuthURL, doc.AuthorizationEndpoint},
+		{&p.TokenURL, doc.TokenEndpoint},
+		{&p.UserinfoURL, doc.UserinfoEndpoint},
+		{&p.JWKSURL, doc.JWKSURI},
+	} {
+		if *f.dst == "" {
+			*f.dst = f.src
+		}
+	}
+	if p.AuthURL == "" || p.TokenURL == "" || p.JWKSURL == "" {
+		return errors.New("discovery document is missing endpoints")
+	}
+	return nil
+}
+
+// authCodeURL builds the authorization request with state, nonce and a PKCE S256 challenge.
+func (p *oidcProvider) authCodeURL(state, nonce, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if p.Issuer != "" {
+		q.Set("nonce", nonce)
+	}
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + q.Encode()
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+}
+
+func (p *oidcProvider) exchange(ctx context.Context, code, verifier string) (tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return tokenResponse{}, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var tok tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return tokenResponse{}, err
+	}
+	if tok.AccessToken == "" {
+		return tokenResponse{}, errors.New("token response without access token")
+	}
+	return tok, nil
+}
+
+// externalIdentity is the verified result of a provider login.
+type externalIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+// identify verifies the ID token (OIDC) or queries userinfo (OAuth2) after a code exchange.
+func (p *oidcProvider) identify(ctx context.Context, tok tokenResponse, nonce string) (externalIdentity, error) {
+	if p.Issuer == "" {
+		var claims map[string]any
+		if err := p.getJSON(ctx, p.UserinfoURL, tok.AccessToken, &claims); err != nil {
+			return externalIdentity{}, err
+		}
+		id := externalIdentity{
+			Subject:  claimString(claims, p.SubjectClaim),
+			Email:    claimString(claims, p.EmailClaim),
+			Username: claimString(claims, p.UsernameClaim),
+		}
+		// Plain OAuth2 gives no verification guarantee, so these emails never link accounts.
+		if id.Subject == "" {
+			return id, errors.New("userinfo without subject")
+		}
+		return id, nil
+	}
+
+	if tok.IDToken == "" {
+		return externalIdentity{}, errors.New("token response without id_token")
+	}
+	claims, err := p.verifyIDToken(ctx, tok.IDToken, nonce)
+	if err != nil {
+		return externalIdentity{}, err
+	}
+	verified, _ := claims["email_verified"].(bool)
+	return externalIdentity{
+		Subject:       claimString(claims, "sub"),
+		Email:         claimString(claims, "email"),
+		EmailVerified: verified,
+		Username:      claimString(claims, "preferred_username"),
+	}, nil
+}
+
+// claimString returns a string claim; numeric subjects (e.g. GitHub user IDs) are formatted.
+func claimString(claims map[string]any, name string) string {
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	}
+	return ""
+}
+
+// verifyIDToken checks signature, issuer, audience, expiry and nonce of a compact JWS.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id_token")
+	}
+	headerJSON, err1 := base64.RawURLEncoding.DecodeString(parts[0])
+	payload, err2 := base64.RawURLEncoding.DecodeString(parts[1])
+	sig, err3 := base64.RawURLEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, errors.New("malformed id_token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed id_token header")
+	}
+	key, err := p.signingKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed id_token claims")
+	}
+	if claims["iss"] != p.Issuer {
+		return nil, errors.New("id_token issuer mismatch")
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud != p.ClientID {
+			return nil, errors.New("id_token audience mismatch")
+		}
+	case []any:
+		if !slices.Contains(aud, any(p.ClientID)) {
+			return nil, errors.New("id_token audience mismatch")
+		}
+		if azp, ok := claims["azp"]; ok && azp != p.ClientID {
+			return nil, errors.New("id_token authorized party mismatch")
+		}
+	default:
+		return nil, errors.New("id_token without audience")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, errors.New("id_token expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+	if claimString(claims, "sub") == "" {
+		return nil, errors.New("id_token without subject")
+	}
+	return claims, nil
+}
+
+func verifyJWS(alg string, key crypto.PublicKey, signingInput, sig []byte) error {
+	digest := sha256.Sum256(signingInput)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		// JWS uses the raw r||s encoding rather than ASN.1.
+		if alg == "ES256" && len(sig) == 64 &&
+			ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil
+		}
+	}
+	return errors.New("id_token signature verification failed")
+}
+
+// signingKey returns the JWKS key with kid, refetching the key set once when it is unknown
+// so that provider key rotation is picked up.
+func (p *oidcProvider) signingKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.keysMu.Lock()
+	defer p.keysMu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.JWKSURL, "", &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 == nil && err2 == nil && len(e) <= 4 {
+				p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			}
+		case "EC":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 == nil && err2 == nil && k.Crv == "P-256" {
+				pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+				if pub.Curve.IsOnCurve(pub.X, pub.Y) {
+					p.keys[k.Kid] = pub
+				}
+			}
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key with kid %q", kid)
+}
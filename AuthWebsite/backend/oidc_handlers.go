@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	oidcStateTTL = 10 * time.Minute
+
+	// oidcStateCookie holds the SHA-256 of the state of the login started in this browser.
+	oidcStateCookie = "oidc_state"
+
+	// maxPendingOIDCLogins bounds the pending logins, which anyone can start.
+	maxPendingOIDCLogins = 10000
+)
+
+// oidcLogin is the server-side half of an authorization request, keyed by state.
+type oidcLogin struct {
+	Provider  string
+	Nonce     string
+	Verifier  string
+	LinkUser  string // set when a logged-in user is linking another identity
+	Reauth    string // id of the session whose user is confirming it by signing in again
+	ExpiresAt time.Time
+}
+
+var (
+	oidcLogins   = make(map[string]oidcLogin)
+	oidcLoginsMu sync.Mutex
+)
+
+var errTooManyOIDCLogins = errors.New("too many pending OIDC logins")
+
+func saveOIDCLogin(state string, l oidcLogin) error {
+	oidcLoginsMu.Lock()
+	defer oidcLoginsMu.Unlock()
+	if len(oidcLogins) >= maxPendingOIDCLogins {
+		return errTooManyOIDCLogins
+	}
+	oidcLogins[state] = l
+	return nil
+}
+
+// expireOIDCLogins drops the logins that never came back from the provider.
+func expireOIDCLogins(now time.Time) {
+	oidcLoginsMu.Lock()
+	defer oidcLoginsMu.Unlock()
+	for s, pending := range oidcLogins {
+		if now.After(pending.ExpiresAt) {
+			delete(oidcLogins, s)
+		}
+	}
+}
+
+// takeOIDCLogin consumes state so that a callback cannot be replayed.
+func takeOIDCLogin(state string) (oidcLogin, bool) {
+	oidcLoginsMu.Lock()
+	defer oidcLoginsMu.Unlock()
+	l, ok := oidcLogins[state]
+	delete(oidcLogins, state)
+	if !ok || time.Now().After(l.ExpiresAt) {
+		return oidcLogin{}, false
+	}
+	return l, true
+}
+
+func listOIDCProvidersHandler(c *fiber.Ctx) error {
+	providers := []fiber.Map{}
+	for _, p := range oidcProviders {
+		providers = append(providers, fiber.Map{
+			"name":         p.Name,
+			"display_name": p.DisplayName,
+			"login_url":    "/api/oidc/" + p.Name + "/login",
+		})
+	}
+	return c.JSON(fiber.Map{"providers": providers})
+}
+
+// oidcLoginHandler redirects to the provider. With ?link=1 and a valid session the
+// resulting identity is linked to the current account instead of logging in; with
+// ?reauth=1 signing in at a linked provider confirms the session for a sensitive
+// action, see reauthenticate.
+func oidcLoginHandler(c *fiber.Ctx) error {
+	p, ok := oidcProviders[c.Params("provider")]
+	if !ok {
+		return c.Status(404).JSON(fiber.Map{"error": "Unknown provider"})
+	}
+
+	login := oidcLogin{
+		Provider:  p.Name,
+		Nonce:     generateToken(),
+		Verifier:  generateToken(),
+		ExpiresAt: time.Now().Add(oidcStateTTL),
+	}
+	if c.Query("link") != "" || c.Query("reauth") != "" {
+		// A re-authentication is how a passwordless account completes a step-up.
+		token := c.Cookies("session_token")
+		sess, exists := boundSession(c, token, c.Query("link") == "")
+		if !exists {
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+		if sess.Impersonator != "" {
+			return c.Status(403).JSON(fiber.Map{"error": "Not allowed while impersonating"})
+		}
+		if c.Query("link") != "" {
+			login.LinkUser = sess.Username
+		} else {
+			login.Reauth = hashToken(token)
+		}
+	}
+	state := generateToken()
+	if err := saveOIDCLogin(state, login); err != nil {
+		return c.Status(503).JSON(fiber.Map{"error": "Too many pending sign-ins, try again later"})
+	}
+	// The callback must come back to the browser that started the login, or an
+	// attacker could finish their own authorization in someone else's browser.
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    hashToken(state),
+		Path:     "/api/oidc/" + p.Name + "/callback",
+		Expires:  login.ExpiresAt,
+		HTTPOnly: true,
+		Secure:   secureCookies,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return c.Redirect(p.authCodeURL(state, login.Nonce, login.Verifier), fiber.StatusFound)
+}
+
+// oidcCallbackHandler completes the code flow and ends in the same session cookie as loginHandler.
+func oidcCallbackHandler(c *fiber.Ctx) error {
+	p, ok := oidcProviders[c.Params("provider")]
+	if !ok {
+		return c.Status(404).JSON(fiber.Map{"error": "Unknown provider"})
+	}
+	stateHash := c.Cookies(oidcStateCookie)
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/api/oidc/" + p.Name + "/callback",
+		Expires:  time.Now().Add(-time.Hour),
+		HTTPOnly: true,
+		Secure:   secureCookies,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	if subtle.ConstantTimeCompare([]byte(stateHash), []byte(hashToken(c.Query("state")))) != 1 {
+		loginAttempts.WithLabelValues("failure", "oidc_state").Inc()
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid or expired login attempt"})
+	}
+	login, ok := takeOIDCLogin(c.Query("state"))
+	if !ok || login.Provider != p.Name {
+		loginAttempts.WithLabelValues("failure", "oidc_state").Inc()
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid or expired login attempt"})
+	}
+	// A link lands on the account that asked for it only while that account is
+	// still signed in here.
+	if login.LinkUser != "" {
+		sess, exists := boundSession(c, c.Cookies("session_token"), false)
+		if !exists || sess.Username != login.LinkUser || sess.Impersonator != "" {
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+	}
+	if errCode := c.Query("error"); errCode != "" {
+		loginAttempts.WithLabelValues("failure", "oidc_denied").Inc()
+		return c.Status(401).JSON(fiber.Map{"error": "Sign-in was cancelled at the provider"})
+	}
+
+	tok, err := p.exchange(c.Context(), c.Query("code"), login.Verifier)
+	if err != nil {
+		log.Printf("oidc %s: %v", p.Name, err)
+		loginAttempts.WithLabelValues("failure", "oidc_exchange").Inc()
+		return c.Status(502).JSON(fiber.Map{"error": "Could not complete sign-in with the provider"})
+	}
+	ext, err := p.identify(c.Context(), tok, login.Nonce)
+	if err != nil {
+		log.Printf("oidc %s: %v", p.Name, err)
+		loginAttempts.WithLabelValues("failure", "oidc_invalid").Inc()
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	if login.Reauth != "" {
+		return oidcReauthCallback(c, p.Name, ext, login.Reauth)
+	}
+	if login.LinkUser != "" {
+		if err := linkIdentity(p.Name, ext, login.LinkUser); err != nil {
+			return c.Status(409).JSON(fiber.Map{"error": "This account is already linked to another user"})
+		}
+		audit(login.LinkUser, "identity_link", c.IP(), p.Name)
+		return c.Redirect(envOr("AUTH_PUBLIC_URL", "http://localhost:8080")+"/", fiber.StatusFound)
+	}
+
+	username, err := resolveIdentity(p, ext)
+	if errors.Is(err, errRegistrationDisabled) {
+		loginAttempts.WithLabelValues("failure", "oidc_no_account").Inc()
+		return c.Status(403).JSON(fiber.Map{"error": "No account is linked to this identity"})
+	} else if err != nil {
+		log.Printf("oidc %s: %v", p.Name, err)
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if err := startSession(c, username, "oidc:"+p.Name); err != nil {
+		return sessionRefused(c, err)
+	}
+	return c.Redirect(envOr("AUTH_PUBLIC_URL", "http://localhost:8080")+"/", fiber.StatusFound)
+}
+
+// oidcReauthCallback confirms the session sessionID if ext is linked to its user and
+// the browser still holds that session.
+func oidcReauthCallback(c *fiber.Ctx, provider string, ext externalIdentity, sessionID string) error {
+	token := c.Cookies("session_token")
+	sess, exists := boundSession(c, token, true)
+	if !exists || hashToken(token) != sessionID {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	var linked string
+	err := db.QueryRow("SELECT username FROM user_identities WHERE provider = ? AND subject = ?", provider, ext.Subject).Scan(&linked)
+	if err != nil && err != sql.ErrNoRows {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if linked != sess.Username {
+		audit(sess.Username, "reauth_failure", c.IP(), provider)
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+	markReauthenticated(sessionID)
+	audit(sess.Username, "reauth", c.IP(), provider)
+	return c.Redirect(envOr("AUTH_PUBLIC_URL", "http://localhost:8080")+"/", fiber.StatusFound)
+}
+
+var errRegistrationDisabled = errors.New("registration is not open")
+
+func linkIdentity(provider string, ext externalIdentity, username string) error {
+	_, err := db.Exec("INSERT INTO user_identities (provider, subject, username, email, created_at) VALUES (?, ?, ?, ?, ?)",
+		provider, ext.Subject, username, ext.Email, time.Now())
+	return err
+}
+
+// resolveIdentity finds the account for an external identity: an existing link, then,
+// if the provider is trusted with AUTH_OIDC_<NAME>_LINK_BY_EMAIL, the one local
+// account whose verified email the provider also vouches for, and finally a new
+// account if registration is open. Addresses users type into their profile are not
+// verified, so they never attract a provider identity; such users link providers
+// themselves through ?link=1.
+func resolveIdentity(p *oidcProvider, ext externalIdentity) (string, error) {
+	provider := p.Name
+	var username string
+	err := db.QueryRow("SELECT username FROM user_identities WHERE provider = ? AND subject = ?", provider, ext.Subject).Scan(&username)
+	if err != sql.ErrNoRows {
+		return username, err
+	}
+
+	if p.LinkByEmail && ext.EmailVerified && ext.Email != "" {
+		username, err = userByVerifiedEmail(ext.Email)
+		if err != nil {
+			return "", err
+		}
+		if username != "" {
+			if err := linkIdentity(provider, ext, username); err != nil {
+				return "", err
+			}
+			audit(username, "identity_link", "", provider+" by verified email")
+			return username, nil
+		}
+	}
+
+	mode, err := registrationMode()
+	if err != nil {
+		return "", err
+	}
+	if mode != registrationOpen {
+		return "", errRegistrationDisabled
+	}
+	username, err = createExternalUser(provider, ext)
+	if err != nil {
+		return "", err
+	}
+	registrations.WithLabelValues("success").Inc()
+	audit(username, "register", "", provider)
+	emitEvent(eventUserRegistered, fiber.Map{"username": username, "source": provider})
+	return username, nil
+}
+
+// userByVerifiedEmail returns the local account with the verified address email, or
+// "" when there is none or more than one.
+func userByVerifiedEmail(email string) (string, error) {
+	rows, err := db.Query("SELECT username FROM users WHERE LOWER(email) = LOWER(?) AND email_verified = 1 AND auth_source = 'local' LIMIT 2", email)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var matches []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return "", err
+		}
+		matches = append(matches, username)
+	}
+	if len(matches) != 1 {
+		return "", rows.Err()
+	}
+	return matches[0], rows.Err()
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// createExternalUser inserts a passwordless account and its identity link, picking a
+// free username derived from the provider's claims.
+func createExternalUser(provider string, ext externalIdentity) (string, error) {
+	base := ext.Username
+	if base == "" {
+		base, _, _ = strings.Cut(ext.Email, "@")
+	}
+	base = usernameUnsafe.ReplaceAllString(base, "")
+	if base == "" {
+		base = provider + "-user"
+	}
+	email := ""
+	if ext.EmailVerified {
+		email = ext.Email
+	}
+
+	for i := 0; i < 20; i++ {
+		// Usernames are at most 255 bytes; the base is ASCII after usernameUnsafe.
+		suffix := ""
+		if i > 0 {
+			suffix = strconv.Itoa(i + 1)
+		}
+		username := base[:min(len(base), 255-len(suffix))] + suffix
+		// A reserved or look-alike name gets a numbered variant instead.
+		if err := checkNewUsername(username, ""); err == errReservedUsername || err == errConfusableUsername {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return "", err
+		}
+		// The "!" hash can never match, so the account is usable only through its linked identities.
+		key := usernameKey(username)
+		_, err = tx.Exec("INSERT INTO users (username, username_canonical, username_skeleton, password_hash, email, email_verified) VALUES (?, ?, ?, '!', ?, ?)",
+			username, key, usernameSkeleton(key), email, email != "")
+		if isDuplicateKey(err) {
+			tx.Rollback()
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+		_, err = tx.Exec("INSERT INTO user_identities (provider, subject, username, email, created_at) VALUES (?, ?, ?, ?, ?)",
+			provider, ext.Subject, username, ext.Email, time.Now())
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+		return username, nil
+	}
+	return "", fmt.Errorf("no free username for %q", base)
+}
+
+type linkedIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func listIdentities(username string) ([]linkedIdentity, error) {
+	rows, err := db.Query("SELECT provider, subject, email, created_at FROM user_identities WHERE username = ? ORDER BY created_at", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	identities := []linkedIdentity{}
+	for rows.Next() {
+		var id linkedIdentity
+		if err := rows.Scan(&id.Provider, &id.Subject, &id.Email, &id.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	return identities, rows.Err()
+}
+
+func listIdentitiesHandler(c *fiber.Ctx) error {
+	identities, err := listIdentities(c.Locals("username").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(fiber.Map{"identities": identities})
+}
+
+// signInMethods reports whether username has a password and how many provider links
+// and passkeys it can sign in with.
+func signInMethods(username string) (hasPassword bool, links, passkeys int, err error) {
+	var passwordHash string
+	err = db.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&passwordHash)
+	if err == nil {
+		err = db.QueryRow("SELECT COUNT(*) FROM user_identities WHERE username = ?", username).Scan(&links)
+	}
+	if err == nil {
+		err = db.QueryRow("SELECT COUNT(*) FROM webauthn_credentials WHERE username = ?", username).Scan(&passkeys)
+	}
+	return passwordHash != "!", links, passkeys, err
+}
+
+// unlinkIdentityHandler removes a provider link unless it is the account's last way to sign in.
+func unlinkIdentityHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	provider := c.Params("provider")
+
+	hasPassword, links, passkeys, err := signInMethods(username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if !hasPassword && passkeys == 0 && links <= 1 {
+		return c.Status(409).JSON(fiber.Map{"error": "Cannot remove your only way to sign in"})
+	}
+
+	res, err := db.Exec("DELETE FROM user_identities WHERE username = ? AND provider = ?", username, provider)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Identity not linked"})
+	}
+	audit(username, "identity_unlink", c.IP(), provider)
+	return c.JSON(fiber.Map{"message": "Identity unlinked"})
+}
+
+// exportIdentities lists linked provider accounts for the personal-data export.
+func exportIdentities(username string) (any, error) {
+	return listIdentities(username)
+}
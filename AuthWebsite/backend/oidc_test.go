@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// mockIdP is an OpenID provider: discovery, JWKS, and a token endpoint that checks
+// the PKCE verifier and client credentials. Authorization is done by the test
+// through authorize instead of a login page.
+type mockIdP struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+	kid string
+
+	mu    sync.Mutex
+	codes map[string]mockGrant // authorization code → grant
+	// badNonce makes the next ID token carry a nonce other than the requested one.
+	badNonce bool
+}
+
+type mockGrant struct {
+	Challenge, RedirectURI, Nonce string
+	Claims                        map[string]any
+}
+
+const mockClientID, mockClientSecret = "test-client", "test-secret"
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, kid: "key-1", codes: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"userinfo_endpoint":      idp.URL + "/userinfo",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "EC", "crv": "P-256", "use": "sig", "kid": idp.kid,
+			"x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	idp.mu.Lock()
+	grant, ok := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	badNonce := idp.badNonce
+	idp.badNonce = false
+	idp.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || id != mockClientID || secret != mockClientSecret || r.FormValue("grant_type") != "authorization_code" ||
+		r.FormValue("redirect_uri") != grant.RedirectURI ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.Challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	claims := map[string]any{
+		"iss": idp.URL, "aud": mockClientID, "exp": time.Now().Add(time.Hour).Unix(), "nonce": grant.Nonce,
+	}
+	if badNonce {
+		claims["nonce"] = generateToken()
+	}
+	for k, v := range grant.Claims {
+		claims[k] = v
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": generateToken(), "token_type": "Bearer", "id_token": idp.sign(claims),
+	})
+}
+
+// sign returns claims as an ES256 compact JWS.
+func (idp *mockIdP) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": idp.kid})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, idp.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize plays the user signing in at the provider as subject and returns the
+// callback URL the provider redirects back to.
+func (idp *mockIdP) authorize(t *testing.T, authURL, subject string, claims map[string]any) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme+"://"+u.Host != idp.URL || u.Path != "/authorize" {
+		t.Fatalf("redirected to %s, want the provider's authorization endpoint", authURL)
+	}
+	if q.Get("client_id") != mockClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" ||
+		q.Get("code_challenge") == "" || q.Get("nonce") == "" || q.Get("state") == "" {
+		t.Fatalf("authorization request %v", q)
+	}
+	grant := mockGrant{Challenge: q.Get("code_challenge"), RedirectURI: q.Get("redirect_uri"), Nonce: q.Get("nonce"),
+		Claims: map[string]any{"sub": subject}}
+	for k, v := range claims {
+		grant.Claims[k] = v
+	}
+	code := generateToken()
+	idp.mu.Lock()
+	idp.codes[code] = grant
+	idp.mu.Unlock()
+
+	callback, err := url.Parse(grant.RedirectURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	return callback.RequestURI()
+}
+
+// useMockIdP registers idp as provider "mock" for the rest of the test.
+func useMockIdP(t *testing.T, idp *mockIdP) {
+	p := &oidcProvider{
+		Name:         "mock",
+		DisplayName:  "Mock",
+		Issuer:       idp.URL,
+		ClientID:     mockClientID,
+		ClientSecret: mockClientSecret,
+		Scopes:       []string{"openid", "email"},
+		RedirectURL:  "http://localhost:8080/api/oidc/mock/callback",
+		client:       idp.Client(),
+	}
+	if err := p.discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	oidcProviders["mock"] = p
+	t.Cleanup(func() { delete(oidcProviders, "mock") })
+}
+
+// startOIDC begins a login (query may ask for link or reauth) and returns the
+// provider URL and the state cookie.
+func startOIDC(t *testing.T, query string, cookies ...*http.Cookie) (string, *http.Cookie) {
+	t.Helper()
+	resp := request(t, "GET", "/api/oidc/mock/login"+query, nil, cookies...)
+	if resp.StatusCode != http.StatusFound {
+		decode(t, resp, http.StatusFound)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == oidcStateCookie {
+			return resp.Header.Get("Location"), c
+		}
+	}
+	t.Fatal("login did not set the state cookie")
+	return "", nil
+}
+
+// oidcSignIn signs in at the mock provider as subject and returns the callback response.
+func oidcSignIn(t *testing.T, idp *mockIdP, query, subject string, claims map[string]any, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+	authURL, state := startOIDC(t, query, cookies...)
+	return request(t, "GET", idp.authorize(t, authURL, subject, claims), nil, append(cookies, state)...)
+}
+
+func expectRedirect(t *testing.T, resp *http.Response) {
+	t.Helper()
+	if resp.StatusCode != http.StatusFound {
+		decode(t, resp, http.StatusFound)
+	}
+	resp.Body.Close()
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	p := oidcProviders["mock"]
+	if p.AuthURL != idp.URL+"/authorize" || p.TokenURL != idp.URL+"/token" || p.JWKSURL != idp.URL+"/jwks" {
+		t.Errorf("discovered endpoints %s %s %s", p.AuthURL, p.TokenURL, p.JWKSURL)
+	}
+
+	other := &oidcProvider{Name: "other", Issuer: idp.URL + "/elsewhere", client: idp.Client()}
+	if err := other.discover(context.Background()); err == nil {
+		t.Error("discovery accepted a document for another issuer")
+	}
+}
+
+func TestOIDCSignUpAndLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	subject := generateToken()
+
+	resp := oidcSignIn(t, idp, "", subject, map[string]any{"preferred_username": newUsername()})
+	expectRedirect(t, resp)
+	cookie := sessionCookie(resp)
+	if cookie == nil {
+		t.Fatal("callback did not sign in")
+	}
+	profile := decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	username := profile["username"].(string)
+
+	// The same subject signs in to the same account.
+	resp = oidcSignIn(t, idp, "", subject, nil)
+	expectRedirect(t, resp)
+	profile = decode(t, request(t, "GET", "/api/profile", nil, sessionCookie(resp)), 200)
+	if profile["username"] != username {
+		t.Errorf("second sign-in reached %v, want %s", profile["username"], username)
+	}
+	identities := decode(t, request(t, "GET", "/api/oidc/identities", nil, cookie), 200)["identities"].([]any)
+	if len(identities) != 1 || identities[0].(map[string]any)["subject"] != subject {
+		t.Errorf("identities = %v", identities)
+	}
+}
+
+func TestOIDCCallbackRejected(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+
+	t.Run("no state cookie", func(t *testing.T) {
+		// Login CSRF: the callback of someone else's authorization.
+		authURL, _ := startOIDC(t, "")
+		resp := request(t, "GET", idp.authorize(t, authURL, generateToken(), nil), nil)
+		decode(t, resp, 400)
+	})
+	t.Run("state cookie of another login", func(t *testing.T) {
+		_, mine := startOIDC(t, "")
+		authURL, _ := startOIDC(t, "")
+		decode(t, request(t, "GET", idp.authorize(t, authURL, generateToken(), nil), nil, mine), 400)
+	})
+	t.Run("replayed state", func(t *testing.T) {
+		authURL, state := startOIDC(t, "")
+		callback := idp.authorize(t, authURL, generateToken(), nil)
+		expectRedirect(t, request(t, "GET", callback, nil, state))
+		decode(t, request(t, "GET", callback, nil, state), 400)
+	})
+	t.Run("wrong nonce", func(t *testing.T) {
+		idp.badNonce = true
+		decode(t, oidcSignIn(t, idp, "", generateToken(), nil), 401)
+	})
+	t.Run("code exchanged with another verifier", func(t *testing.T) {
+		authURL, _ := startOIDC(t, "")
+		callback := idp.authorize(t, authURL, generateToken(), nil)
+		// Swap the code into a different login, whose verifier does not match.
+		otherURL, otherState := startOIDC(t, "")
+		u, _ := url.Parse(callback)
+		o, _ := url.Parse(otherURL)
+		forged := "/api/oidc/mock/callback?" + url.Values{"code": {u.Query().Get("code")}, "state": {o.Query().Get("state")}}.Encode()
+		decode(t, request(t, "GET", forged, nil, otherState), 502)
+	})
+	t.Run("token signed by an unknown key", func(t *testing.T) {
+		saved := idp.key
+		idp.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		// The JWKS still publishes the original key under this kid.
+		defer func() { idp.key = saved }()
+		decode(t, oidcSignIn(t, idp, "", generateToken(), nil), 401)
+	})
+}
+
+func TestOIDCNoLinkByEmail(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	local := newUsername()
+	register(t, local, "correct horse")
+	email := local + "@example.com"
+	decode(t, request(t, "PATCH", "/api/profile", fiber.Map{"email": email}, login(t, local, "correct horse")), 200)
+
+	resp := oidcSignIn(t, idp, "", generateToken(), map[string]any{"email": email, "email_verified": true})
+	expectRedirect(t, resp)
+	profile := decode(t, request(t, "GET", "/api/profile", nil, sessionCookie(resp)), 200)
+	if profile["username"] == local {
+		t.Error("a provider identity with the same email signed in to the existing account")
+	}
+}
+
+func TestOIDCLinkByVerifiedEmail(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	oidcProviders["mock"].LinkByEmail = true
+	// Addresses from the provisioning system count as verified.
+	local := newUsername()
+	email := local + "@example.com"
+	body := scimUserBody(local)
+	body["emails"] = []fiber.Map{{"value": email, "primary": true}}
+	decode(t, scimRequest(t, "POST", "/scim/v2/Users", body), 201)
+	signInAs := func(claims map[string]any) any {
+		t.Helper()
+		resp := oidcSignIn(t, idp, "", generateToken(), claims)
+		expectRedirect(t, resp)
+		return decode(t, request(t, "GET", "/api/profile", nil, sessionCookie(resp)), 200)["username"]
+	}
+
+	if got := signInAs(map[string]any{"email": email, "email_verified": false}); got == local {
+		t.Error("an identity with an unverified email was linked")
+	}
+	if got := signInAs(map[string]any{"email": strings.ToUpper(email), "email_verified": true}); got != local {
+		t.Errorf("identity with the verified email signed in to %v, want %s", got, local)
+	}
+	identities, err := listIdentities(local)
+	if err != nil || len(identities) != 1 {
+		t.Errorf("identities = %v, %v", identities, err)
+	}
+
+	// Once the user types in another address, it is no longer verified.
+	other := newUsername()
+	body = scimUserBody(other)
+	body["password"] = "correct horse"
+	body["emails"] = []fiber.Map{{"value": other + "@example.com"}}
+	decode(t, scimRequest(t, "POST", "/scim/v2/Users", body), 201)
+	decode(t, request(t, "PATCH", "/api/profile", fiber.Map{"email": other + "@example.org"}, login(t, other, "correct horse")), 200)
+	if got := signInAs(map[string]any{"email": other + "@example.org", "email_verified": true}); got == other {
+		t.Error("an identity was linked by an address typed into the profile")
+	}
+
+	// Providers are not trusted with linking unless configured to be.
+	oidcProviders["mock"].LinkByEmail = false
+	if got := signInAs(map[string]any{"email": email, "email_verified": true}); got == local {
+		t.Error("an untrusted provider's identity was linked by email")
+	}
+}
+
+func TestOIDCLongUsername(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	long := strings.Repeat("x", 300)
+	var names []string
+	for i := 0; i < 2; i++ {
+		resp := oidcSignIn(t, idp, "", generateToken(), map[string]any{"preferred_username": long})
+		expectRedirect(t, resp)
+		names = append(names, decode(t, request(t, "GET", "/api/profile", nil, sessionCookie(resp)), 200)["username"].(string))
+	}
+	if len(names[0]) != 255 || len(names[1]) != 255 || names[0] == names[1] {
+		t.Errorf("usernames %q", names)
+	}
+}
+
+func TestOIDCLinkAndUnlink(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+	subject := generateToken()
+
+	decode(t, request(t, "GET", "/api/oidc/mock/login?link=1", nil), 401)
+
+	// The callback of a link must come with the session that started it.
+	authURL, state := startOIDC(t, "?link=1", cookie)
+	decode(t, request(t, "GET", idp.authorize(t, authURL, subject, nil), nil, state), 401)
+
+	expectRedirect(t, oidcSignIn(t, idp, "?link=1", subject, nil, cookie))
+	resp := oidcSignIn(t, idp, "", subject, nil)
+	expectRedirect(t, resp)
+	profile := decode(t, request(t, "GET", "/api/profile", nil, sessionCookie(resp)), 200)
+	if profile["username"] != username {
+		t.Errorf("linked identity signed in to %v, want %s", profile["username"], username)
+	}
+
+	decode(t, request(t, "DELETE", "/api/oidc/identities/mock", nil, cookie), 200)
+	decode(t, request(t, "DELETE", "/api/oidc/identities/mock", nil, cookie), 404)
+}
+
+func TestOIDCLinkChecksSessionBinding(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	saved := sessionBindingMode
+	sessionBindingMode = bindingModes["strict"]
+	t.Cleanup(func() { sessionBindingMode = saved })
+	username := newUsername()
+	register(t, username, "correct horse")
+
+	// A cookie showing up in another browser is revoked, not linked.
+	cookie := login(t, username, "correct horse")
+	req := httptest.NewRequest("GET", "/api/oidc/mock/login?link=1", nil)
+	req.Header.Set("User-Agent", otherBrowser)
+	req.AddCookie(cookie)
+	resp, err := testApp.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, resp, 401)
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 401)
+
+	// Neither end of a link accepts a session waiting for a step-up.
+	cookie = login(t, username, "correct horse")
+	authURL, state := startOIDC(t, "?link=1", cookie)
+	requireStepUp(t, cookie)
+	decode(t, request(t, "GET", idp.authorize(t, authURL, generateToken(), nil), nil, cookie, state), 401)
+	decode(t, request(t, "GET", "/api/oidc/mock/login?link=1", nil, cookie), 401)
+}
+
+// requireStepUp marks the session behind cookie as waiting for a step-up.
+func requireStepUp(t *testing.T, cookie *http.Cookie) {
+	t.Helper()
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	id := hashToken(cookie.Value)
+	s, ok := sessions[id]
+	if !ok {
+		t.Fatal("no such session")
+	}
+	s.StepUp = true
+	sessions[id] = s
+}
+
+func TestOIDCOnlyAccountReauthentication(t *testing.T) {
+	idp := newMockIdP(t)
+	useMockIdP(t, idp)
+	subject := generateToken()
+	resp := oidcSignIn(t, idp, "", subject, map[string]any{"preferred_username": newUsername()})
+	expectRedirect(t, resp)
+	cookie := sessionCookie(resp)
+
+	// The only sign-in method cannot be removed.
+	decode(t, request(t, "DELETE", "/api/oidc/identities/mock", nil, cookie), 409)
+
+	// Without a password, the account needs a fresh provider sign-in ...
+	newName := newUsername()
+	decode(t, request(t, "POST", "/api/profile/username", fiber.Map{"new_username": newName}, cookie), 401)
+	expectRedirect(t, oidcSignIn(t, idp, "?reauth=1", subject, nil, cookie))
+	decode(t, request(t, "POST", "/api/profile/username", fiber.Map{"new_username": newName}, cookie), 200)
+	// ... which is used up by one action.
+	decode(t, request(t, "DELETE", "/api/account", fiber.Map{}, cookie), 401)
+
+	// Signing in as somebody else does not confirm the session.
+	decode(t, oidcSignIn(t, idp, "?reauth=1", generateToken(), nil, cookie), 401)
+	decode(t, request(t, "DELETE", "/api/account", fiber.Map{}, cookie), 401)
+
+	// Step-up after a network change.
+	id := hashToken(cookie.Value)
+	sessionsMu.Lock()
+	s := sessions[id]
+	s.StepUp = true
+	sessions[id] = s
+	sessionsMu.Unlock()
+	decode(t, request(t, "POST", "/api/session/step-up", fiber.Map{}, cookie), 401)
+	expectRedirect(t, oidcSignIn(t, idp, "?reauth=1", subject, nil, cookie))
+	decode(t, request(t, "POST", "/api/session/step-up", fiber.Map{}, cookie), 200)
+
+	expectRedirect(t, oidcSignIn(t, idp, "?reauth=1", subject, nil, cookie))
+	decode(t, request(t, "DELETE", "/api/account", fiber.Map{}, cookie), 200)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// openapi.json describes every route of the server. It is served as-is and its
+// component schemas are used to validate request bodies before they reach a handler.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// jsonSchema is the subset of JSON Schema used by the request schemas in openapi.json.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 any                    `json:"type"` // a type name or a list of them
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties any                    `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []any                  `json:"enum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	Pattern              string                 `json:"pattern"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+
+	pattern *regexp.Regexp
+}
+
+var openAPISchemas map[string]*jsonSchema
+
+// loadOpenAPI parses the component schemas of the embedded document.
+func loadOpenAPI() error {
+	var doc struct {
+		Components struct {
+			Schemas map[string]*jsonSchema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPIDocument, &doc); err != nil {
+		return fmt.Errorf("openapi.json: %w", err)
+	}
+	for name, s := range doc.Components.Schemas {
+		if err := s.compile(); err != nil {
+			return fmt.Errorf("openapi.json: schema %s: %w", name, err)
+		}
+	}
+	openAPISchemas = doc.Components.Schemas
+	return nil
+}
+
+func (s *jsonSchema) compile() error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = re
+	}
+	children := append([]*jsonSchema{s.Items}, s.OneOf...)
+	for _, p := range s.Properties {
+		children = append(children, p)
+	}
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if err := child.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openAPIHandler(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	return c.Send(openAPIDocument)
+}
+
+// validateBody rejects requests whose JSON body does not match the named
+// component schema. Schemas are resolved when the route is set up, so
+// loadOpenAPI must run first.
+func validateBody(schema string) fiber.Handler {
+	s, ok := openAPISchemas[schema]
+	if !ok {
+		panic("openapi: no schema named " + schema)
+	}
+	return func(c *fiber.Ctx) error {
+		if !c.Is("json") {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request", "details": []string{"body must be application/json"}})
+		}
+		var body any
+		if err := json.Unmarshal(c.Body(), &body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request", "details": []string{"body is not valid JSON"}})
+		}
+		if problems := s.validate("body", body); len(problems) > 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request", "details": problems})
+		}
+		return c.Next()
+	}
+}
+
+// validate returns a description of every way v violates the schema.
+func (s *jsonSchema) validate(path string, v any) []string {
+	if s.Ref != "" {
+		name, _ := strings.CutPrefix(s.Ref, "#/components/schemas/")
+		target, ok := openAPISchemas[name]
+		if !ok {
+			return []string{path + ": unresolvable schema " + s.Ref}
+		}
+		return target.validate(path, v)
+	}
+
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, alt := range s.OneOf {
+			if len(alt.validate(path, v)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return []string{path + ": must match exactly one of the allowed schemas"}
+		}
+	}
+
+	if types := s.types(); len(types) > 0 && !hasJSONType(types, v) {
+		return []string{fmt.Sprintf("%s: must be of type %s", path, strings.Join(types, " or "))}
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		return []string{fmt.Sprintf("%s: must be one of %v", path, s.Enum)}
+	}
+
+	var problems []string
+	switch v := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			problems = append(problems, fmt.Sprintf("%s: must be at least %d characters", path, *s.MinLength))
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			problems = append(problems, fmt.Sprintf("%s: must be at most %d characters", path, *s.MaxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			problems = append(problems, fmt.Sprintf("%s: must match %s", path, s.Pattern))
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			problems = append(problems, fmt.Sprintf("%s: must be at least %g", path, *s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			problems = append(problems, fmt.Sprintf("%s: must be at most %g", path, *s.Maximum))
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range v {
+				problems = append(problems, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s: is required", path, name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := s.Properties[name]; ok {
+				problems = append(problems, prop.validate(path+"."+name, v[name])...)
+			} else if s.AdditionalProperties == false {
+				problems = append(problems, fmt.Sprintf("%s.%s: is not allowed", path, name))
+			}
+		}
+	}
+	return problems
+}
+
+func (s *jsonSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		types := make([]string, 0, len(t))
+		for _, name := range t {
+			if name, ok := name.(string); ok {
+				types = append(types, name)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func hasJSONType(types []string, v any) bool {
+	for _, t := range types {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || (t == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case []any:
+			if t == "array" {
+				return true
+			}
+		case map[string]any:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func inEnum(enum []any, v any) bool {
+	for _, allowed := range enum {
+		if allowed == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	resp := request(t, "GET", "/api/openapi.json", nil)
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		OpenAPI string         `json:"openapi"`
+		Paths   map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("status %d: %v", resp.StatusCode, err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.1") || doc.Paths["/api/register"] == nil || doc.Paths["/api/login"] == nil {
+		t.Errorf("openapi %q documents %d paths", doc.OpenAPI, len(doc.Paths))
+	}
+}
+
+func TestValidateBodyContentType(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"a","password":"b"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := testApp.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := decode(t, resp, 400)
+	if details, _ := data["details"].([]any); len(details) != 1 || details[0] != "body must be application/json" {
+		t.Errorf("details = %v", data["details"])
+	}
+
+	data = decode(t, request(t, "POST", "/api/login", `{"username": "a",`), 400)
+	if details, _ := data["details"].([]any); len(details) != 1 || details[0] != "body is not valid JSON" {
+		t.Errorf("details = %v", data["details"])
+	}
+}
+
+func TestValidateBodySchema(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		body any
+		want []string
+	}{
+		{"/api/login", fiber.Map{"username": "alice"}, []string{"body.password: is required"}},
+		{"/api/login", fiber.Map{"username": "alice", "password": "x", "admin": true}, []string{"body.admin: is not allowed"}},
+		{"/api/login", fiber.Map{"username": 42, "password": ""}, []string{"body.password: must be at least 1 characters", "body.username: must be of type string"}},
+		{"/api/login", []string{"alice"}, []string{"body: must be of type object"}},
+		{"/api/register", fiber.Map{"username": "alice", "password": strings.Repeat("x", 73)}, []string{"body.password: must be at most 72 characters"}},
+	} {
+		data := decode(t, request(t, "POST", tc.path, tc.body), 400)
+		var details []string
+		for _, d := range data["details"].([]any) {
+			details = append(details, d.(string))
+		}
+		if data["error"] != "Invalid request" || !slices.Equal(details, tc.want) {
+			t.Errorf("%s %v: %v, want %v", tc.path, tc.body, data, tc.want)
+		}
+	}
+
+	// A valid body reaches the handler.
+	resp := request(t, "POST", "/api/login", fiber.Map{"username": newUsername(), "password": "correct horse"})
+	if data := decode(t, resp, 401); data["details"] != nil {
+		t.Errorf("valid body rejected: %v", data)
+	}
+}
+
+func TestSchemaKeywords(t *testing.T) {
+	lo, hi := 1.0, 10.0
+	s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{
+		"count": {Type: "integer", Minimum: &lo, Maximum: &hi},
+		"kind":  {Enum: []any{"terms", "privacy"}},
+		"tags":  {Type: "array", Items: &jsonSchema{Type: "string"}},
+		"note":  {Type: []any{"string", "null"}},
+		"id":    {OneOf: []*jsonSchema{{Type: "string"}, {Type: "integer"}}},
+	}}
+	var v any
+	if err := json.Unmarshal([]byte(`{"count": 11.5, "kind": "cookies", "tags": ["a", 1], "note": null, "id": true}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"body.count: must be of type integer",
+		"body.id: must match exactly one of the allowed schemas",
+		"body.kind: must be one of [terms privacy]",
+		"body.tags[1]: must be of type string",
+	}
+	if got := s.validate("body", v); !slices.Equal(got, want) {
+		t.Errorf("problems = %q, want %q", got, want)
+	}
+	if err := json.Unmarshal([]byte(`{"count": 3, "kind": "terms", "tags": [], "note": "n", "id": 7}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.validate("body", v); len(got) != 0 {
+		t.Errorf("valid value: %q", got)
+	}
+}
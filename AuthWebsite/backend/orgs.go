@@ -0,0 +1,529 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Roles inside an organization, independent of the site-wide users.role.
+const (
+	orgOwner  = "owner"
+	orgAdmin  = "admin"
+	orgMember = "member"
+)
+
+var orgRoles = map[string]bool{orgOwner: true, orgAdmin: true, orgMember: true}
+
+const orgInvitationTTL = 7 * 24 * time.Hour
+
+var orgSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+
+// orgContext is the active organization of a request, set by orgContextMiddleware.
+type orgContext struct {
+	ID   int64  `json:"id"`
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// loadMembership returns the organization and the user's role in it, or sql.ErrNoRows
+// if the user is not a member.
+func loadMembership(orgID int64, username string) (orgContext, error) {
+	var o orgContext
+	err := db.QueryRow(`SELECT o.id, o.slug, o.name, m.role FROM organizations o
+            JOIN org_memberships m ON m.org_id = o.id WHERE o.id = ? AND m.username = ?`, orgID, username).
+		Scan(&o.ID, &o.Slug, &o.Name, &o.Role)
+	return o, err
+}
+
+// orgContextMiddleware runs after authMiddleware and resolves the session's active
+// organization. A membership that was removed since the switch clears it.
+func orgContextMiddleware(c *fiber.Ctx) error {
+	sess := c.Locals("session").(session)
+	if sess.OrgID == 0 {
+		return c.Next()
+	}
+	o, err := loadMembership(sess.OrgID, sess.Username)
+	if err == sql.ErrNoRows {
+		setSessionOrg(c.Locals("token").(string), 0)
+		return c.Next()
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	c.Locals("org", &o)
+	return c.Next()
+}
+
+// currentOrg returns the request's active organization, or nil if none is selected.
+func currentOrg(c *fiber.Ctx) *orgContext {
+	o, _ := c.Locals("org").(*orgContext)
+	return o
+}
+
+// requireOrgRole answers the request itself and returns nil unless an organization
+// is active and the user holds one of allowed in it.
+func requireOrgRole(c *fiber.Ctx, allowed ...string) *orgContext {
+	o := currentOrg(c)
+	if o == nil {
+		c.Status(409).JSON(fiber.Map{"error": "No active organization"})
+		return nil
+	}
+	for _, role := range allowed {
+		if o.Role == role {
+			return o
+		}
+	}
+	c.Status(403).JSON(fiber.Map{"error": "Forbidden"})
+	return nil
+}
+
+func createOrgHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		Slug string `json:"slug"`
+		Name string `json:"name"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	data.Slug = strings.ToLower(strings.TrimSpace(data.Slug))
+	data.Name = strings.TrimSpace(data.Name)
+	if !orgSlugPattern.MatchString(data.Slug) {
+		return c.Status(400).JSON(fiber.Map{"error": "slug must be 2-63 lowercase letters, digits or dashes"})
+	}
+	if data.Name == "" || len(data.Name) > 255 {
+		return c.Status(400).JSON(fiber.Map{"error": "name must be 1-255 characters"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	res, err := tx.Exec("INSERT INTO organizations (slug, name, created_by, created_at) VALUES (?, ?, ?, ?)",
+		data.Slug, data.Name, username, now)
+	if err != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "Organization slug already taken"})
+	}
+	id, err := res.LastInsertId()
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO org_memberships (org_id, username, role, created_at) VALUES (?, ?, ?, ?)",
+			id, username, orgOwner, now)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(username, "org_create", c.IP(), data.Slug)
+	return c.Status(201).JSON(orgContext{ID: id, Slug: data.Slug, Name: data.Name, Role: orgOwner})
+}
+
+func listMemberships(username string) ([]orgContext, error) {
+	rows, err := db.Query(`SELECT o.id, o.slug, o.name, m.role FROM organizations o
+            JOIN org_memberships m ON m.org_id = o.id WHERE m.username = ? ORDER BY o.slug`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orgs := []orgContext{}
+	for rows.Next() {
+		var o orgContext
+		if err := rows.Scan(&o.ID, &o.Slug, &o.Name, &o.Role); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+func listOrgsHandler(c *fiber.Ctx) error {
+	orgs, err := listMemberships(c.Locals("username").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(fiber.Map{"organizations": orgs, "active": currentOrg(c)})
+}
+
+// switchOrgHandler makes an organization the session's active one. An empty slug
+// returns the session to the personal context.
+func switchOrgHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		Slug string `json:"slug"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if data.Slug == "" {
+		setSessionOrg(c.Locals("token").(string), 0)
+		return c.JSON(fiber.Map{"organization": nil})
+	}
+
+	var o orgContext
+	err := db.QueryRow(`SELECT o.id, o.slug, o.name, m.role FROM organizations o
+            JOIN org_memberships m ON m.org_id = o.id WHERE o.slug = ? AND m.username = ?`, data.Slug, username).
+		Scan(&o.ID, &o.Slug, &o.Name, &o.Role)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Organization not found"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	setSessionOrg(c.Locals("token").(string), o.ID)
+	audit(username, "org_switch", c.IP(), o.Slug)
+	return c.JSON(fiber.Map{"organization": o})
+}
+
+type membership struct {
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func listOrgMembersHandler(c *fiber.Ctx) error {
+	o := requireOrgRole(c, orgOwner, orgAdmin, orgMember)
+	if o == nil {
+		return nil
+	}
+	rows, err := db.Query("SELECT username, role, created_at FROM org_memberships WHERE org_id = ? ORDER BY username", o.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer rows.Close()
+	members := []membership{}
+	for rows.Next() {
+		var m membership
+		if err := rows.Scan(&m.Username, &m.Role, &m.CreatedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		}
+		members = append(members, m)
+	}
+	return c.JSON(fiber.Map{"members": members})
+}
+
+// countOwners counts the owners of an organization, for the last-owner checks.
+func countOwners(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, orgID int64) (int, error) {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM org_memberships WHERE org_id = ? AND role = ?", orgID, orgOwner).Scan(&n)
+	return n, err
+}
+
+// updateOrgMemberHandler changes a member's role. Only owners may grant or revoke
+// ownership, and the last owner cannot be demoted.
+func updateOrgMemberHandler(c *fiber.Ctx) error {
+	o := requireOrgRole(c, orgOwner, orgAdmin)
+	if o == nil {
+		return nil
+	}
+	var data struct {
+		Role string `json:"role"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if !orgRoles[data.Role] {
+		return c.Status(400).JSON(fiber.Map{"error": "Unknown role"})
+	}
+	member := resolveUsername(c.Params("username"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer tx.Rollback()
+	var current string
+	err = tx.QueryRow("SELECT role FROM org_memberships WHERE org_id = ? AND username = ? FOR UPDATE", o.ID, member).Scan(&current)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if (current == orgOwner || data.Role == orgOwner) && o.Role != orgOwner {
+		return c.Status(403).JSON(fiber.Map{"error": "Only owners can change ownership"})
+	}
+	if current == orgOwner && data.Role != orgOwner {
+		if n, err := countOwners(tx, o.ID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		} else if n <= 1 {
+			return c.Status(409).JSON(fiber.Map{"error": "An organization needs at least one owner"})
+		}
+	}
+	_, err = tx.Exec("UPDATE org_memberships SET role = ? WHERE org_id = ? AND username = ?", data.Role, o.ID, member)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(c.Locals("username").(string), "org_member_role", c.IP(), o.Slug+" "+member+" "+data.Role)
+	return c.JSON(membership{Username: member, Role: data.Role})
+}
+
+// removeOrgMemberHandler removes a member. Members may remove themselves; removing
+// others takes an org admin, and removing an owner takes an owner.
+func removeOrgMemberHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	member := resolveUsername(c.Params("username"))
+	o := currentOrg(c)
+	if member != username {
+		o = requireOrgRole(c, orgOwner, orgAdmin)
+	} else if o == nil {
+		return c.Status(409).JSON(fiber.Map{"error": "No active organization"})
+	}
+	if o == nil {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer tx.Rollback()
+	var role string
+	err = tx.QueryRow("SELECT role FROM org_memberships WHERE org_id = ? AND username = ? FOR UPDATE", o.ID, member).Scan(&role)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if role == orgOwner {
+		if o.Role != orgOwner {
+			return c.Status(403).JSON(fiber.Map{"error": "Only owners can remove an owner"})
+		}
+		if n, err := countOwners(tx, o.ID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		} else if n <= 1 {
+			return c.Status(409).JSON(fiber.Map{"error": "An organization needs at least one owner"})
+		}
+	}
+	_, err = tx.Exec("DELETE FROM org_memberships WHERE org_id = ? AND username = ?", o.ID, member)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(username, "org_member_remove", c.IP(), o.Slug+" "+member)
+	return c.JSON(fiber.Map{"message": "Member removed"})
+}
+
+type orgInvitation struct {
+	ID              string    `json:"id"`
+	Organization    string    `json:"organization"`
+	InviteeUsername string    `json:"invitee_username,omitempty"`
+	InviteeEmail    string    `json:"invitee_email,omitempty"`
+	Role            string    `json:"role"`
+	InvitedBy       string    `json:"invited_by"`
+	CreatedAt       time.Time `json:"created_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// inviteOrgMemberHandler invites a user to the active organization by username or
+// email. An email invitation is accepted with the code sent to the address, since
+// nothing proves that the email on a profile belongs to its user.
+func inviteOrgMemberHandler(c *fiber.Ctx) error {
+	o := requireOrgRole(c, orgOwner, orgAdmin)
+	if o == nil {
+		return nil
+	}
+	data := struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Role     string `json:"role"`
+	}{Role: orgMember}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	data.Email = strings.TrimSpace(data.Email)
+	if (data.Username == "") == (data.Email == "") {
+		return c.Status(400).JSON(fiber.Map{"error": "Provide either username or email"})
+	}
+	if data.Email != "" && !strings.Contains(data.Email, "@") {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid email"})
+	}
+	if !orgRoles[data.Role] {
+		return c.Status(400).JSON(fiber.Map{"error": "Unknown role"})
+	}
+	if data.Role == orgOwner && o.Role != orgOwner {
+		return c.Status(403).JSON(fiber.Map{"error": "Only owners can invite owners"})
+	}
+	// Invitations hold the stored spelling, which acceptance compares against.
+	if data.Username != "" {
+		data.Username = resolveUsername(data.Username)
+		var exists int
+		err := db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", data.Username).Scan(&exists)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		}
+		if exists == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+		}
+	}
+
+	now := time.Now()
+	inv := orgInvitation{
+		ID:              generateID(),
+		Organization:    o.Slug,
+		InviteeUsername: data.Username,
+		InviteeEmail:    data.Email,
+		Role:            data.Role,
+		InvitedBy:       c.Locals("username").(string),
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(orgInvitationTTL),
+	}
+	var code, codeHash string
+	if inv.InviteeEmail != "" {
+		code = generateToken()
+		codeHash = hashToken(code)
+	}
+	_, err := db.Exec(`INSERT INTO org_invitations (id, org_id, invitee_username, invitee_email, role, invited_by, created_at, expires_at, token_hash)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		inv.ID, o.ID, inv.InviteeUsername, inv.InviteeEmail, inv.Role, inv.InvitedBy, inv.CreatedAt, inv.ExpiresAt, codeHash)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(inv.InvitedBy, "org_invite", c.IP(), o.Slug+" "+data.Username+data.Email)
+	if code != "" {
+		notify(Notification{
+			Username: inv.InviteeEmail,
+			To:       inv.InviteeEmail,
+			Subject:  "Invitation to join " + o.Slug,
+			Body: fmt.Sprintf("%s invited you to join the organization %s as %s.\n\n"+
+				"Sign in, or create an account, and accept the invitation with this code before %s:\n\n"+
+				"Invitation: %s\nCode: %s\n",
+				inv.InvitedBy, o.Slug, inv.Role, inv.ExpiresAt.UTC().Format(time.RFC1123), inv.ID, code),
+			Secrets: []string{code},
+		})
+	}
+	return c.Status(201).JSON(inv)
+}
+
+// pendingOrgInvitations returns the unexpired invitations addressed to username.
+// Email invitations are not listed; they are accepted with their code.
+func pendingOrgInvitations(username string) ([]orgInvitation, error) {
+	rows, err := db.Query(`SELECT i.id, o.slug, i.invitee_username, i.invitee_email, i.role, i.invited_by, i.created_at, i.expires_at
+            FROM org_invitations i JOIN organizations o ON o.id = i.org_id
+            WHERE i.expires_at > ? AND i.invitee_username = ?
+            ORDER BY i.created_at`, time.Now(), username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invitations := []orgInvitation{}
+	for rows.Next() {
+		var inv orgInvitation
+		if err := rows.Scan(&inv.ID, &inv.Organization, &inv.InviteeUsername, &inv.InviteeEmail, &inv.Role,
+			&inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+func listOrgInvitationsHandler(c *fiber.Ctx) error {
+	invitations, err := pendingOrgInvitations(c.Locals("username").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(fiber.Map{"invitations": invitations})
+}
+
+// acceptOrgInvitationHandler turns a pending invitation into a membership: one
+// addressed to the caller's username, or an email invitation whose code the caller
+// gives. An existing membership keeps its role.
+func acceptOrgInvitationHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		Code string `json:"code"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&data); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+
+	var inv orgInvitation
+	var codeHash string
+	err := db.QueryRow(`SELECT i.id, o.slug, i.invitee_username, i.invitee_email, i.role, i.token_hash
+            FROM org_invitations i JOIN organizations o ON o.id = i.org_id
+            WHERE i.id = ? AND i.expires_at > ?`, c.Params("id"), time.Now()).
+		Scan(&inv.ID, &inv.Organization, &inv.InviteeUsername, &inv.InviteeEmail, &inv.Role, &codeHash)
+	if err != nil && err != sql.ErrNoRows {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	byName := inv.InviteeUsername != "" && inv.InviteeUsername == username
+	byCode := codeHash != "" && subtle.ConstantTimeCompare([]byte(codeHash), []byte(hashToken(data.Code))) == 1
+	if err == sql.ErrNoRows || !(byName || byCode) {
+		return c.Status(404).JSON(fiber.Map{"error": "Invitation not found"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer tx.Rollback()
+	var orgID int64
+	err = tx.QueryRow("SELECT org_id FROM org_invitations WHERE id = ?", inv.ID).Scan(&orgID)
+	if err == nil {
+		// The delete claims the invitation, so a concurrent accept cannot use it twice.
+		var res sql.Result
+		if res, err = tx.Exec("DELETE FROM org_invitations WHERE id = ?", inv.ID); err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				err = sql.ErrNoRows
+			}
+		}
+	}
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Invitation not found"})
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT IGNORE INTO org_memberships (org_id, username, role, created_at) VALUES (?, ?, ?, ?)",
+			orgID, username, inv.Role, time.Now())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(username, "org_join", c.IP(), inv.Organization)
+	return c.JSON(fiber.Map{"message": "Invitation accepted", "organization": inv.Organization})
+}
+
+// soleOwnerOrgs lists organizations that would be left without an owner if username left.
+func soleOwnerOrgs(username string) ([]string, error) {
+	rows, err := db.Query(`SELECT o.slug FROM organizations o JOIN org_memberships m ON m.org_id = o.id
+            WHERE m.username = ? AND m.role = ? AND o.id IN (SELECT org_id FROM org_memberships
+                WHERE role = ? GROUP BY org_id HAVING COUNT(*) = 1)
+            AND o.id IN (SELECT org_id FROM org_memberships GROUP BY org_id HAVING COUNT(*) > 1)`,
+		username, orgOwner, orgOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	slugs := []string{}
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	return slugs, rows.Err()
+}
+
+// exportMemberships lists organization memberships for the personal-data export.
+func exportMemberships(username string) (any, error) {
+	return listMemberships(username)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newOrg has a new user create an organization and returns the owner's session.
+func newOrg(t *testing.T) (slug string, owner *http.Cookie) {
+	t.Helper()
+	username := newUsername()
+	register(t, username, "correct horse")
+	owner = login(t, username, "correct horse")
+	slug = "org-" + username
+	decode(t, request(t, "POST", "/api/orgs", fiber.Map{"slug": slug, "name": "Org " + username}, owner), 201)
+	decode(t, request(t, "POST", "/api/orgs/switch", fiber.Map{"slug": slug}, owner), 200)
+	return slug, owner
+}
+
+func TestOrgInvitationByUsername(t *testing.T) {
+	_, owner := newOrg(t)
+	invitee, other := newUsername(), newUsername()
+	register(t, invitee, "correct horse")
+	register(t, other, "correct horse")
+
+	inv := decode(t, request(t, "POST", "/api/orgs/current/invitations", fiber.Map{"username": invitee}, owner), 201)
+	id := inv["id"].(string)
+
+	decode(t, request(t, "POST", "/api/orgs/invitations/"+id+"/accept", nil, login(t, other, "correct horse")), 404)
+	cookie := login(t, invitee, "correct horse")
+	listed := decode(t, request(t, "GET", "/api/orgs/invitations", nil, cookie), 200)["invitations"].([]any)
+	if len(listed) != 1 || listed[0].(map[string]any)["id"] != id {
+		t.Errorf("invitations = %v", listed)
+	}
+	decode(t, request(t, "POST", "/api/orgs/invitations/"+id+"/accept", nil, cookie), 200)
+	decode(t, request(t, "POST", "/api/orgs/invitations/"+id+"/accept", nil, cookie), 404)
+}
+
+func TestOrgInvitationByEmail(t *testing.T) {
+	notes := useRecordingNotifier(t)
+	slug, owner := newOrg(t)
+	email := newUsername() + "@example.com"
+
+	inv := decode(t, request(t, "POST", "/api/orgs/current/invitations", fiber.Map{"email": email}, owner), 201)
+	id := inv["id"].(string)
+	note := notes.waitFor(t, email)
+	code := regexp.MustCompile(`Code: (\S+)`).FindStringSubmatch(note.Body)
+	if code == nil {
+		t.Fatalf("invitation email without a code: %q", note.Body)
+	}
+
+	// Claiming the address on a profile is not enough.
+	squatter := newUsername()
+	register(t, squatter, "correct horse")
+	squatterCookie := login(t, squatter, "correct horse")
+	decode(t, request(t, "PATCH", "/api/profile", fiber.Map{"email": email}, squatterCookie), 200)
+	if listed := decode(t, request(t, "GET", "/api/orgs/invitations", nil, squatterCookie), 200)["invitations"].([]any); len(listed) != 0 {
+		t.Errorf("email invitation listed for a profile with that email: %v", listed)
+	}
+	decode(t, request(t, "POST", "/api/orgs/invitations/"+id+"/accept", nil, squatterCookie), 404)
+	decode(t, request(t, "POST", "/api/orgs/invitations/"+id+"/accept", fiber.Map{"code": generateToken()}, squatterCookie), 404)
+
+	// Whoever received the code joins, once.
+	invitee := newUsername()
+	register(t, invitee, "correct horse")
+	cookie := login(t, invitee, "correct horse")
+	data := decode(t, request(t, "POST", "/api/orgs/invitations/"+id+"/accept", fiber.Map{"code": code[1]}, cookie), 200)
+	if data["organization"] != slug {
+		t.Errorf("joined %v, want %s", data["organization"], slug)
+	}
+	decode(t, request(t, "POST", "/api/orgs/invitations/"+id+"/accept", fiber.Map{"code": code[1]}, squatterCookie), 404)
+}
+
+func TestOrgMembersMatchedByCanonicalName(t *testing.T) {
+	_, owner := newOrg(t)
+	invitee := "Mixed" + newUsername()
+	register(t, invitee, "correct horse")
+
+	inv := decode(t, request(t, "POST", "/api/orgs/current/invitations", fiber.Map{"username": strings.ToLower(invitee)}, owner), 201)
+	if inv["invitee_username"] != invitee {
+		t.Errorf("invitee = %v, want %s", inv["invitee_username"], invitee)
+	}
+	decode(t, request(t, "POST", "/api/orgs/invitations/"+inv["id"].(string)+"/accept", nil, login(t, invitee, "correct horse")), 200)
+
+	path := "/api/orgs/current/members/" + strings.ToUpper(invitee)
+	decode(t, request(t, "PATCH", path, fiber.Map{"role": orgAdmin}, owner), 200)
+	decode(t, request(t, "DELETE", path, nil, owner), 200)
+}
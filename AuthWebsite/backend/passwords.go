@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Local passwords may not repeat any of the account's last AUTH_PASSWORD_HISTORY
+// passwords, and those of the roles in AUTH_PASSWORD_EXPIRING_ROLES expire after
+// AUTH_PASSWORD_MAX_AGE. An expired password only lets the user change it.
+
+const changePasswordPath = "/api/account/password"
+
+var errNotLocalAccount = errors.New("password is managed by another sign-in method")
+
+type passwordPolicyConfig struct {
+	History       int           // passwords that may not be reused, including the current one; 0 disables
+	MaxAge        time.Duration // 0 disables expiry
+	ExpiringRoles map[string]bool
+}
+
+var passwordPolicy passwordPolicyConfig
+
+func loadPasswordPolicy() error {
+	var err error
+	if passwordPolicy.History, err = strconv.Atoi(envOr("AUTH_PASSWORD_HISTORY", "5")); err != nil || passwordPolicy.History < 0 {
+		return fmt.Errorf("AUTH_PASSWORD_HISTORY must be a non-negative integer")
+	}
+	if passwordPolicy.MaxAge, err = time.ParseDuration(envOr("AUTH_PASSWORD_MAX_AGE", "2160h")); err != nil {
+		return fmt.Errorf("AUTH_PASSWORD_MAX_AGE: %w", err)
+	}
+	passwordPolicy.ExpiringRoles = map[string]bool{}
+	for _, role := range strings.Split(envOr("AUTH_PASSWORD_EXPIRING_ROLES", "admin"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			passwordPolicy.ExpiringRoles[role] = true
+		}
+	}
+	return nil
+}
+
+// passwordReused reports whether password matches the current password of username
+// or one of the previous ones covered by the history policy.
+func passwordReused(username, password string) (bool, error) {
+	if passwordPolicy.History == 0 {
+		return false, nil
+	}
+	rows, err := db.Query(`(SELECT password_hash FROM users WHERE username = ?)
+            UNION ALL
+            (SELECT password_hash FROM password_history WHERE username = ? ORDER BY id DESC LIMIT ?)`,
+		username, username, passwordPolicy.History-1)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return false, err
+		}
+		if comparePassword(hash, password) == nil {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// storePassword replaces the password hash of a local account and moves the old
+// hash into the history. It also lifts a pending reset requirement.
+func storePassword(username string, hash []byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var old, source string
+	err = tx.QueryRow("SELECT password_hash, auth_source FROM users WHERE username = ? FOR UPDATE", username).Scan(&old, &source)
+	if err != nil {
+		return err
+	}
+	if source != "local" {
+		return errNotLocalAccount
+	}
+
+	now := time.Now()
+	if passwordPolicy.History > 1 && old != "" && old != "!" {
+		_, err = tx.Exec("INSERT INTO password_history (username, password_hash, created_at) VALUES (?, ?, ?)", username, old, now)
+		if err == nil {
+			// MySQL does not allow LIMIT in an IN subquery unless it is wrapped in a derived table.
+			_, err = tx.Exec(`DELETE FROM password_history WHERE username = ? AND id NOT IN (
+                    SELECT id FROM (SELECT id FROM password_history WHERE username = ? ORDER BY id DESC LIMIT ?) AS recent)`,
+				username, username, passwordPolicy.History-1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE users SET password_hash = ?, password_changed_at = ?, password_reset_required = 0 WHERE username = ?",
+		string(hash), now, username)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// passwordExpired reports whether username holds an expiring role and has not
+// changed the password within the maximum age.
+func passwordExpired(username string) (bool, error) {
+	if passwordPolicy.MaxAge == 0 || len(passwordPolicy.ExpiringRoles) == 0 {
+		return false, nil
+	}
+	var role, source string
+	var changedAt time.Time
+	err := db.QueryRow("SELECT role, auth_source, password_changed_at FROM users WHERE username = ?", username).
+		Scan(&role, &source, &changedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return source == "local" && passwordPolicy.ExpiringRoles[role] && time.Since(changedAt) > passwordPolicy.MaxAge, nil
+}
+
+// allowedWithExpiredPassword lists the requests a user with an expired password
+// may still make: changing it, confirming the session for that, and signing out.
+func allowedWithExpiredPassword(c *fiber.Ctx) bool {
+	return c.Method() == fiber.MethodPost && (c.Path() == changePasswordPath || c.Path() == stepUpPath || c.Path() == "/api/logout")
+}
+
+// changePasswordHandler sets a new password after checking the current one and the
+// history. Other sessions and all refresh tokens are signed out.
+func changePasswordHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.NewPassword == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	var hash, source string
+	if err := db.QueryRow("SELECT password_hash, auth_source FROM users WHERE username = ?", username).Scan(&hash, &source); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if source != "local" {
+		return c.Status(403).JSON(fiber.Map{"error": "Password is managed by your directory"})
+	}
+	if comparePassword(hash, data.CurrentPassword) != nil {
+		audit(username, "password_change_failure", c.IP(), "bad current password")
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+	reused, err := passwordReused(username, data.NewPassword)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if reused {
+		return c.Status(400).JSON(fiber.Map{"error": "Password was used recently"})
+	}
+
+	newHash, err := hashPassword(data.NewPassword)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to hash password"})
+	}
+	if err := storePassword(username, newHash); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if err := revokeOtherLogins(username, c.Locals("token").(string), "password_change"); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(username, "password_change", c.IP(), "")
+	emitEvent(eventUserPasswordChanged, fiber.Map{"username": username})
+	return c.JSON(fiber.Map{"message": "Password changed"})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// usePasswordPolicy replaces the password policy for one test.
+func usePasswordPolicy(t *testing.T, policy passwordPolicyConfig) {
+	t.Helper()
+	saved := passwordPolicy
+	passwordPolicy = policy
+	t.Cleanup(func() { passwordPolicy = saved })
+}
+
+func changePassword(t *testing.T, cookie *http.Cookie, current, next string, status int) map[string]any {
+	t.Helper()
+	return decode(t, request(t, "POST", "/api/account/password", fiber.Map{"current_password": current, "new_password": next}, cookie), status)
+}
+
+func TestChangePassword(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+	other := login(t, username, "correct horse")
+
+	changePassword(t, cookie, "wrong horse", "battery staple", 401)
+	changePassword(t, cookie, "correct horse", "battery staple", 200)
+
+	// The session that changed the password stays, every other one is signed out.
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	decode(t, request(t, "GET", "/api/profile", nil, other), 401)
+	decode(t, request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "correct horse"}), 401)
+	login(t, username, "battery staple")
+}
+
+func TestPasswordHistory(t *testing.T) {
+	usePasswordPolicy(t, passwordPolicyConfig{History: 3})
+	username := newUsername()
+	register(t, username, "password 0")
+	cookie := login(t, username, "password 0")
+
+	changePassword(t, cookie, "password 0", "password 0", 400)
+	changePassword(t, cookie, "password 0", "password 1", 200)
+	if data := changePassword(t, cookie, "password 1", "password 0", 400); data["error"] != "Password was used recently" {
+		t.Errorf("reuse: %v", data)
+	}
+	changePassword(t, cookie, "password 1", "password 2", 200)
+	changePassword(t, cookie, "password 2", "password 0", 400)
+	changePassword(t, cookie, "password 2", "password 3", 200)
+
+	// The current password and the two before it are remembered; older ones are dropped.
+	var kept int
+	if err := db.QueryRow("SELECT COUNT(*) FROM password_history WHERE username = ?", username).Scan(&kept); err != nil || kept != 2 {
+		t.Errorf("%d history rows (%v), want 2", kept, err)
+	}
+	changePassword(t, cookie, "password 3", "password 1", 400)
+	changePassword(t, cookie, "password 3", "password 0", 200)
+}
+
+func TestExpiredPassword(t *testing.T) {
+	usePasswordPolicy(t, passwordPolicyConfig{MaxAge: time.Hour, ExpiringRoles: map[string]bool{"admin": true}})
+	username, member := newUsername(), newUsername()
+	register(t, username, "correct horse")
+	register(t, member, "correct horse")
+	if _, err := db.Exec("UPDATE users SET role = 'admin' WHERE username = ?", username); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE users SET password_changed_at = ? WHERE username IN (?, ?)", time.Now().Add(-2*time.Hour), username, member); err != nil {
+		t.Fatal(err)
+	}
+
+	// Roles outside the policy are not affected.
+	decode(t, request(t, "GET", "/api/profile", nil, login(t, member, "correct horse")), 200)
+
+	cookie := login(t, username, "correct horse")
+	if data := decode(t, request(t, "GET", "/api/profile", nil, cookie), 403); data["error"] != "Password expired" {
+		t.Errorf("profile with an expired password: %v", data)
+	}
+	decode(t, request(t, "GET", "/api/admin/invitations", nil, cookie), 403)
+	changePassword(t, cookie, "correct horse", "battery staple", 200)
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	decode(t, request(t, "GET", "/api/admin/invitations", nil, cookie), 200)
+}
+
+func TestChangePasswordDirectoryAccount(t *testing.T) {
+	dir := newFakeDirectory()
+	ldapUser := newUsername()
+	dir.addUser(ldapUser, "directory password", map[string][]string{})
+	saved := authChain
+	authChain = []Authenticator{dir.authenticator(t), localAuthenticator{}}
+	t.Cleanup(func() { authChain = saved })
+
+	cookie := login(t, ldapUser, "directory password")
+	if data := changePassword(t, cookie, "directory password", "battery staple", 403); data["error"] != "Password is managed by your directory" {
+		t.Errorf("directory account: %v", data)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Registration requires a proof of work: the client must find a nonce such that
+// SHA-256(challenge + ":" + nonce) starts with the challenge's number of zero bits.
+// Challenges are HMAC-signed, so the server keeps no state until one is spent.
+
+const (
+	powChallengeTTL = 10 * time.Minute
+	powRateWindow   = 10 * time.Minute
+	// powMaxDifficulty keeps the worst case to seconds of hashing in a browser on a
+	// phone; past that the proof only locks out legitimate users.
+	powMaxDifficulty = 24
+	powMaxTracked    = 1 << 16 // enough registrations to reach powMaxDifficulty at any sane rate
+)
+
+var errInvalidProof = errors.New("invalid proof of work")
+
+type powConfig struct {
+	Secret     []byte
+	Difficulty int // base number of leading zero bits, 0 disables the check
+	Rate       int // successful registrations per window before difficulty rises
+}
+
+var pow powConfig
+
+func loadPowConfig() error {
+	var err error
+	if pow.Difficulty, err = strconv.Atoi(envOr("AUTH_POW_DIFFICULTY", "16")); err != nil {
+		return fmt.Errorf("AUTH_POW_DIFFICULTY: %w", err)
+	}
+	if pow.Difficulty < 0 || pow.Difficulty > powMaxDifficulty {
+		return fmt.Errorf("AUTH_POW_DIFFICULTY must be between 0 and %d", powMaxDifficulty)
+	}
+	if pow.Rate, err = strconv.Atoi(envOr("AUTH_POW_RATE", "20")); err != nil || pow.Rate < 1 {
+		return fmt.Errorf("AUTH_POW_RATE must be a positive integer")
+	}
+	// A per-process secret only invalidates outstanding challenges on restart.
+	pow.Secret = []byte(envOr("AUTH_POW_SECRET", ""))
+	if len(pow.Secret) == 0 {
+		pow.Secret = randomBytes(32)
+	}
+	return nil
+}
+
+var (
+	powRegistrations []time.Time              // successful registrations within powRateWindow
+	powSpent         = map[string]time.Time{} // challenge → expiry, for replay protection
+	powMu            sync.Mutex
+)
+
+// powDifficulty adds one bit to the base difficulty for every doubling of the
+// registration rate above pow.Rate. Only registrations that went through count, so
+// a flood of rejected requests cannot raise the bar for everyone else.
+func powDifficulty() int {
+	powMu.Lock()
+	defer powMu.Unlock()
+	cutoff := time.Now().Add(-powRateWindow)
+	for len(powRegistrations) > 0 && powRegistrations[0].Before(cutoff) {
+		powRegistrations = powRegistrations[1:]
+	}
+	difficulty := pow.Difficulty
+	for n := len(powRegistrations); n > pow.Rate; n /= 2 {
+		difficulty++
+	}
+	return min(difficulty, powMaxDifficulty)
+}
+
+func recordRegistration() {
+	powMu.Lock()
+	defer powMu.Unlock()
+	if len(powRegistrations) >= powMaxTracked {
+		powRegistrations = powRegistrations[1:]
+	}
+	powRegistrations = append(powRegistrations, time.Now())
+}
+
+func signChallenge(payload string) string {
+	mac := hmac.New(sha256.New, pow.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// powChallengeHandler issues a challenge of the form "<random>.<difficulty>.<expiry>.<signature>".
+func powChallengeHandler(c *fiber.Ctx) error {
+	if pow.Difficulty == 0 {
+		return c.JSON(fiber.Map{"required": false})
+	}
+	difficulty := powDifficulty()
+	expires := time.Now().Add(powChallengeTTL)
+	payload := base64.RawURLEncoding.EncodeToString(randomBytes(16)) + "." +
+		strconv.Itoa(difficulty) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return c.JSON(fiber.Map{
+		"required":   true,
+		"algorithm":  "SHA-256",
+		"challenge":  payload + "." + signChallenge(payload),
+		"difficulty": difficulty,
+		"expires_at": expires,
+	})
+}
+
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// verifyProof checks the signature, expiry and work of a solved challenge and spends it.
+func verifyProof(challenge, nonce string) error {
+	if pow.Difficulty == 0 {
+		return nil
+	}
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 || len(nonce) > 64 {
+		return errInvalidProof
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(signChallenge(payload))) {
+		return errInvalidProof
+	}
+	difficulty, err1 := strconv.Atoi(parts[1])
+	expiry, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || time.Now().Unix() > expiry {
+		return errInvalidProof
+	}
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return errInvalidProof
+	}
+
+	powMu.Lock()
+	defer powMu.Unlock()
+	if _, replayed := powSpent[challenge]; replayed {
+		return errInvalidProof
+	}
+	powSpent[challenge] = time.Unix(expiry, 0)
+	return nil
+}
+
+// expireSpentProofs forgets spent challenges once they could no longer be replayed.
+func expireSpentProofs(now time.Time) {
+	powMu.Lock()
+	defer powMu.Unlock()
+	for challenge, expiry := range powSpent {
+		if now.After(expiry) {
+			delete(powSpent, challenge)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// usePow turns the proof of work on for the rest of the test.
+func usePow(t *testing.T, difficulty, rate int) {
+	saved, savedRegistrations := pow, powRegistrations
+	pow.Difficulty, pow.Rate, powRegistrations = difficulty, rate, nil
+	t.Cleanup(func() { pow, powRegistrations = saved, savedRegistrations })
+}
+
+// solve fetches a challenge and finds a nonce for it.
+func solve(t *testing.T) (challenge, nonce string, difficulty int) {
+	t.Helper()
+	got := decode(t, request(t, "GET", "/api/register/challenge", nil), 200)
+	challenge, difficulty = got["challenge"].(string), int(got["difficulty"].(float64))
+	for i := 0; ; i++ {
+		nonce = strconv.Itoa(i)
+		if sum := sha256.Sum256([]byte(challenge + ":" + nonce)); leadingZeroBits(sum[:]) >= difficulty {
+			return challenge, nonce, difficulty
+		}
+	}
+}
+
+func TestPowRegistration(t *testing.T) {
+	usePow(t, 2, 1)
+
+	// Rejected requests do not make the next challenge harder.
+	for range 4 {
+		decode(t, request(t, "POST", "/api/register", fiber.Map{"username": newUsername(), "password": "correct horse"}), 400)
+	}
+	if d := powDifficulty(); d != 2 {
+		t.Fatalf("difficulty after rejected registrations = %d", d)
+	}
+
+	for range 2 {
+		challenge, nonce, _ := solve(t)
+		body := fiber.Map{"username": newUsername(), "password": "correct horse", "pow_challenge": challenge, "pow_nonce": nonce}
+		decode(t, request(t, "POST", "/api/register", body), 200)
+		body["username"] = newUsername()
+		decode(t, request(t, "POST", "/api/register", body), 400)
+	}
+	if _, _, d := solve(t); d != 3 {
+		t.Errorf("difficulty after two registrations = %d, want 3", d)
+	}
+}
+
+func TestExpireSpentProofs(t *testing.T) {
+	usePow(t, 1, 1)
+	challenge, nonce, _ := solve(t)
+	if err := verifyProof(challenge, nonce); err != nil {
+		t.Fatal(err)
+	}
+	expireSpentProofs(time.Now())
+	if err := verifyProof(challenge, nonce); err != errInvalidProof {
+		t.Errorf("replay before expiry: %v", err)
+	}
+	expireSpentProofs(time.Now().Add(powChallengeTTL + time.Second))
+	powMu.Lock()
+	_, kept := powSpent[challenge]
+	powMu.Unlock()
+	if kept {
+		t.Error("expired challenge still tracked")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import "database/sql"
+
+// schema is applied in order at startup; every statement must be idempotent.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+            id INT AUTO_INCREMENT PRIMARY KEY,
+            username VARCHAR(255) UNIQUE NOT NULL,
+            password_hash VARCHAR(255) NOT NULL
+        )`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+            token VARCHAR(64) PRIMARY KEY,
+            username VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL,
+            expires_at DATETIME NOT NULL
+        )`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            created_at DATETIME NOT NULL,
+            username VARCHAR(255) NOT NULL,
+            action VARCHAR(64) NOT NULL,
+            ip VARCHAR(64) NOT NULL,
+            detail TEXT,
+            INDEX idx_audit_username (username)
+        )`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            endpoint VARCHAR(2048) NOT NULL,
+            event VARCHAR(64) NOT NULL,
+            payload TEXT NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            attempts INT NOT NULL DEFAULT 0,
+            last_error TEXT,
+            created_at DATETIME NOT NULL,
+            next_attempt_at DATETIME NOT NULL,
+            delivered_at DATETIME NULL,
+            INDEX idx_webhook_due (status, next_attempt_at)
+        )`,
+	`CREATE TABLE IF NOT EXISTS settings (
+            name VARCHAR(64) PRIMARY KEY,
+            value TEXT NOT NULL
+        )`,
+	`CREATE TABLE IF NOT EXISTS invitations (
+            code VARCHAR(64) PRIMARY KEY,
+            role VARCHAR(32) NOT NULL,
+            max_uses INT NOT NULL,
+            uses INT NOT NULL DEFAULT 0,
+            expires_at DATETIME NOT NULL,
+            created_by VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL
+        )`,
+	`CREATE TABLE IF NOT EXISTS data_exports (
+            id VARCHAR(64) PRIMARY KEY,
+            username VARCHAR(255) NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            error TEXT,
+            archive LONGBLOB,
+            created_at DATETIME NOT NULL,
+            expires_at DATETIME NOT NULL,
+            INDEX idx_exports_username (username)
+        )`,
+	`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+            credential_id VARBINARY(1023) PRIMARY KEY,
+            username VARCHAR(255) NOT NULL,
+            name VARCHAR(255) NOT NULL,
+            public_key BLOB NOT NULL,
+            sign_count BIGINT NOT NULL,
+            format VARCHAR(32) NOT NULL,
+            created_at DATETIME NOT NULL,
+            last_used_at DATETIME NULL,
+            INDEX idx_webauthn_username (username)
+        )`,
+	`CREATE TABLE IF NOT EXISTS user_identities (
+            provider VARCHAR(64) NOT NULL,
+            subject VARCHAR(255) NOT NULL,
+            username VARCHAR(255) NOT NULL,
+            email VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL,
+            PRIMARY KEY (provider, subject),
+            INDEX idx_identities_username (username)
+        )`,
+	`CREATE TABLE IF NOT EXISTS refresh_token_families (
+            id VARCHAR(64) PRIMARY KEY,
+            username VARCHAR(255) NOT NULL,
+            client VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL,
+            expires_at DATETIME NOT NULL,
+            revoked_at DATETIME NULL,
+            revoked_reason VARCHAR(64) NULL,
+            INDEX idx_families_username (username)
+        )`,
+	`CREATE TABLE IF NOT EXISTS refresh_tokens (
+            token_hash CHAR(64) PRIMARY KEY,
+            family_id VARCHAR(64) NOT NULL,
+            created_at DATETIME NOT NULL,
+            used_at DATETIME NULL,
+            INDEX idx_refresh_family (family_id)
+        )`,
+	`CREATE TABLE IF NOT EXISTS organizations (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            slug VARCHAR(64) UNIQUE NOT NULL,
+            name VARCHAR(255) NOT NULL,
+            created_by VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL
+        )`,
+	`CREATE TABLE IF NOT EXISTS org_memberships (
+            org_id BIGINT NOT NULL,
+            username VARCHAR(255) NOT NULL,
+            role VARCHAR(16) NOT NULL,
+            created_at DATETIME NOT NULL,
+            PRIMARY KEY (org_id, username),
+            INDEX idx_memberships_username (username)
+        )`,
+	`CREATE TABLE IF NOT EXISTS org_invitations (
+            id VARCHAR(64) PRIMARY KEY,
+            org_id BIGINT NOT NULL,
+            invitee_username VARCHAR(255) NOT NULL,
+            invitee_email VARCHAR(255) NOT NULL,
+            role VARCHAR(16) NOT NULL,
+            invited_by VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL,
+            expires_at DATETIME NOT NULL,
+            INDEX idx_org_invitations_org (org_id)
+        )`,
+	`CREATE TABLE IF NOT EXISTS scim_groups (
+            id VARCHAR(64) PRIMARY KEY,
+            display_name VARCHAR(255) UNIQUE NOT NULL,
+            external_id VARCHAR(255) NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL
+        )`,
+	`CREATE TABLE IF NOT EXISTS scim_group_members (
+            group_id VARCHAR(64) NOT NULL,
+            username VARCHAR(255) NOT NULL,
+            PRIMARY KEY (group_id, username),
+            INDEX idx_scim_members_username (username)
+        )`,
+	`CREATE TABLE IF NOT EXISTS known_devices (
+            username VARCHAR(255) NOT NULL,
+            fingerprint CHAR(64) NOT NULL,
+            ip_prefix VARCHAR(64) NOT NULL,
+            user_agent VARCHAR(512) NOT NULL,
+            first_seen DATETIME NOT NULL,
+            last_seen DATETIME NOT NULL,
+            PRIMARY KEY (username, fingerprint)
+        )`,
+	`CREATE TABLE IF NOT EXISTS device_alerts (
+            token_hash CHAR(64) PRIMARY KEY,
+            username VARCHAR(255) NOT NULL,
+            fingerprint CHAR(64) NOT NULL,
+            created_at DATETIME NOT NULL,
+            expires_at DATETIME NOT NULL,
+            INDEX idx_device_alerts_username (username)
+        )`,
+	`CREATE TABLE IF NOT EXISTS password_history (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            username VARCHAR(255) NOT NULL,
+            password_hash VARCHAR(255) NOT NULL,
+            created_at DATETIME NOT NULL,
+            INDEX idx_password_history_username (username)
+        )`,
+	`CREATE TABLE IF NOT EXISTS policy_documents (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            kind VARCHAR(32) NOT NULL,
+            version VARCHAR(32) NOT NULL,
+            title VARCHAR(255) NOT NULL,
+            body MEDIUMTEXT NOT NULL,
+            published_at DATETIME NOT NULL,
+            created_by VARCHAR(255) NOT NULL,
+            UNIQUE KEY uq_policy_version (kind, version),
+            INDEX idx_policy_published (kind, published_at)
+        )`,
+	`CREATE TABLE IF NOT EXISTS policy_acceptances (
+            username VARCHAR(255) NOT NULL,
+            kind VARCHAR(32) NOT NULL,
+            version VARCHAR(32) NOT NULL,
+            accepted_at DATETIME NOT NULL,
+            ip VARCHAR(64) NOT NULL,
+            PRIMARY KEY (username, kind, version)
+        )`,
+}
+
+// columns added to tables that already existed before the column was introduced.
+var columns = []struct{ table, column, definition string }{
+	{"users", "role", "VARCHAR(32) NOT NULL DEFAULT 'user'"},
+	{"users", "display_name", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"users", "email", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"users", "avatar_url", "VARCHAR(2048) NOT NULL DEFAULT ''"},
+	{"users", "locale", "VARCHAR(35) NOT NULL DEFAULT ''"},
+	{"users", "timezone", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"users", "auth_source", "VARCHAR(32) NOT NULL DEFAULT 'local'"},
+	{"users", "active", "TINYINT(1) NOT NULL DEFAULT 1"},
+	{"users", "external_id", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"users", "password_reset_required", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"users", "password_changed_at", "DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP"},
+	{"users", "username_canonical", "VARCHAR(255) NULL"},
+	{"users", "username_skeleton", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"users", "email_verified", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"sessions", "family_id", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"sessions", "org_id", "BIGINT NOT NULL DEFAULT 0"},
+	{"sessions", "impersonator", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"sessions", "client_ip", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"sessions", "client_family", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"sessions", "step_up", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"org_invitations", "token_hash", "CHAR(64) NOT NULL DEFAULT ''"},
+	{"device_alerts", "reported_at", "DATETIME NULL"},
+	// pending_for is the username while an export is being prepared, and NULL after.
+	{"data_exports", "pending_for", "VARCHAR(255) NULL"},
+}
+
+func migrate(db *sql.DB) error {
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	for _, col := range columns {
+		if err := ensureColumn(db, col.table, col.column, col.definition); err != nil {
+			return err
+		}
+	}
+	for _, idx := range indexes {
+		if err := ensureIndex(db, idx.table, idx.name, idx.definition); err != nil {
+			return err
+		}
+	}
+	return backfillUsernameKeys(db)
+}
+
+// indexes on columns from the columns list, which CREATE TABLE cannot declare.
+var indexes = []struct{ table, name, definition string }{
+	{"users", "uq_users_username_canonical", "UNIQUE INDEX uq_users_username_canonical (username_canonical)"},
+	{"users", "idx_users_username_skeleton", "INDEX idx_users_username_skeleton (username_skeleton)"},
+	{"data_exports", "uq_exports_pending", "UNIQUE INDEX uq_exports_pending (pending_for)"},
+}
+
+// ensureColumn adds a column unless it is already present; MySQL has no ADD COLUMN IF NOT EXISTS.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS
+            WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// ensureIndex adds an index unless one with that name exists.
+func ensureIndex(db *sql.DB, table, name, definition string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.STATISTICS
+            WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`, table, name).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD " + definition)
+	return err
+}
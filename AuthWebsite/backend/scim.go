@@ -0,0 +1,949 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SCIM 2.0 (RFC 7643/7644) provisioning for HR systems. Users map onto the users
+// table and groups onto scim_groups. The endpoints are mounted only when
+// AUTH_SCIM_TOKEN is set, and every request must present it as a bearer token.
+
+const (
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema  = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema  = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimContentType  = "application/scim+json"
+	scimMaxPageCount = 200
+)
+
+// scimError carries the status and scimType of an RFC 7644 error response.
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimError) Error() string { return e.detail }
+
+func scimInvalid(scimType, format string, args ...any) *scimError {
+	return &scimError{400, scimType, fmt.Sprintf(format, args...)}
+}
+
+func scimFail(c *fiber.Ctx, err error) error {
+	e, ok := err.(*scimError)
+	if !ok {
+		e = &scimError{500, "", "DB error"}
+	}
+	body := fiber.Map{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(e.status), "detail": e.detail}
+	if e.scimType != "" {
+		body["scimType"] = e.scimType
+	}
+	return c.Status(e.status).JSON(body, scimContentType)
+}
+
+func scimReply(c *fiber.Ctx, status int, v any) error {
+	return c.Status(status).JSON(v, scimContentType)
+}
+
+func scimRoutes(app *fiber.App) {
+	token := envOr("AUTH_SCIM_TOKEN", "")
+	if token == "" {
+		return
+	}
+	scim := app.Group("/scim/v2", func(c *fiber.Ctx) error {
+		expected := []byte("Bearer " + token)
+		if subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), expected) != 1 {
+			return scimFail(c, &scimError{401, "", "Unauthorized"})
+		}
+		return c.Next()
+	})
+	scim.Get("/ServiceProviderConfig", scimServiceProviderConfigHandler)
+	scim.Get("/ResourceTypes", scimResourceTypesHandler)
+	scim.Get("/Users", scimListUsersHandler)
+	scim.Post("/Users", scimCreateUserHandler)
+	scim.Get("/Users/:id", scimGetUserHandler)
+	scim.Put("/Users/:id", scimReplaceUserHandler)
+	scim.Patch("/Users/:id", scimPatchUserHandler)
+	scim.Delete("/Users/:id", scimDeleteUserHandler)
+	scim.Get("/Groups", scimListGroupsHandler)
+	scim.Post("/Groups", scimCreateGroupHandler)
+	scim.Get("/Groups/:id", scimGetGroupHandler)
+	scim.Put("/Groups/:id", scimReplaceGroupHandler)
+	scim.Patch("/Groups/:id", scimPatchGroupHandler)
+	scim.Delete("/Groups/:id", scimDeleteGroupHandler)
+}
+
+func scimServiceProviderConfigHandler(c *fiber.Ctx) error {
+	return scimReply(c, 200, fiber.Map{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          fiber.Map{"supported": true},
+		"bulk":           fiber.Map{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         fiber.Map{"supported": true, "maxResults": scimMaxPageCount},
+		"changePassword": fiber.Map{"supported": true},
+		"sort":           fiber.Map{"supported": false},
+		"etag":           fiber.Map{"supported": false},
+		"authenticationSchemes": []fiber.Map{{
+			"type": "oauthbearertoken", "name": "Bearer token", "description": "Static token from AUTH_SCIM_TOKEN",
+		}},
+	})
+}
+
+func scimResourceTypesHandler(c *fiber.Ctx) error {
+	types := []fiber.Map{
+		{"schemas": []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id": "User", "name": "User", "endpoint": "/Users", "schema": scimUserSchema},
+		{"schemas": []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id": "Group", "name": "Group", "endpoint": "/Groups", "schema": scimGroupSchema},
+	}
+	return scimReply(c, 200, fiber.Map{
+		"schemas": []string{scimListSchema}, "totalResults": len(types), "startIndex": 1,
+		"itemsPerPage": len(types), "Resources": types,
+	})
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// scimValue is an entry of a multi-valued attribute such as emails or members.
+type scimValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+}
+
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        *scimName   `json:"name,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []scimValue `json:"emails,omitempty"`
+	Locale      string      `json:"locale,omitempty"`
+	Timezone    string      `json:"timezone,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Password    string      `json:"password,omitempty"` // writeOnly, never returned
+	Groups      []scimValue `json:"groups,omitempty"`   // readOnly
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+func hasSchema(schemas []string, want string) bool {
+	for _, s := range schemas {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *scimUser) primaryEmail() string {
+	for _, e := range u.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+func (u *scimUser) displayName() string {
+	if u.DisplayName == "" && u.Name != nil {
+		return u.Name.Formatted
+	}
+	return u.DisplayName
+}
+
+// validate checks a full User representation against the core schema and the
+// constraints the profile endpoints enforce.
+func (u *scimUser) validate() error {
+	if !hasSchema(u.Schemas, scimUserSchema) {
+		return scimInvalid("invalidSyntax", "schemas must include %s", scimUserSchema)
+	}
+	name, err := normalizeUsername(u.UserName)
+	if err != nil {
+		return scimInvalid("invalidValue", "userName is required, at most 255 bytes and a valid PRECIS username")
+	}
+	u.UserName = name
+	if len(u.ExternalID) > 255 {
+		return scimInvalid("invalidValue", "externalId is too long")
+	}
+	p := profile{DisplayName: u.displayName(), Email: u.primaryEmail(), Locale: u.Locale, Timezone: u.Timezone}
+	if err := p.validate(); err != nil {
+		return scimInvalid("invalidValue", "%v", err)
+	}
+	return nil
+}
+
+func parseSCIMBody(c *fiber.Ctx, v any) error {
+	if err := json.Unmarshal(c.Body(), v); err != nil {
+		return scimInvalid("invalidSyntax", "Invalid request: %v", err)
+	}
+	return nil
+}
+
+func scimLocation(c *fiber.Ctx, resource, id string) string {
+	return c.BaseURL() + "/scim/v2/" + resource + "/" + id
+}
+
+// scimUserByID loads the stored representation of a user. The id is users.id.
+func scimUserByID(c *fiber.Ctx, id string) (*scimUser, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, &scimError{404, "", "User not found"}
+	}
+	u := &scimUser{Schemas: []string{scimUserSchema}, ID: id}
+	var email string
+	var active bool
+	err = db.QueryRow(`SELECT username, display_name, email, locale, timezone, active, external_id FROM users WHERE id = ?`, n).
+		Scan(&u.UserName, &u.DisplayName, &email, &u.Locale, &u.Timezone, &active, &u.ExternalID)
+	if err == sql.ErrNoRows {
+		return nil, &scimError{404, "", "User not found"}
+	} else if err != nil {
+		return nil, err
+	}
+	u.Active = &active
+	if u.DisplayName != "" {
+		u.Name = &scimName{Formatted: u.DisplayName}
+	}
+	if email != "" {
+		u.Emails = []scimValue{{Value: email, Type: "work", Primary: true}}
+	}
+
+	rows, err := db.Query(`SELECT g.id, g.display_name FROM scim_groups g
+            JOIN scim_group_members m ON m.group_id = g.id WHERE m.username = ? ORDER BY g.display_name`, u.UserName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g scimValue
+		if err := rows.Scan(&g.Value, &g.Display); err != nil {
+			return nil, err
+		}
+		g.Ref = scimLocation(c, "Groups", g.Value)
+		u.Groups = append(u.Groups, g)
+	}
+	u.Meta = &scimMeta{ResourceType: "User", Location: scimLocation(c, "Users", id)}
+	return u, rows.Err()
+}
+
+// scimFilterColumn is the column an attribute is filtered on. Key, if set, turns the
+// filter value into the form stored in the column.
+type scimFilterColumn struct {
+	Column string
+	Key    func(string) string
+}
+
+// scimFilter parses the "attribute eq value" filters supported here and maps the
+// attribute onto a column from columns. Attribute names are case-insensitive.
+var scimFilterPattern = regexp.MustCompile(`(?i)^\s*([a-z][a-z0-9.]*)\s+eq\s+("(?:[^"\\]|\\.)*")\s*$`)
+
+func scimFilter(filter string, columns map[string]scimFilterColumn) (string, []any, error) {
+	if filter == "" {
+		return "", nil, nil
+	}
+	m := scimFilterPattern.FindStringSubmatch(filter)
+	if m == nil {
+		return "", nil, scimInvalid("invalidFilter", "Only 'attribute eq \"value\"' filters are supported")
+	}
+	column, ok := columns[strings.ToLower(m[1])]
+	if !ok {
+		return "", nil, scimInvalid("invalidFilter", "Filtering on %s is not supported", m[1])
+	}
+	value, err := strconv.Unquote(m[2])
+	if err != nil {
+		return "", nil, scimInvalid("invalidFilter", "Invalid filter value")
+	}
+	if column.Key != nil {
+		value = column.Key(value)
+	}
+	return " WHERE " + column.Column + " = ?", []any{value}, nil
+}
+
+// scimPage reads startIndex (1-based) and count from the query string.
+func scimPage(c *fiber.Ctx) (startIndex, count int) {
+	startIndex = c.QueryInt("startIndex", 1)
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	count = c.QueryInt("count", 100)
+	if count < 0 {
+		count = 0
+	} else if count > scimMaxPageCount {
+		count = scimMaxPageCount
+	}
+	return startIndex, count
+}
+
+// scimList answers a paginated query of table; load turns an id into a resource.
+func scimList(c *fiber.Ctx, table string, columns map[string]scimFilterColumn, load func(id string) (any, error)) error {
+	where, args, err := scimFilter(c.Query("filter"), columns)
+	if err != nil {
+		return scimFail(c, err)
+	}
+	startIndex, count := scimPage(c)
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM "+table+where, args...).Scan(&total); err != nil {
+		return scimFail(c, err)
+	}
+	rows, err := db.Query("SELECT id FROM "+table+where+" ORDER BY id LIMIT ? OFFSET ?", append(args, count, startIndex-1)...)
+	if err != nil {
+		return scimFail(c, err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return scimFail(c, err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return scimFail(c, err)
+	}
+
+	resources := []any{}
+	for _, id := range ids {
+		r, err := load(id)
+		if err != nil {
+			return scimFail(c, err)
+		}
+		resources = append(resources, r)
+	}
+	return scimReply(c, 200, fiber.Map{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+// userName is matched like at sign-in, by canonical key; RFC 7643 makes it case-insensitive.
+var scimUserFilters = map[string]scimFilterColumn{
+	"username":     {"username_canonical", usernameKey},
+	"externalid":   {"external_id", nil},
+	"emails.value": {"email", nil},
+	"emails":       {"email", nil},
+}
+
+func scimListUsersHandler(c *fiber.Ctx) error {
+	return scimList(c, "users", scimUserFilters, func(id string) (any, error) {
+		return scimUserByID(c, id)
+	})
+}
+
+func scimGetUserHandler(c *fiber.Ctx) error {
+	u, err := scimUserByID(c, c.Params("id"))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	return scimReply(c, 200, u)
+}
+
+func scimCreateUserHandler(c *fiber.Ctx) error {
+	var u scimUser
+	if err := parseSCIMBody(c, &u); err != nil {
+		return scimFail(c, err)
+	}
+	if err := u.validate(); err != nil {
+		return scimFail(c, err)
+	}
+	if err := scimCheckUserName(u.UserName, ""); err != nil {
+		return scimFail(c, err)
+	}
+
+	// Without a password the account can only sign in through a linked identity or passkey.
+	hash := []byte("!")
+	if u.Password != "" {
+		var err error
+		if hash, err = hashPassword(u.Password); err != nil {
+			return scimFail(c, err)
+		}
+	}
+	active := u.Active == nil || *u.Active
+	key := usernameKey(u.UserName)
+	// The provisioning system is trusted with the address, as with a directory.
+	res, err := db.Exec(`INSERT INTO users (username, username_canonical, username_skeleton, password_hash, display_name, email, email_verified, locale, timezone, active, external_id)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.UserName, key, usernameSkeleton(key), string(hash), u.displayName(), u.primaryEmail(), u.primaryEmail() != "", u.Locale, u.Timezone, active, u.ExternalID)
+	if isDuplicateKey(err) {
+		return scimFail(c, &scimError{409, "uniqueness", "userName is already taken"})
+	} else if err != nil {
+		return scimFail(c, err)
+	}
+	id, _ := res.LastInsertId()
+	registrations.WithLabelValues("success").Inc()
+	audit(u.UserName, "register", c.IP(), "scim")
+	emitEvent(eventUserRegistered, fiber.Map{"username": u.UserName, "source": "scim"})
+
+	created, err := scimUserByID(c, strconv.FormatInt(id, 10))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	c.Location(created.Meta.Location)
+	return scimReply(c, 201, created)
+}
+
+// scimCheckUserName applies checkNewUsername to a userName being created, or given
+// to the account current.
+func scimCheckUserName(name, current string) error {
+	switch err := checkNewUsername(name, current); err {
+	case nil:
+		return nil
+	case errReservedUsername:
+		return scimInvalid("invalidValue", "userName is reserved")
+	case errConfusableUsername:
+		return &scimError{409, "uniqueness", "userName is too similar to an existing account"}
+	default:
+		return err
+	}
+}
+
+// saveSCIMUser writes updated over current, which was loaded by scimUserByID.
+func saveSCIMUser(c *fiber.Ctx, current, updated *scimUser) error {
+	if err := updated.validate(); err != nil {
+		return err
+	}
+	username := current.UserName
+	if updated.UserName != username {
+		var source string
+		if err := db.QueryRow("SELECT auth_source FROM users WHERE username = ?", username).Scan(&source); err != nil {
+			return err
+		}
+		// Directory accounts are matched by name on every login, so renaming would orphan them.
+		if source != "local" {
+			return scimInvalid("mutability", "userName is managed by the %s directory", source)
+		}
+		if err := scimCheckUserName(updated.UserName, username); err != nil {
+			return err
+		}
+		if err := renameUser(username, updated.UserName); err != nil {
+			return &scimError{409, "uniqueness", "userName is already taken"}
+		}
+		audit(updated.UserName, "username_change", c.IP(), "scim, from "+username)
+		username = updated.UserName
+	}
+
+	active := updated.Active == nil || *updated.Active
+	_, err := db.Exec(`UPDATE users SET display_name = ?, email = ?, email_verified = ?, locale = ?, timezone = ?, active = ?, external_id = ?
+            WHERE username = ?`,
+		updated.displayName(), updated.primaryEmail(), updated.primaryEmail() != "", updated.Locale, updated.Timezone, active, updated.ExternalID, username)
+	if err != nil {
+		return err
+	}
+	if updated.Password != "" {
+		hash, err := hashPassword(updated.Password)
+		if err != nil {
+			return err
+		}
+		switch err := storePassword(username, hash); {
+		case errors.Is(err, errNotLocalAccount):
+			// Directory accounts keep authenticating against the directory.
+		case err != nil:
+			return err
+		default:
+			audit(username, "password_change", c.IP(), "scim")
+			emitEvent(eventUserPasswordChanged, fiber.Map{"username": username})
+		}
+	}
+	if *current.Active && !active {
+		// checkAccountActive keeps the account from signing in again.
+		if err := revokeAllLogins(username, "deactivated"); err != nil {
+			return err
+		}
+		audit(username, "account_deactivate", c.IP(), "scim")
+	} else if !*current.Active && active {
+		audit(username, "account_activate", c.IP(), "scim")
+	}
+	return nil
+}
+
+func scimReplaceUserHandler(c *fiber.Ctx) error {
+	current, err := scimUserByID(c, c.Params("id"))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	var updated scimUser
+	if err := parseSCIMBody(c, &updated); err != nil {
+		return scimFail(c, err)
+	}
+	if err := saveSCIMUser(c, current, &updated); err != nil {
+		return scimFail(c, err)
+	}
+	return scimGetUserHandler(c)
+}
+
+type scimPatchOp struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// scimPatch applies a PatchOp message through set, which handles one attribute path.
+// An operation without a path carries an object of attribute/value pairs.
+func scimPatch(c *fiber.Ctx, set func(op, path string, value json.RawMessage) error) error {
+	var patch scimPatchOp
+	if err := parseSCIMBody(c, &patch); err != nil {
+		return err
+	}
+	if !hasSchema(patch.Schemas, scimPatchSchema) {
+		return scimInvalid("invalidSyntax", "schemas must include %s", scimPatchSchema)
+	}
+	for _, operation := range patch.Operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return scimInvalid("invalidSyntax", "Unsupported op %q", operation.Op)
+		}
+		if operation.Path != "" {
+			if err := set(op, operation.Path, operation.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		var attrs map[string]json.RawMessage
+		if op == "remove" || json.Unmarshal(operation.Value, &attrs) != nil {
+			return scimInvalid("noTarget", "Operation needs a path or an object value")
+		}
+		for path, value := range attrs {
+			if err := set(op, path, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func scimString(value json.RawMessage, into *string) error {
+	if err := json.Unmarshal(value, into); err != nil {
+		return scimInvalid("invalidValue", "Expected a string")
+	}
+	return nil
+}
+
+// setUserAttribute applies one patch operation to u.
+func setUserAttribute(u *scimUser, op, path string, value json.RawMessage) error {
+	remove := op == "remove"
+	lower := strings.ToLower(path)
+	lower = strings.TrimPrefix(lower, strings.ToLower(scimUserSchema)+":")
+	if u.Name == nil {
+		u.Name = &scimName{}
+	}
+	var field *string
+	switch lower {
+	case "username":
+		if remove {
+			return scimInvalid("mutability", "userName is required")
+		}
+		field = &u.UserName
+	case "displayname":
+		// name.formatted is stored in the same column and would bring it back.
+		if remove {
+			u.Name.Formatted = ""
+		}
+		field = &u.DisplayName
+	case "externalid":
+		field = &u.ExternalID
+	case "locale":
+		field = &u.Locale
+	case "timezone":
+		field = &u.Timezone
+	case "password":
+		field = &u.Password
+	case "name.formatted":
+		field = &u.Name.Formatted
+	case "name.givenname":
+		field = &u.Name.GivenName
+	case "name.familyname":
+		field = &u.Name.FamilyName
+	case "name":
+		u.Name = &scimName{}
+		if remove {
+			return nil
+		}
+		if err := json.Unmarshal(value, u.Name); err != nil {
+			return scimInvalid("invalidValue", "name must be an object")
+		}
+		return nil
+	case "active":
+		active := false
+		if !remove {
+			// Some clients send booleans as strings.
+			var s string
+			if json.Unmarshal(value, &active) != nil {
+				if json.Unmarshal(value, &s) != nil || (s != "True" && s != "true" && s != "False" && s != "false") {
+					return scimInvalid("invalidValue", "active must be a boolean")
+				}
+				active = strings.EqualFold(s, "true")
+			}
+		}
+		u.Active = &active
+		return nil
+	case "emails":
+		u.Emails = nil
+		if remove {
+			return nil
+		}
+		if err := json.Unmarshal(value, &u.Emails); err != nil {
+			return scimInvalid("invalidValue", "emails must be an array")
+		}
+		return nil
+	default:
+		// A filtered sub-attribute such as emails[type eq "work"].value sets the one email kept here.
+		if strings.HasPrefix(lower, "emails[") && strings.HasSuffix(lower, "].value") {
+			var email string
+			if !remove {
+				if err := scimString(value, &email); err != nil {
+					return err
+				}
+			}
+			u.Emails = nil
+			if email != "" {
+				u.Emails = []scimValue{{Value: email, Type: "work", Primary: true}}
+			}
+			return nil
+		}
+		return scimInvalid("invalidPath", "Unsupported attribute %q", path)
+	}
+	if remove {
+		*field = ""
+		return nil
+	}
+	return scimString(value, field)
+}
+
+func scimPatchUserHandler(c *fiber.Ctx) error {
+	current, err := scimUserByID(c, c.Params("id"))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	updated := *current
+	if current.Name != nil {
+		name := *current.Name
+		updated.Name = &name
+	}
+	err = scimPatch(c, func(op, path string, value json.RawMessage) error {
+		return setUserAttribute(&updated, op, path, value)
+	})
+	if err == nil {
+		err = saveSCIMUser(c, current, &updated)
+	}
+	if err != nil {
+		return scimFail(c, err)
+	}
+	return scimGetUserHandler(c)
+}
+
+// scimDeleteUserHandler deletes the account like deleteAccountHandler, and like it
+// refuses while the user is the only owner of an organization with other members.
+func scimDeleteUserHandler(c *fiber.Ctx) error {
+	u, err := scimUserByID(c, c.Params("id"))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	orgs, err := soleOwnerOrgs(u.UserName)
+	if err != nil {
+		return scimFail(c, err)
+	}
+	if len(orgs) > 0 {
+		return scimFail(c, &scimError{409, "", "User is the sole owner of organizations " + strings.Join(orgs, ", ") + "; transfer ownership first"})
+	}
+	id, _ := strconv.ParseInt(u.ID, 10, 64)
+	if err := deleteAccount(id, u.UserName); err != nil {
+		return scimFail(c, err)
+	}
+	return c.SendStatus(204)
+}
+
+type scimGroup struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []scimValue `json:"members,omitempty"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+func scimGroupByID(c *fiber.Ctx, id string) (*scimGroup, error) {
+	g := &scimGroup{Schemas: []string{scimGroupSchema}, ID: id}
+	var created, modified time.Time
+	err := db.QueryRow("SELECT display_name, external_id, created_at, updated_at FROM scim_groups WHERE id = ?", id).
+		Scan(&g.DisplayName, &g.ExternalID, &created, &modified)
+	if err == sql.ErrNoRows {
+		return nil, &scimError{404, "", "Group not found"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT u.id, u.username FROM scim_group_members m
+            JOIN users u ON u.username = m.username WHERE m.group_id = ? ORDER BY u.username`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m scimValue
+		if err := rows.Scan(&m.Value, &m.Display); err != nil {
+			return nil, err
+		}
+		m.Ref = scimLocation(c, "Users", m.Value)
+		g.Members = append(g.Members, m)
+	}
+	g.Meta = &scimMeta{ResourceType: "Group", Created: &created, LastModified: &modified, Location: scimLocation(c, "Groups", id)}
+	return g, rows.Err()
+}
+
+var scimGroupFilters = map[string]scimFilterColumn{
+	"displayname": {"display_name", nil},
+	"externalid":  {"external_id", nil},
+}
+
+func scimListGroupsHandler(c *fiber.Ctx) error {
+	return scimList(c, "scim_groups", scimGroupFilters, func(id string) (any, error) {
+		return scimGroupByID(c, id)
+	})
+}
+
+func scimGetGroupHandler(c *fiber.Ctx) error {
+	g, err := scimGroupByID(c, c.Params("id"))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	return scimReply(c, 200, g)
+}
+
+func (g *scimGroup) validate() error {
+	if !hasSchema(g.Schemas, scimGroupSchema) {
+		return scimInvalid("invalidSyntax", "schemas must include %s", scimGroupSchema)
+	}
+	if g.DisplayName == "" || len(g.DisplayName) > 255 {
+		return scimInvalid("invalidValue", "displayName is required and at most 255 characters")
+	}
+	if len(g.ExternalID) > 255 {
+		return scimInvalid("invalidValue", "externalId is too long")
+	}
+	return nil
+}
+
+// saveSCIMGroup writes g, inserting it when create is set, and replaces its members.
+func saveSCIMGroup(g *scimGroup, create bool) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if create {
+		_, err = tx.Exec("INSERT INTO scim_groups (id, display_name, external_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+			g.ID, g.DisplayName, g.ExternalID, now, now)
+	} else {
+		_, err = tx.Exec("UPDATE scim_groups SET display_name = ?, external_id = ?, updated_at = ? WHERE id = ?",
+			g.DisplayName, g.ExternalID, now, g.ID)
+	}
+	if isDuplicateKey(err) {
+		return &scimError{409, "uniqueness", "displayName is already taken"}
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM scim_group_members WHERE group_id = ?", g.ID); err != nil {
+		return err
+	}
+	for _, m := range g.Members {
+		var username string
+		err := tx.QueryRow("SELECT username FROM users WHERE id = ?", m.Value).Scan(&username)
+		if err == sql.ErrNoRows {
+			return scimInvalid("invalidValue", "Unknown member %q", m.Value)
+		} else if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT IGNORE INTO scim_group_members (group_id, username) VALUES (?, ?)", g.ID, username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func scimCreateGroupHandler(c *fiber.Ctx) error {
+	var g scimGroup
+	if err := parseSCIMBody(c, &g); err != nil {
+		return scimFail(c, err)
+	}
+	g.ID = generateID()
+	if err := saveSCIMGroup(&g, true); err != nil {
+		return scimFail(c, err)
+	}
+	audit("", "scim_group_create", c.IP(), g.DisplayName)
+	created, err := scimGroupByID(c, g.ID)
+	if err != nil {
+		return scimFail(c, err)
+	}
+	c.Location(created.Meta.Location)
+	return scimReply(c, 201, created)
+}
+
+func scimReplaceGroupHandler(c *fiber.Ctx) error {
+	if _, err := scimGroupByID(c, c.Params("id")); err != nil {
+		return scimFail(c, err)
+	}
+	var g scimGroup
+	if err := parseSCIMBody(c, &g); err != nil {
+		return scimFail(c, err)
+	}
+	g.ID = c.Params("id")
+	if err := saveSCIMGroup(&g, false); err != nil {
+		return scimFail(c, err)
+	}
+	return scimGetGroupHandler(c)
+}
+
+// scimMemberFilter matches the members[value eq "id"] path used to remove one member.
+var scimMemberFilter = regexp.MustCompile(`(?i)^members\[value\s+eq\s+"([^"]*)"\]$`)
+
+func setGroupAttribute(g *scimGroup, op, path string, value json.RawMessage) error {
+	lower := strings.ToLower(path)
+	switch {
+	case lower == "displayname":
+		if op == "remove" {
+			return scimInvalid("mutability", "displayName is required")
+		}
+		return scimString(value, &g.DisplayName)
+	case lower == "externalid":
+		if op == "remove" {
+			g.ExternalID = ""
+			return nil
+		}
+		return scimString(value, &g.ExternalID)
+	case lower == "members":
+		var members []scimValue
+		if len(value) > 0 {
+			if err := json.Unmarshal(value, &members); err != nil {
+				return scimInvalid("invalidValue", "members must be an array")
+			}
+		}
+		switch op {
+		case "replace":
+			g.Members = members
+		case "add":
+			g.Members = append(g.Members, members...)
+		case "remove":
+			if members == nil {
+				g.Members = nil
+			}
+			for _, m := range members {
+				g.Members = removeMember(g.Members, m.Value)
+			}
+		}
+		return nil
+	}
+	if m := scimMemberFilter.FindStringSubmatch(path); m != nil && op == "remove" {
+		g.Members = removeMember(g.Members, m[1])
+		return nil
+	}
+	return scimInvalid("invalidPath", "Unsupported attribute %q", path)
+}
+
+func removeMember(members []scimValue, id string) []scimValue {
+	kept := members[:0]
+	for _, m := range members {
+		if m.Value != id {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+func scimPatchGroupHandler(c *fiber.Ctx) error {
+	g, err := scimGroupByID(c, c.Params("id"))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	err = scimPatch(c, func(op, path string, value json.RawMessage) error {
+		return setGroupAttribute(g, op, path, value)
+	})
+	if err == nil {
+		err = saveSCIMGroup(g, false)
+	}
+	if err != nil {
+		return scimFail(c, err)
+	}
+	return scimGetGroupHandler(c)
+}
+
+func scimDeleteGroupHandler(c *fiber.Ctx) error {
+	g, err := scimGroupByID(c, c.Params("id"))
+	if err != nil {
+		return scimFail(c, err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return scimFail(c, err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM scim_group_members WHERE group_id = ?", g.ID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM scim_groups WHERE id = ?", g.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return scimFail(c, err)
+	}
+	audit("", "scim_group_delete", c.IP(), g.DisplayName)
+	return c.SendStatus(204)
+}
+
+// exportGroups lists the SCIM groups a user belongs to for the personal-data export.
+func exportGroups(username string) (any, error) {
+	rows, err := db.Query(`SELECT g.display_name FROM scim_groups g
+            JOIN scim_group_members m ON m.group_id = g.id WHERE m.username = ? ORDER BY g.display_name`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		groups = append(groups, name)
+	}
+	return groups, rows.Err()
+}
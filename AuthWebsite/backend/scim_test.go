@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const testSCIMToken = "scim-s3cret"
+
+// scimRequest sends a request to the SCIM API as the provisioning client.
+func scimRequest(t *testing.T, method, path string, body any) *http.Response {
+	t.Helper()
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", scimContentType)
+	req.Header.Set("Authorization", "Bearer "+testSCIMToken)
+	resp, err := testApp.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func scimUserBody(userName string) fiber.Map {
+	return fiber.Map{"schemas": []string{scimUserSchema}, "userName": userName}
+}
+
+func TestSCIMUserNames(t *testing.T) {
+	existing := newUsername()
+	register(t, existing, "correct horse")
+	confusable := "usеr" + existing[len("user"):]
+
+	decode(t, scimRequest(t, "POST", "/scim/v2/Users", scimUserBody("Admin")), 400)
+	decode(t, scimRequest(t, "POST", "/scim/v2/Users", scimUserBody(confusable)), 409)
+
+	username := "Mixed" + newUsername()
+	created := decode(t, scimRequest(t, "POST", "/scim/v2/Users", scimUserBody(username)), 201)
+	path := "/scim/v2/Users/" + created["id"].(string)
+
+	// userName filters are case-insensitive.
+	filter := url.QueryEscape(`userName eq "` + strings.ToLower(username) + `"`)
+	listed := decode(t, scimRequest(t, "GET", "/scim/v2/Users?filter="+filter, nil), 200)
+	if listed["totalResults"] != float64(1) {
+		t.Errorf("filtered list = %v", listed)
+	}
+
+	decode(t, scimRequest(t, "PUT", path, scimUserBody("Support")), 400)
+	decode(t, scimRequest(t, "PUT", path, scimUserBody(confusable)), 409)
+	renamed := decode(t, scimRequest(t, "PUT", path, scimUserBody(strings.ToUpper(username))), 200)
+	if renamed["userName"] != strings.ToUpper(username) {
+		t.Errorf("userName = %v", renamed["userName"])
+	}
+}
+
+func TestSCIMDeleteSoleOwner(t *testing.T) {
+	username := newUsername()
+	body := scimUserBody(username)
+	body["password"] = "correct horse"
+	created := decode(t, scimRequest(t, "POST", "/scim/v2/Users", body), 201)
+	path := "/scim/v2/Users/" + created["id"].(string)
+
+	owner := login(t, username, "correct horse")
+	decode(t, request(t, "POST", "/api/orgs", fiber.Map{"slug": "org-" + username, "name": "Org"}, owner), 201)
+	decode(t, request(t, "POST", "/api/orgs/switch", fiber.Map{"slug": "org-" + username}, owner), 200)
+	member := newUsername()
+	register(t, member, "correct horse")
+	inv := decode(t, request(t, "POST", "/api/orgs/current/invitations", fiber.Map{"username": member}, owner), 201)
+	decode(t, request(t, "POST", "/api/orgs/invitations/"+inv["id"].(string)+"/accept", nil, login(t, member, "correct horse")), 200)
+
+	decode(t, scimRequest(t, "DELETE", path, nil), 409)
+	decode(t, scimRequest(t, "GET", path, nil), 200)
+
+	decode(t, request(t, "DELETE", "/api/orgs/current/members/"+member, nil, owner), 200)
+	if resp := scimRequest(t, "DELETE", path, nil); resp.StatusCode != 204 {
+		t.Fatalf("delete status %d", resp.StatusCode)
+	}
+	decode(t, scimRequest(t, "GET", path, nil), 404)
+	decode(t, request(t, "GET", "/api/profile", nil, owner), 401)
+}
+
+func TestSCIMRequiresToken(t *testing.T) {
+	for name, header := range map[string]string{
+		"missing":     "",
+		"wrong token": "Bearer not-" + testSCIMToken,
+		"not bearer":  "Basic " + testSCIMToken,
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			resp, err := testApp.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := decode(t, resp, 401)
+			if got["status"] != "401" || resp.Header.Get("Content-Type") != scimContentType {
+				t.Errorf("error response %v, content type %q", got, resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestSCIMPatchUser(t *testing.T) {
+	username := newUsername()
+	created := decode(t, scimRequest(t, "POST", "/scim/v2/Users", scimUserBody(username)), 201)
+	path := "/scim/v2/Users/" + created["id"].(string)
+	patch := func(ops ...fiber.Map) *http.Response {
+		return scimRequest(t, "PATCH", path, fiber.Map{"schemas": []string{scimPatchSchema}, "Operations": ops})
+	}
+
+	got := decode(t, patch(
+		fiber.Map{"op": "replace", "path": "displayName", "value": "Ada Lovelace"},
+		fiber.Map{"op": "add", "path": `emails[type eq "work"].value`, "value": "ada@example.com"},
+		fiber.Map{"op": "Replace", "value": fiber.Map{"locale": "en-GB", "externalId": "hr-1"}},
+	), 200)
+	if got["displayName"] != "Ada Lovelace" || got["locale"] != "en-GB" || got["externalId"] != "hr-1" {
+		t.Errorf("patched user = %v", got)
+	}
+	if emails, _ := got["emails"].([]any); len(emails) != 1 || emails[0].(map[string]any)["value"] != "ada@example.com" {
+		t.Errorf("emails = %v", got["emails"])
+	}
+	filter := url.QueryEscape(`externalId eq "hr-1"`)
+	if listed := decode(t, scimRequest(t, "GET", "/scim/v2/Users?filter="+filter, nil), 200); listed["totalResults"] != float64(1) {
+		t.Errorf("filtered by externalId = %v", listed)
+	}
+
+	// Deactivation, sent as a string as some clients do, signs the user out.
+	password := decode(t, patch(fiber.Map{"op": "replace", "path": "password", "value": "correct horse"}), 200)
+	if _, ok := password["password"]; ok {
+		t.Error("password returned")
+	}
+	cookie := login(t, username, "correct horse")
+	if got := decode(t, patch(fiber.Map{"op": "replace", "path": "active", "value": "False"}), 200); got["active"] != false {
+		t.Errorf("active = %v", got["active"])
+	}
+	decode(t, request(t, "GET", "/api/profile", nil, cookie), 401)
+	decode(t, request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "correct horse"}), 403)
+
+	got = decode(t, patch(fiber.Map{"op": "remove", "path": "displayName"}), 200)
+	if _, ok := got["displayName"]; ok {
+		t.Errorf("displayName after remove = %v", got["displayName"])
+	}
+
+	decode(t, patch(fiber.Map{"op": "remove", "path": "userName"}), 400)
+	decode(t, patch(fiber.Map{"op": "replace", "path": "nickName", "value": "x"}), 400)
+	decode(t, patch(fiber.Map{"op": "move", "path": "displayName", "value": "x"}), 400)
+	decode(t, scimRequest(t, "PATCH", path, fiber.Map{"Operations": []fiber.Map{}}), 400)
+}
+
+func TestSCIMGroups(t *testing.T) {
+	alice, bob := newUsername(), newUsername()
+	aliceID := decode(t, scimRequest(t, "POST", "/scim/v2/Users", scimUserBody(alice)), 201)["id"].(string)
+	bobID := decode(t, scimRequest(t, "POST", "/scim/v2/Users", scimUserBody(bob)), 201)["id"].(string)
+	members := func(g map[string]any) []string {
+		var ids []string
+		for _, m := range g["members"].([]any) {
+			ids = append(ids, m.(map[string]any)["value"].(string))
+		}
+		return ids
+	}
+
+	name := "Engineering " + alice
+	created := decode(t, scimRequest(t, "POST", "/scim/v2/Groups", fiber.Map{"schemas": []string{scimGroupSchema},
+		"displayName": name, "members": []fiber.Map{{"value": aliceID}}}), 201)
+	path := "/scim/v2/Groups/" + created["id"].(string)
+	if ids := members(created); len(ids) != 1 || ids[0] != aliceID {
+		t.Errorf("members = %v", ids)
+	}
+	decode(t, scimRequest(t, "POST", "/scim/v2/Groups", fiber.Map{"schemas": []string{scimGroupSchema}, "displayName": name}), 409)
+	decode(t, scimRequest(t, "POST", "/scim/v2/Groups", fiber.Map{"schemas": []string{scimGroupSchema},
+		"displayName": "Other " + alice, "members": []fiber.Map{{"value": "0"}}}), 400)
+
+	// The user representation lists its groups.
+	user := decode(t, scimRequest(t, "GET", "/scim/v2/Users/"+aliceID, nil), 200)
+	if groups, _ := user["groups"].([]any); len(groups) != 1 || groups[0].(map[string]any)["display"] != name {
+		t.Errorf("groups of %s = %v", alice, user["groups"])
+	}
+
+	patch := func(ops ...fiber.Map) map[string]any {
+		return decode(t, scimRequest(t, "PATCH", path, fiber.Map{"schemas": []string{scimPatchSchema}, "Operations": ops}), 200)
+	}
+	if ids := members(patch(fiber.Map{"op": "add", "path": "members", "value": []fiber.Map{{"value": bobID}}})); len(ids) != 2 {
+		t.Errorf("members after add = %v", ids)
+	}
+	if ids := members(patch(fiber.Map{"op": "remove", "path": `members[value eq "` + aliceID + `"]`})); len(ids) != 1 || ids[0] != bobID {
+		t.Errorf("members after remove = %v", ids)
+	}
+	renamed := patch(fiber.Map{"op": "replace", "path": "displayName", "value": name + " (renamed)"})
+	if renamed["displayName"] != name+" (renamed)" {
+		t.Errorf("displayName = %v", renamed["displayName"])
+	}
+	if g := patch(fiber.Map{"op": "remove", "path": "members"}); g["members"] != nil {
+		t.Errorf("members after removing all = %v", g["members"])
+	}
+
+	replaced := decode(t, scimRequest(t, "PUT", path, fiber.Map{"schemas": []string{scimGroupSchema},
+		"displayName": name, "externalId": "grp-" + alice, "members": []fiber.Map{{"value": aliceID}, {"value": bobID}}}), 200)
+	if ids := members(replaced); len(ids) != 2 || replaced["externalId"] != "grp-"+alice {
+		t.Errorf("replaced group = %v", replaced)
+	}
+	filter := url.QueryEscape(`displayName eq "` + name + `"`)
+	if listed := decode(t, scimRequest(t, "GET", "/scim/v2/Groups?filter="+filter, nil), 200); listed["totalResults"] != float64(1) {
+		t.Errorf("filtered groups = %v", listed)
+	}
+
+	if resp := scimRequest(t, "DELETE", path, nil); resp.StatusCode != 204 {
+		t.Fatalf("delete status %d", resp.StatusCode)
+	}
+	decode(t, scimRequest(t, "GET", path, nil), 404)
+	decode(t, scimRequest(t, "DELETE", path, nil), 404)
+	if user := decode(t, scimRequest(t, "GET", "/scim/v2/Users/"+aliceID, nil), 200); user["groups"] != nil {
+		t.Errorf("groups after the group was deleted = %v", user["groups"])
+	}
+}
+
+func TestSCIMPagination(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		decode(t, scimRequest(t, "POST", "/scim/v2/Users", scimUserBody(newUsername())), 201)
+	}
+	page := func(query string) (total int, ids []string) {
+		got := decode(t, scimRequest(t, "GET", "/scim/v2/Users?"+query, nil), 200)
+		for _, r := range got["Resources"].([]any) {
+			ids = append(ids, r.(map[string]any)["id"].(string))
+		}
+		if got["itemsPerPage"] != float64(len(ids)) {
+			t.Errorf("%s: itemsPerPage %v for %d resources", query, got["itemsPerPage"], len(ids))
+		}
+		return int(got["totalResults"].(float64)), ids
+	}
+
+	total, first := page("startIndex=1&count=2")
+	if total < 3 || len(first) != 2 {
+		t.Fatalf("first page: total %d, ids %v", total, first)
+	}
+	if _, second := page("startIndex=2&count=1"); len(second) != 1 || second[0] != first[1] {
+		t.Errorf("startIndex=2 returned %v, want [%s]", second, first[1])
+	}
+	if n, none := page("count=0"); n != total || len(none) != 0 {
+		t.Errorf("count=0: total %d, ids %v", n, none)
+	}
+	if _, last := page("startIndex=" + strconv.Itoa(total)); len(last) != 1 {
+		t.Errorf("last page = %v", last)
+	}
+	if _, capped := page("count=100000"); len(capped) > scimMaxPageCount {
+		t.Errorf("count was not capped: %d resources", len(capped))
+	}
+
+	decode(t, scimRequest(t, "GET", "/scim/v2/Users?filter="+url.QueryEscape(`userName sw "user"`), nil), 400)
+	decode(t, scimRequest(t, "GET", "/scim/v2/Users?filter="+url.QueryEscape(`nickName eq "x"`), nil), 400)
+}
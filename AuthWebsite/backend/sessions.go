@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const sessionTTL = 24 * time.Hour
+
+type session struct {
+	Username  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	FamilyID  string // refresh-token family of an API access token, empty for cookie sessions
+	OrgID     int64  // active organization, 0 for none
+
+	// Impersonator is the admin acting as Username in a support session.
+	Impersonator string
+
+	// Binding is the client a browser session was started from, and StepUp is set
+	// while it waits for the password after a network change; see binding.go.
+	Binding clientBinding
+	StepUp  bool
+
+	uses           []sessionUse // recent fingerprints, oldest first; not persisted
+	stepUpFailures int
+	reauthAt       time.Time // last sign-in at a provider to confirm this session; not persisted
+}
+
+// sessions is keyed by session id, the SHA-256 of the token, so that neither memory
+// dumps nor the sessions table hold a usable token.
+var sessions = make(map[string]session)
+var sessionsMu sync.RWMutex
+
+// sessionsClosed is set once the store has been flushed during shutdown.
+var sessionsClosed atomic.Bool
+
+// createSession stores s, valid for ttl from now, and returns its token.
+func createSession(s session, ttl time.Duration) (string, session) {
+	token := generateToken()
+	now := time.Now()
+	s.CreatedAt, s.ExpiresAt = now, now.Add(ttl)
+	sessionsMu.Lock()
+	sessions[hashToken(token)] = s
+	sessionsMu.Unlock()
+	return token, s
+}
+
+// lookupSession returns the unexpired session for token.
+func lookupSession(token string) (session, bool) {
+	return lookupSessionByID(hashToken(token))
+}
+
+// lookupSessionByID returns the unexpired session whose id is id.
+func lookupSessionByID(id string) (session, bool) {
+	sessionsMu.RLock()
+	s, exists := sessions[id]
+	sessionsMu.RUnlock()
+	if !exists || time.Now().After(s.ExpiresAt) {
+		return session{}, false
+	}
+	return s, true
+}
+
+func deleteSession(token string) {
+	deleteSessionByID(hashToken(token))
+}
+
+func deleteSessionByID(id string) {
+	sessionsMu.Lock()
+	delete(sessions, id)
+	sessionsMu.Unlock()
+}
+
+// userSessions returns the unexpired sessions of username keyed by id.
+func userSessions(username string) map[string]session {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	now := time.Now()
+	result := make(map[string]session)
+	for id, s := range sessions {
+		if s.Username == username && now.Before(s.ExpiresAt) {
+			result[id] = s
+		}
+	}
+	return result
+}
+
+// revokeUserSessions deletes every session belonging to username, including those in
+// which username impersonates someone, and returns how many there were.
+func revokeUserSessions(username string) int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	n := 0
+	for id, s := range sessions {
+		if s.Username == username || s.Impersonator == username {
+			delete(sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+// revokeOtherSessions deletes the sessions of username except the one behind keep.
+func revokeOtherSessions(username, keep string) int {
+	keepID := hashToken(keep)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	n := 0
+	for id, s := range sessions {
+		if id != keepID && (s.Username == username || s.Impersonator == username) {
+			delete(sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+// setSessionOrg changes the active organization of the session behind token.
+func setSessionOrg(token string, orgID int64) {
+	id := hashToken(token)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if s, ok := sessions[id]; ok {
+		s.OrgID = orgID
+		sessions[id] = s
+	}
+}
+
+// rebindSession binds the session behind token to b and lifts a pending step-up.
+// Earlier uses are forgotten, so a return to the old network asks again instead of
+// counting as divergent use.
+func rebindSession(token string, b clientBinding) {
+	id := hashToken(token)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if s, ok := sessions[id]; ok {
+		s.Binding, s.StepUp, s.stepUpFailures, s.uses = b, false, 0, nil
+		sessions[id] = s
+	}
+}
+
+// recordStepUpFailure counts a wrong password given to confirm the session behind
+// token and returns the number of failures so far.
+func recordStepUpFailure(token string) int {
+	id := hashToken(token)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[id]
+	if !ok {
+		return 0
+	}
+	s.stepUpFailures++
+	sessions[id] = s
+	return s.stepUpFailures
+}
+
+// markReauthenticated records that the user of session id has just signed in again
+// at an identity provider.
+func markReauthenticated(id string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if s, ok := sessions[id]; ok {
+		s.reauthAt = time.Now()
+		sessions[id] = s
+	}
+}
+
+// takeReauthentication consumes a provider sign-in made for the session behind token
+// within the last window.
+func takeReauthentication(token string, window time.Duration) bool {
+	id := hashToken(token)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[id]
+	if !ok || s.reauthAt.IsZero() || time.Since(s.reauthAt) > window {
+		return false
+	}
+	s.reauthAt = time.Time{}
+	sessions[id] = s
+	return true
+}
+
+// revokeFamilySessions deletes the access tokens issued from refresh-token family familyID.
+func revokeFamilySessions(familyID string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for id, s := range sessions {
+		if s.FamilyID == familyID {
+			delete(sessions, id)
+		}
+	}
+}
+
+// renameSessionUser moves the sessions of oldName over to newName.
+func renameSessionUser(oldName, newName string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for id, s := range sessions {
+		if s.Username == oldName {
+			s.Username = newName
+		}
+		if s.Impersonator == oldName {
+			s.Impersonator = newName
+		}
+		sessions[id] = s
+	}
+}
+
+// sessionCount returns the number of unexpired sessions.
+func sessionCount() int {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	now := time.Now()
+	n := 0
+	for _, s := range sessions {
+		if now.Before(s.ExpiresAt) {
+			n++
+		}
+	}
+	return n
+}
+
+// expireSessions drops sessions that lookupSession no longer accepts.
+func expireSessions(now time.Time) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for id, s := range sessions {
+		if now.After(s.ExpiresAt) {
+			delete(sessions, id)
+		}
+	}
+}
+
+// checkSessionStore reports whether the store can still accept new sessions.
+func checkSessionStore() error {
+	if sessionsClosed.Load() {
+		return errors.New("session store closed")
+	}
+	return nil
+}
+
+// loadSessions restores the sessions saved by the last flushSessions call.
+func loadSessions() error {
+	rows, err := db.Query(`SELECT token, username, created_at, expires_at, family_id, org_id, impersonator, client_ip, client_family, step_up
+            FROM sessions WHERE expires_at > ?`, time.Now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for rows.Next() {
+		var id string
+		var s session
+		if err := rows.Scan(&id, &s.Username, &s.CreatedAt, &s.ExpiresAt, &s.FamilyID, &s.OrgID, &s.Impersonator,
+			&s.Binding.IP, &s.Binding.Client, &s.StepUp); err != nil {
+			return err
+		}
+		// Rows saved before sessions were keyed by id hold the token itself.
+		if len(id) != sha256.Size*2 {
+			id = hashToken(id)
+		}
+		sessions[id] = s
+	}
+	return rows.Err()
+}
+
+// flushSessions persists every unexpired session so that a restart does not log users
+// out. Only session ids are written; the tokens themselves stay with the clients.
+func flushSessions() error {
+	sessionsClosed.Store(true)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM sessions"); err != nil {
+		return err
+	}
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	now := time.Now()
+	for id, s := range sessions {
+		if now.After(s.ExpiresAt) {
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO sessions (token, username, created_at, expires_at, family_id, org_id, impersonator, client_ip, client_family, step_up)
+                VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, id, s.Username, s.CreatedAt, s.ExpiresAt, s.FamilyID, s.OrgID, s.Impersonator,
+			s.Binding.IP, s.Binding.Client, s.StepUp)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
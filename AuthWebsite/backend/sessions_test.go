@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFlushedSessionsHoldNoTokens(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+
+	if err := flushSessions(); err != nil {
+		t.Fatal(err)
+	}
+	sessionsClosed.Store(false)
+
+	var raw, hashed int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sessions WHERE token = ?", cookie.Value).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM sessions WHERE token = ?", hashToken(cookie.Value)).Scan(&hashed); err != nil {
+		t.Fatal(err)
+	}
+	if raw != 0 || hashed != 1 {
+		t.Errorf("sessions table has %d rows with the token and %d with its hash, want 0 and 1", raw, hashed)
+	}
+
+	// A restart restores the session from its hash.
+	deleteSession(cookie.Value)
+	if err := loadSessions(); err != nil {
+		t.Fatal(err)
+	}
+	profile := decode(t, request(t, "GET", "/api/profile", nil, cookie), 200)
+	if profile["username"] != username {
+		t.Errorf("profile username = %v, want %s", profile["username"], username)
+	}
+}
+
+func TestExpiredSessionsAreSwept(t *testing.T) {
+	before := testutil.ToFloat64(activeSessions)
+	token, _ := createSession(session{Username: newUsername()}, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if got := testutil.ToFloat64(activeSessions); got != before {
+		t.Errorf("active sessions = %v after expiry, want %v", got, before)
+	}
+
+	expireSessions(time.Now())
+	sessionsMu.RLock()
+	_, kept := sessions[hashToken(token)]
+	sessionsMu.RUnlock()
+	if kept {
+		t.Error("expired session still stored")
+	}
+}
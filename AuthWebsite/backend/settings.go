@@ -0,0 +1,18 @@
+package main
+
+import "database/sql"
+
+// getSetting returns the value stored under key, or def when it has never been set.
+func getSetting(key, def string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE name = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return def, nil
+	}
+	return value, err
+}
+
+func setSetting(key, value string) error {
+	_, err := db.Exec("INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", key, value)
+	return err
+}
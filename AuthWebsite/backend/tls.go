@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// With AUTH_TLS_CERT and AUTH_TLS_KEY set the server speaks HTTPS only. The key
+// pair is reloaded on SIGHUP and when either file changes; every handshake picks
+// up the current certificate, so open connections are not dropped.
+
+// secureCookies marks cookies Secure. It is on with TLS, and can be forced with
+// AUTH_COOKIE_SECURE=true when TLS is terminated by a proxy in front of the server.
+var secureCookies bool
+
+type tlsConfig struct {
+	CertFile       string
+	KeyFile        string
+	ReloadInterval time.Duration
+	RedirectAddr   string // plain HTTP listener that redirects to HTTPS, empty for none
+	HSTS           string // Strict-Transport-Security header value, empty to disable
+	CSP            string
+}
+
+var serverTLS tlsConfig
+
+const defaultCSP = "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data: https:; connect-src 'self'; frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+func loadTLSConfig() error {
+	serverTLS = tlsConfig{
+		CertFile:     envOr("AUTH_TLS_CERT", ""),
+		KeyFile:      envOr("AUTH_TLS_KEY", ""),
+		RedirectAddr: envOr("AUTH_HTTP_REDIRECT_ADDR", ""),
+		CSP:          envOr("AUTH_CSP", defaultCSP),
+	}
+	if (serverTLS.CertFile == "") != (serverTLS.KeyFile == "") {
+		return fmt.Errorf("AUTH_TLS_CERT and AUTH_TLS_KEY must be set together")
+	}
+	if serverTLS.RedirectAddr != "" && serverTLS.CertFile == "" {
+		return fmt.Errorf("AUTH_HTTP_REDIRECT_ADDR requires AUTH_TLS_CERT and AUTH_TLS_KEY")
+	}
+
+	var err error
+	if serverTLS.ReloadInterval, err = time.ParseDuration(envOr("AUTH_TLS_RELOAD_INTERVAL", "1m")); err != nil {
+		return fmt.Errorf("AUTH_TLS_RELOAD_INTERVAL: %w", err)
+	}
+	maxAge, err := strconv.Atoi(envOr("AUTH_HSTS_MAX_AGE", "31536000"))
+	if err != nil || maxAge < 0 {
+		return fmt.Errorf("AUTH_HSTS_MAX_AGE must be a non-negative number of seconds")
+	}
+	if serverTLS.CertFile != "" && maxAge > 0 {
+		serverTLS.HSTS = "max-age=" + strconv.Itoa(maxAge) + "; includeSubDomains"
+	}
+
+	secureCookies = serverTLS.CertFile != "" || envOr("AUTH_COOKIE_SECURE", "false") == "true"
+	return nil
+}
+
+// certReloader serves the most recently loaded key pair to TLS handshakes.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+	modTime           time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the key pair from disk. On failure the previous certificate stays in use.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	r.modTime = r.latestModTime()
+	return nil
+}
+
+func (r *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// watch reloads the certificate on SIGHUP and whenever the files' modification
+// time changes. It runs until the process exits.
+func (r *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			if !r.latestModTime().After(r.modTime) {
+				continue
+			}
+		}
+		if err := r.reload(); err != nil {
+			log.Println("reload TLS certificate:", err)
+		} else {
+			log.Println("TLS certificate reloaded")
+		}
+	}
+}
+
+// listen serves app on addr, over TLS when a certificate is configured.
+func listen(app *fiber.App, addr string) error {
+	if serverTLS.CertFile == "" {
+		log.Println("Server running on http://" + addr)
+		return app.Listen(addr)
+	}
+	reloader, err := newCertReloader(serverTLS.CertFile, serverTLS.KeyFile)
+	if err != nil {
+		return err
+	}
+	go reloader.watch(serverTLS.ReloadInterval)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Println("Server running on https://" + addr)
+	return app.Listener(tls.NewListener(ln, &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}))
+}
+
+// serveRedirect starts the plain HTTP listener that sends every request to the
+// HTTPS address. It returns nil when AUTH_HTTP_REDIRECT_ADDR is not set.
+func serveRedirect(httpsAddr string) *fiber.App {
+	if serverTLS.RedirectAddr == "" {
+		return nil
+	}
+	redirectApp := fiber.New(fiber.Config{DisableStartupMessage: true})
+	redirectApp.Use(redirectToHTTPS(httpsAddr))
+	go func() {
+		log.Println("Redirecting http://" + serverTLS.RedirectAddr + " to HTTPS")
+		if err := redirectApp.Listen(serverTLS.RedirectAddr); err != nil {
+			log.Println("redirect listener:", err)
+		}
+	}()
+	return redirectApp
+}
+
+// redirectToHTTPS sends requests to the same host and URL on the HTTPS address.
+// GET and HEAD are moved permanently; other methods get a 308 so that clients
+// repeat them with the same body.
+func redirectToHTTPS(httpsAddr string) fiber.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return func(c *fiber.Ctx) error {
+		host := c.Hostname()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		status := fiber.StatusMovedPermanently
+		if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+			status = fiber.StatusPermanentRedirect
+		}
+		return c.Redirect("https://"+host+c.OriginalURL(), status)
+	}
+}
+
+// securityHeaders sets the browser hardening headers on every response, and HSTS
+// when serving over TLS.
+func securityHeaders(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderXFrameOptions, "DENY")
+	c.Set(fiber.HeaderReferrerPolicy, "strict-origin-when-cross-origin")
+	c.Set("Cross-Origin-Opener-Policy", "same-origin")
+	c.Set(fiber.HeaderPermissionsPolicy, "camera=(), microphone=(), geolocation=()")
+	if serverTLS.CSP != "" {
+		c.Set(fiber.HeaderContentSecurityPolicy, serverTLS.CSP)
+	}
+	if serverTLS.HSTS != "" {
+		c.Set(fiber.HeaderStrictTransportSecurity, serverTLS.HSTS)
+	}
+	return c.Next()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// useTLSConfig loads the TLS settings from env and restores the test defaults afterwards.
+func useTLSConfig(t *testing.T, env map[string]string) error {
+	t.Helper()
+	savedTLS, savedSecure := serverTLS, secureCookies
+	t.Cleanup(func() { serverTLS, secureCookies = savedTLS, savedSecure })
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	return loadTLSConfig()
+}
+
+// writeCertificate writes a self-signed key pair for commonName into dir.
+func writeCertificate(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"AUTH_TLS_CERT": "cert.pem"},
+		{"AUTH_HTTP_REDIRECT_ADDR": ":8080"},
+		{"AUTH_TLS_CERT": "cert.pem", "AUTH_TLS_KEY": "key.pem", "AUTH_HSTS_MAX_AGE": "-1"},
+		{"AUTH_TLS_RELOAD_INTERVAL": "often"},
+	} {
+		t.Run("", func(t *testing.T) {
+			if err := useTLSConfig(t, env); err == nil {
+				t.Errorf("%v accepted", env)
+			}
+		})
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		if err := useTLSConfig(t, nil); err != nil {
+			t.Fatal(err)
+		}
+		if serverTLS.HSTS != "" || secureCookies || serverTLS.CSP != defaultCSP {
+			t.Errorf("config = %+v, secureCookies = %v", serverTLS, secureCookies)
+		}
+	})
+	t.Run("behind a proxy", func(t *testing.T) {
+		if err := useTLSConfig(t, map[string]string{"AUTH_COOKIE_SECURE": "true"}); err != nil {
+			t.Fatal(err)
+		}
+		if serverTLS.HSTS != "" || !secureCookies {
+			t.Errorf("config = %+v, secureCookies = %v", serverTLS, secureCookies)
+		}
+	})
+	t.Run("TLS", func(t *testing.T) {
+		if err := useTLSConfig(t, map[string]string{"AUTH_TLS_CERT": "cert.pem", "AUTH_TLS_KEY": "key.pem", "AUTH_HSTS_MAX_AGE": "600"}); err != nil {
+			t.Fatal(err)
+		}
+		if serverTLS.HSTS != "max-age=600; includeSubDomains" || !secureCookies {
+			t.Errorf("config = %+v, secureCookies = %v", serverTLS, secureCookies)
+		}
+	})
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	resp := request(t, "GET", "/healthz", nil)
+	resp.Body.Close()
+	for header, want := range map[string]string{
+		fiber.HeaderXContentTypeOptions:     "nosniff",
+		fiber.HeaderXFrameOptions:           "DENY",
+		fiber.HeaderReferrerPolicy:          "strict-origin-when-cross-origin",
+		"Cross-Origin-Opener-Policy":        "same-origin",
+		fiber.HeaderContentSecurityPolicy:   defaultCSP,
+		fiber.HeaderStrictTransportSecurity: "",
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	if err := useTLSConfig(t, map[string]string{"AUTH_TLS_CERT": "cert.pem", "AUTH_TLS_KEY": "key.pem", "AUTH_CSP": "default-src 'none'"}); err != nil {
+		t.Fatal(err)
+	}
+	resp = request(t, "GET", "/healthz", nil)
+	resp.Body.Close()
+	if got := resp.Header.Get(fiber.HeaderStrictTransportSecurity); got != "max-age=31536000; includeSubDomains" {
+		t.Errorf("HSTS = %q", got)
+	}
+	if got := resp.Header.Get(fiber.HeaderContentSecurityPolicy); got != "default-src 'none'" {
+		t.Errorf("CSP = %q, want the one from AUTH_CSP", got)
+	}
+}
+
+func TestSecureCookies(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	resp := request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "correct horse"})
+	decode(t, resp, 200)
+	if cookie := sessionCookie(resp); cookie == nil || cookie.Secure || !cookie.HttpOnly {
+		t.Errorf("plain HTTP session cookie = %+v", cookie)
+	}
+
+	if err := useTLSConfig(t, map[string]string{"AUTH_COOKIE_SECURE": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	resp = request(t, "POST", "/api/login", fiber.Map{"username": username, "password": "correct horse"})
+	decode(t, resp, 200)
+	if cookie := sessionCookie(resp); cookie == nil || !cookie.Secure {
+		t.Errorf("session cookie = %+v, want Secure", cookie)
+	}
+	resp = request(t, "POST", "/api/logout", nil, sessionCookie(resp))
+	decode(t, resp, 200)
+	if cookie := sessionCookie(resp); cookie == nil || !cookie.Secure {
+		t.Errorf("logout cookie = %+v, want Secure", cookie)
+	}
+}
+
+func TestHTTPRedirect(t *testing.T) {
+	if serveRedirect(":443") != nil {
+		t.Fatal("redirect listener started without AUTH_HTTP_REDIRECT_ADDR")
+	}
+
+	for _, tc := range []struct {
+		httpsAddr, method, host, path string
+		status                        int
+		location                      string
+	}{
+		{":443", "GET", "auth.example.com", "/login?next=%2Fprofile", 301, "https://auth.example.com/login?next=%2Fprofile"},
+		{":8443", "HEAD", "auth.example.com:8080", "/", 301, "https://auth.example.com:8443/"},
+		{":8443", "POST", "auth.example.com", "/api/login", 308, "https://auth.example.com:8443/api/login"},
+	} {
+		redirectApp := fiber.New()
+		redirectApp.Use(redirectToHTTPS(tc.httpsAddr))
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Host = tc.host
+		resp, err := redirectApp.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || resp.Header.Get("Location") != tc.location {
+			t.Errorf("%s %s%s: %d to %q, want %d to %q", tc.method, tc.host, tc.path, resp.StatusCode, resp.Header.Get("Location"), tc.status, tc.location)
+		}
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "first")
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := r.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	writeCertificate(t, dir, "second")
+	if err := r.reload(); err != nil || commonName() != "second" {
+		t.Fatalf("after reload: %s (%v)", commonName(), err)
+	}
+
+	// A broken key pair leaves the last good certificate in place.
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Error("broken key pair loaded")
+	}
+	if got := commonName(); got != "second" {
+		t.Errorf("serving %s after a failed reload", got)
+	}
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("reloader started without a valid key pair")
+	}
+}
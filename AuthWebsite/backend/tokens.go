@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// API clients get a short-lived access token, accepted by authMiddleware as a bearer
+// token, and a refresh token that is rotated on every use. All refresh tokens issued
+// from one login form a family; presenting a token that was already used means it
+// leaked, so the whole family is revoked.
+
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+func loadTokenConfig() error {
+	var err error
+	if accessTokenTTL, err = time.ParseDuration(envOr("AUTH_ACCESS_TOKEN_TTL", "15m")); err != nil {
+		return err
+	}
+	refreshTokenTTL, err = time.ParseDuration(envOr("AUTH_REFRESH_TOKEN_TTL", "720h"))
+	return err
+}
+
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// insertRefreshToken stores a fresh refresh token in familyID. Only its hash is kept.
+func insertRefreshToken(tx *sql.Tx, familyID string) (string, error) {
+	refresh := generateToken()
+	_, err := tx.Exec("INSERT INTO refresh_tokens (token_hash, family_id, created_at) VALUES (?, ?, ?)",
+		hashToken(refresh), familyID, time.Now())
+	return refresh, err
+}
+
+// newTokenPair creates the access token to go with a committed refresh token. It is
+// bound to the client that asked for it, like a browser session.
+func newTokenPair(familyID, username, refresh string, binding clientBinding) tokenPair {
+	access, _ := createSession(session{Username: username, FamilyID: familyID, Binding: binding}, accessTokenTTL)
+	return tokenPair{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL / time.Second),
+		RefreshToken: refresh,
+	}
+}
+
+// startTokenFamily begins a new family after a password login.
+func startTokenFamily(username, client string, binding clientBinding) (tokenPair, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	defer tx.Rollback()
+
+	if len(client) > 255 {
+		client = client[:255]
+	}
+	familyID := generateID()
+	now := time.Now()
+	_, err = tx.Exec("INSERT INTO refresh_token_families (id, username, client, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		familyID, username, client, now, now.Add(refreshTokenTTL))
+	if err != nil {
+		return tokenPair{}, err
+	}
+	refresh, err := insertRefreshToken(tx, familyID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return tokenPair{}, err
+	}
+	return newTokenPair(familyID, username, refresh, binding), nil
+}
+
+// rotateRefreshToken exchanges refresh for a new token pair. Reuse of a spent token
+// revokes the family and returns errRefreshTokenReused along with the owner. A
+// refresh is a sign-in too, so an account that checkAccountUsable refuses gets the
+// error and keeps its refresh token unspent.
+func rotateRefreshToken(refresh string, binding clientBinding) (tokenPair, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return tokenPair{}, "", err
+	}
+	defer tx.Rollback()
+
+	var familyID, username string
+	var usedAt, revokedAt sql.NullTime
+	var expiresAt time.Time
+	err = tx.QueryRow(`SELECT t.family_id, t.used_at, f.username, f.expires_at, f.revoked_at
+            FROM refresh_tokens t JOIN refresh_token_families f ON f.id = t.family_id
+            WHERE t.token_hash = ?`, hashToken(refresh)).Scan(&familyID, &usedAt, &username, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return tokenPair{}, "", errInvalidCredentials
+	} else if err != nil {
+		return tokenPair{}, "", err
+	}
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return tokenPair{}, username, errInvalidCredentials
+	}
+	if err := checkAccountUsable(username); err != nil {
+		return tokenPair{}, username, err
+	}
+
+	// The conditional update makes concurrent uses of one token race for a single winner.
+	res, err := tx.Exec("UPDATE refresh_tokens SET used_at = ? WHERE token_hash = ? AND used_at IS NULL", time.Now(), hashToken(refresh))
+	if err != nil {
+		return tokenPair{}, "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 || usedAt.Valid {
+		tx.Rollback()
+		if err := revokeTokenFamily(familyID, "reuse"); err != nil {
+			return tokenPair{}, "", err
+		}
+		return tokenPair{}, username, errRefreshTokenReused
+	}
+
+	next, err := insertRefreshToken(tx, familyID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return tokenPair{}, "", err
+	}
+	return newTokenPair(familyID, username, next, binding), username, nil
+}
+
+// revokeTokenFamily invalidates every refresh token of the family and its live access tokens.
+func revokeTokenFamily(familyID, reason string) error {
+	_, err := db.Exec("UPDATE refresh_token_families SET revoked_at = ?, revoked_reason = ? WHERE id = ? AND revoked_at IS NULL",
+		time.Now(), reason, familyID)
+	if err != nil {
+		return err
+	}
+	revokeFamilySessions(familyID)
+	return nil
+}
+
+// revokeAllLogins signs username out everywhere: every refresh-token family and every session.
+func revokeAllLogins(username, reason string) error {
+	_, err := db.Exec("UPDATE refresh_token_families SET revoked_at = ?, revoked_reason = ? WHERE username = ? AND revoked_at IS NULL",
+		time.Now(), reason, username)
+	if err != nil {
+		return err
+	}
+	revokeUserSessions(username)
+	return nil
+}
+
+// revokeOtherLogins is revokeAllLogins except for the session behind keep and, if it
+// is an API access token, the refresh-token family it belongs to.
+func revokeOtherLogins(username, keep, reason string) error {
+	current, _ := lookupSession(keep)
+	_, err := db.Exec("UPDATE refresh_token_families SET revoked_at = ?, revoked_reason = ? WHERE username = ? AND id <> ? AND revoked_at IS NULL",
+		time.Now(), reason, username, current.FamilyID)
+	if err != nil {
+		return err
+	}
+	revokeOtherSessions(username, keep)
+	return nil
+}
+
+// tokenHandler is an OAuth2-style token endpoint supporting the password and
+// refresh_token grants. It accepts JSON or form-encoded bodies.
+func tokenHandler(c *fiber.Ctx) error {
+	var data struct {
+		GrantType    string `json:"grant_type" form:"grant_type"`
+		Username     string `json:"username" form:"username"`
+		Password     string `json:"password" form:"password"`
+		RefreshToken string `json:"refresh_token" form:"refresh_token"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	switch data.GrantType {
+	case "password":
+		id, err := authenticate(c.Context(), authChain, data.Username, data.Password)
+		if errors.Is(err, errUnknownUser) || errors.Is(err, errInvalidCredentials) {
+			loginAttempts.WithLabelValues("failure", "bad_password").Inc()
+			audit(data.Username, "login_failure", c.IP(), "token endpoint")
+			return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+		} else if errors.Is(err, errPasswordResetRequired) {
+			loginAttempts.WithLabelValues("failure", "reset_required").Inc()
+			return c.Status(403).JSON(fiber.Map{"error": "Password reset required"})
+		} else if err != nil {
+			loginAttempts.WithLabelValues("failure", "backend_error").Inc()
+			return c.Status(503).JSON(fiber.Map{"error": "Authentication service unavailable"})
+		}
+		if err := provisionUser(id); err != nil {
+			return c.Status(403).JSON(fiber.Map{"error": "Account cannot be used with this sign-in method"})
+		}
+		if err := checkSignIn(id.Username); err != nil {
+			return sessionRefused(c, err)
+		}
+		pair, err := startTokenFamily(id.Username, c.Get(fiber.HeaderUserAgent), requestBinding(c))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		}
+		checkDevice(c, id.Username)
+		loginAttempts.WithLabelValues("success", "").Inc()
+		audit(id.Username, "login", c.IP(), "token")
+		emitEvent(eventUserLoggedIn, fiber.Map{"username": id.Username, "ip": c.IP(), "method": "token"})
+		return c.JSON(pair)
+
+	case "refresh_token":
+		pair, username, err := rotateRefreshToken(data.RefreshToken, requestBinding(c))
+		switch {
+		case errors.Is(err, errRefreshTokenReused):
+			audit(username, "refresh_token_reuse", c.IP(), "token family revoked")
+			return c.Status(401).JSON(fiber.Map{"error": "Refresh token has already been used"})
+		case errors.Is(err, errInvalidCredentials):
+			return c.Status(401).JSON(fiber.Map{"error": "Invalid refresh token"})
+		case err != nil:
+			return sessionRefused(c, err)
+		}
+		return c.JSON(pair)
+	}
+	return c.Status(400).JSON(fiber.Map{"error": "Unsupported grant_type"})
+}
+
+// revokeTokenHandler revokes the family of a refresh token. Like RFC 7009 it answers
+// success for unknown tokens so that callers cannot probe for valid ones.
+func revokeTokenHandler(c *fiber.Ctx) error {
+	var data struct {
+		RefreshToken string `json:"refresh_token" form:"refresh_token"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	var familyID, username string
+	err := db.QueryRow(`SELECT t.family_id, f.username FROM refresh_tokens t
+            JOIN refresh_token_families f ON f.id = t.family_id WHERE t.token_hash = ?`,
+		hashToken(data.RefreshToken)).Scan(&familyID, &username)
+	if err == nil {
+		err = revokeTokenFamily(familyID, "revoked")
+		audit(username, "refresh_token_revoke", c.IP(), "")
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(fiber.Map{"message": "Token revoked"})
+}
+
+// exportTokenFamilies lists refresh-token families for the personal-data export.
+func exportTokenFamilies(username string) (any, error) {
+	rows, err := db.Query(`SELECT id, client, created_at, expires_at, revoked_at, revoked_reason
+            FROM refresh_token_families WHERE username = ? ORDER BY created_at`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type family struct {
+		ID            string     `json:"id"`
+		Client        string     `json:"client"`
+		CreatedAt     time.Time  `json:"created_at"`
+		ExpiresAt     time.Time  `json:"expires_at"`
+		RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+		RevokedReason string     `json:"revoked_reason,omitempty"`
+	}
+	result := []family{}
+	for rows.Next() {
+		var f family
+		var revokedAt sql.NullTime
+		var reason sql.NullString
+		if err := rows.Scan(&f.ID, &f.Client, &f.CreatedAt, &f.ExpiresAt, &revokedAt, &reason); err != nil {
+			return nil, err
+		}
+		if revokedAt.Valid {
+			f.RevokedAt = &revokedAt.Time
+		}
+		f.RevokedReason = reason.String
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
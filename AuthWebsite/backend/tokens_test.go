@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// tokenLogin signs in through the password grant and returns the refresh token.
+func tokenLogin(t *testing.T, username, password string) string {
+	t.Helper()
+	pair := decode(t, request(t, "POST", "/api/token", fiber.Map{"grant_type": "password", "username": username, "password": password}), 200)
+	refresh, _ := pair["refresh_token"].(string)
+	if refresh == "" {
+		t.Fatalf("token response without refresh token: %v", pair)
+	}
+	return refresh
+}
+
+func refresh(t *testing.T, token string, status int) map[string]any {
+	t.Helper()
+	return decode(t, request(t, "POST", "/api/token", fiber.Map{"grant_type": "refresh_token", "refresh_token": token}), status)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	first := tokenLogin(t, username, "correct horse")
+
+	second := refresh(t, first, 200)["refresh_token"].(string)
+	if second == first {
+		t.Fatal("refresh token did not rotate")
+	}
+	// Reuse of a rotated token revokes the whole family.
+	refresh(t, first, 401)
+	refresh(t, second, 401)
+}
+
+func TestRefreshChecksAccount(t *testing.T) {
+	tests := []struct {
+		name  string
+		apply func(t *testing.T, username string)
+		error string
+	}{
+		{"disabled", func(t *testing.T, username string) {
+			if _, err := db.Exec("UPDATE users SET active = 0 WHERE username = ?", username); err != nil {
+				t.Fatal(err)
+			}
+		}, "Account is disabled"},
+		{"reset required", func(t *testing.T, username string) {
+			if _, err := db.Exec("UPDATE users SET password_reset_required = 1 WHERE username = ?", username); err != nil {
+				t.Fatal(err)
+			}
+		}, "Password reset required"},
+		{"password expired", func(t *testing.T, username string) {
+			saved := passwordPolicy
+			passwordPolicy = passwordPolicyConfig{MaxAge: time.Hour, ExpiringRoles: map[string]bool{"user": true}}
+			t.Cleanup(func() { passwordPolicy = saved })
+			if _, err := db.Exec("UPDATE users SET password_changed_at = ? WHERE username = ?", time.Now().Add(-2*time.Hour), username); err != nil {
+				t.Fatal(err)
+			}
+		}, "Password expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username := newUsername()
+			register(t, username, "correct horse")
+			token := tokenLogin(t, username, "correct horse")
+			tt.apply(t, username)
+			if data := refresh(t, token, 403); data["error"] != tt.error {
+				t.Errorf("error = %v, want %q", data["error"], tt.error)
+			}
+			// The refused refresh neither issued an access token nor spent the refresh token.
+			if n := len(userSessions(username)); n != 1 {
+				t.Errorf("%d access tokens, want 1", n)
+			}
+			var used sql.NullTime
+			if err := db.QueryRow("SELECT used_at FROM refresh_tokens WHERE token_hash = ?", hashToken(token)).Scan(&used); err != nil || used.Valid {
+				t.Errorf("refresh token used at %v, %v", used, err)
+			}
+		})
+	}
+}
+
+func TestPasswordChangeRevokesOtherLogins(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	token := tokenLogin(t, username, "correct horse")
+	other := login(t, username, "correct horse")
+	current := login(t, username, "correct horse")
+
+	body := fiber.Map{"current_password": "correct horse", "new_password": "battery staple"}
+	decode(t, request(t, "POST", "/api/account/password", body, current), 200)
+	decode(t, request(t, "GET", "/api/profile", nil, current), 200)
+	decode(t, request(t, "GET", "/api/profile", nil, other), 401)
+	refresh(t, token, 401)
+}
+
+// TestPasswordGrantDevice checks that the password grant, like a browser sign-in,
+// alerts about a new device and binds the access token to the client.
+func TestPasswordGrantDevice(t *testing.T) {
+	saved := deviceTracking
+	deviceTracking = deviceSensitivities["medium"]
+	t.Cleanup(func() { deviceTracking = saved })
+	useBindingMode(t, "strict")
+	notes := useRecordingNotifier(t)
+	username := newUsername()
+	email := username + "@example.com"
+	register(t, username, "correct horse")
+	decode(t, request(t, "PATCH", "/api/profile", fiber.Map{"email": email}, login(t, username, "correct horse")), 200)
+
+	req := httptest.NewRequest("POST", "/api/token", strings.NewReader(`{"grant_type":"password","username":"`+username+`","password":"correct horse"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", otherBrowser)
+	resp, err := testApp.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, _ := decode(t, resp, 200)["access_token"].(string)
+	if n := notes.waitFor(t, email); !strings.Contains(n.Body, "not-me=") {
+		t.Errorf("new-device notification = %+v", n)
+	}
+
+	profile := func(userAgent string) *http.Response {
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+access)
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := testApp.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	decode(t, profile(otherBrowser), 200)
+	decode(t, profile("curl/8.5.0"), 401)
+	if _, ok := lookupSession(access); ok {
+		t.Error("access token survived use from another client")
+	}
+}
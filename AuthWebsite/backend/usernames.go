@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Usernames are displayed as chosen but compared by a canonical key: the NFKC
+// normalized, case-folded name. The key is unique, so "Alice" and "alice" cannot
+// both exist, and logins find the account whatever the case. New names must also
+// pass the PRECIS UsernameCasePreserved profile (RFC 8265), must not be reserved and
+// must not share a confusable skeleton with another account, so that "аlice" with a
+// Cyrillic "а" cannot pose as "alice".
+
+var (
+	errInvalidUsername    = errors.New("invalid username")
+	errReservedUsername   = errors.New("reserved username")
+	errConfusableUsername = errors.New("username is confusable with an existing account")
+)
+
+var reservedUsernames = []string{
+	"admin", "administrator", "root", "system", "api", "www", "mail", "support", "help",
+	"security", "abuse", "postmaster", "hostmaster", "webmaster", "noreply", "no-reply",
+	"login", "logout", "register", "signup", "account", "settings", "me", "self",
+	"null", "undefined", "anonymous", "guest", "moderator", "staff", "official",
+}
+
+// reservedSkeletons holds the skeletons of reserved names, so their look-alikes are
+// reserved as well.
+var reservedSkeletons map[string]bool
+
+// loadReservedUsernames adds the comma-separated AUTH_RESERVED_USERNAMES to the
+// built-in list.
+func loadReservedUsernames() {
+	names := append([]string{}, reservedUsernames...)
+	names = append(names, strings.Split(envOr("AUTH_RESERVED_USERNAMES", ""), ",")...)
+	reservedSkeletons = map[string]bool{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			reservedSkeletons[usernameSkeleton(usernameKey(name))] = true
+		}
+	}
+}
+
+// usernameKey returns the canonical form used for uniqueness and lookups.
+func usernameKey(name string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(name)))
+}
+
+// confusables maps characters to the Latin letters they are commonly mistaken
+// for. It is the part of the Unicode confusables data (UTS #39) that matters for
+// case-folded identifiers; compatibility forms are already folded by NFKC.
+var confusables = map[rune]string{
+	// Cyrillic
+	'а': "a", 'ԁ': "d", 'е': "e", 'һ': "h", 'і': "i", 'ј': "j", 'к': "k", 'ӏ': "l",
+	'о': "o", 'р': "p", 'ԛ': "q", 'ѕ': "s", 'ѵ': "v", 'ԝ': "w", 'х': "x", 'у': "y", 'ү': "y",
+	// Greek
+	'α': "a", 'β': "b", 'ϲ': "c", 'η': "n", 'ι': "i", 'ϳ': "j", 'κ': "k", 'ν': "v",
+	'ο': "o", 'ρ': "p", 'υ': "u", 'χ': "x", 'γ': "y", 'ω': "w",
+	// Armenian
+	'հ': "h", 'ո': "n", 'ս': "u", 'օ': "o", 'ց': "g",
+	// Latin look-alikes
+	'ı': "i", 'ɩ': "i", 'ǀ': "l", 'ɡ': "g", 'ɑ': "a", 'ʀ': "r", 'ʏ': "y",
+	// Digits and letter sequences
+	'0': "o", '1': "l", 'm': "rn",
+}
+
+// usernameSkeleton maps a username key to its UTS #39 style skeleton: two names
+// with the same skeleton look alike.
+func usernameSkeleton(key string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(key) {
+		if s, ok := confusables[r]; ok {
+			b.WriteString(s)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return norm.NFD.String(b.String())
+}
+
+// normalizeUsername enforces the PRECIS UsernameCasePreserved profile on a name
+// chosen by a user and returns it in that form.
+func normalizeUsername(name string) (string, error) {
+	enforced, err := precis.UsernameCasePreserved.String(name)
+	if err != nil || enforced == "" || len(enforced) > 255 {
+		return "", errInvalidUsername
+	}
+	return enforced, nil
+}
+
+// checkNewUsername refuses reserved names and names that look like another
+// account's. current is the account being renamed, or "" for a new one.
+func checkNewUsername(name, current string) error {
+	skeleton := usernameSkeleton(usernameKey(name))
+	if reservedSkeletons[skeleton] || strings.HasPrefix(skeleton, "deleted-user-") {
+		return errReservedUsername
+	}
+	var other string
+	err := db.QueryRow("SELECT username FROM users WHERE username_skeleton = ? AND username_canonical <> ? AND username <> ? LIMIT 1",
+		skeleton, usernameKey(name), current).Scan(&other)
+	if err == nil {
+		return errConfusableUsername
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// usernameRejection maps a checkNewUsername error to the response status and
+// message. It returns status 0 when the name is acceptable.
+func usernameRejection(err error) (int, string) {
+	switch err {
+	case nil:
+		return 0, ""
+	case errReservedUsername:
+		return 400, "Username is reserved"
+	case errConfusableUsername:
+		return 409, "Username is too similar to an existing account"
+	}
+	return 500, "DB error"
+}
+
+// resolveUsername returns the stored spelling of the account whose key matches
+// name, or name itself when there is none.
+func resolveUsername(name string) string {
+	var stored string
+	if err := db.QueryRow("SELECT username FROM users WHERE username_canonical = ?", usernameKey(name)).Scan(&stored); err != nil {
+		return name
+	}
+	return stored
+}
+
+// backfillUsernameKeys fills in the keys of accounts created before they existed.
+// Accounts whose key is already taken by an older account keep a NULL key and are
+// logged, since only an admin can decide which of the two to rename.
+func backfillUsernameKeys(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, username FROM users WHERE username_canonical IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	type user struct {
+		id   int64
+		name string
+	}
+	var pending []user
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.id, &u.name); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range pending {
+		key := usernameKey(u.name)
+		_, err := db.Exec("UPDATE users SET username_canonical = ?, username_skeleton = ? WHERE id = ?", key, usernameSkeleton(key), u.id)
+		if isDuplicateKey(err) {
+			log.Printf("username %q collides with another account after normalization; rename one of them", u.name)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDuplicateKey reports a MySQL unique constraint violation.
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
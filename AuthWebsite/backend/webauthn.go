@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebAuthn relying-party logic: challenge handling plus verification of registration
+// (attestation "none" and "packed") and authentication ceremonies. The HTTP
+// handlers live in webauthn_handlers.go.
+
+// COSE algorithm identifiers we accept.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+const challengeTTL = 5 * time.Minute
+
+// maxPendingChallenges bounds the challenge store, which anyone can add to by
+// starting a passkey login.
+const maxPendingChallenges = 10000
+
+type relyingParty struct {
+	ID     string // effective domain, e.g. "localhost"
+	Name   string
+	Origin string // expected clientData origin, e.g. "http://localhost:8080"
+}
+
+func loadRelyingParty() relyingParty {
+	return relyingParty{
+		ID:     envOr("AUTH_WEBAUTHN_RP_ID", "localhost"),
+		Name:   envOr("AUTH_WEBAUTHN_RP_NAME", "AuthWebsite"),
+		Origin: envOr("AUTH_WEBAUTHN_ORIGIN", "http://localhost:8080"),
+	}
+}
+
+var rp relyingParty
+
+type pendingChallenge struct {
+	Username  string // empty for discoverable-credential logins
+	Ceremony  string // "webauthn.create" or "webauthn.get"
+	ExpiresAt time.Time
+}
+
+var (
+	challenges   = make(map[string]pendingChallenge)
+	challengesMu sync.Mutex
+)
+
+var errTooManyChallenges = errors.New("too many pending challenges")
+
+// newChallenge issues a single-use challenge for ceremony.
+func newChallenge(username, ceremony string) (string, error) {
+	challenge := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+	if len(challenges) >= maxPendingChallenges {
+		return "", errTooManyChallenges
+	}
+	challenges[challenge] = pendingChallenge{Username: username, Ceremony: ceremony, ExpiresAt: time.Now().Add(challengeTTL)}
+	return challenge, nil
+}
+
+// expireChallenges drops the challenges that were never answered.
+func expireChallenges(now time.Time) {
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+	for c, p := range challenges {
+		if now.After(p.ExpiresAt) {
+			delete(challenges, c)
+		}
+	}
+}
+
+// takeChallenge consumes challenge; a challenge can be answered only once.
+func takeChallenge(challenge, ceremony string) (pendingChallenge, bool) {
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+	p, ok := challenges[challenge]
+	delete(challenges, challenge)
+	if !ok || p.Ceremony != ceremony || time.Now().After(p.ExpiresAt) {
+		return pendingChallenge{}, false
+	}
+	return p, true
+}
+
+// decodeB64URL accepts base64url with or without padding, as browsers and libraries differ.
+func decodeB64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// parseClientData checks the type and origin of clientDataJSON. The challenge is
+// returned for the caller to look up.
+func (rp relyingParty) parseClientData(raw []byte, ceremony string) (collectedClientData, error) {
+	var cd collectedClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return cd, errors.New("malformed clientDataJSON")
+	}
+	if cd.Type != ceremony {
+		return cd, fmt.Errorf("unexpected ceremony type %q", cd.Type)
+	}
+	if cd.Origin != rp.Origin || cd.CrossOrigin {
+		return cd, fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+	return cd, nil
+}
+
+type authenticatorData struct {
+	Raw          []byte
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key, only present during registration
+}
+
+// maxCredentialIDLength is the longest credential ID WebAuthn allows, and the width
+// of the credential_id column.
+const maxCredentialIDLength = 1023
+
+func parseAuthenticatorData(b []byte) (authenticatorData, error) {
+	if len(b) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	ad := authenticatorData{Raw: b, RPIDHash: b[:32], Flags: b[32], SignCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.Flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	rest := b[37:]
+	if len(rest) < 18 {
+		return ad, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	if idLen > maxCredentialIDLength {
+		return ad, errors.New("credential ID too long")
+	}
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return ad, errors.New("credential ID truncated")
+	}
+	ad.CredentialID, rest = rest[:idLen], rest[idLen:]
+	_, after, err := cborDecode(rest)
+	if err != nil {
+		return ad, fmt.Errorf("credential public key: %w", err)
+	}
+	ad.PublicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+// checkRP verifies the RP ID hash and the user-present and user-verified flags. A
+// passkey stands in for the password, so an authenticator that did not verify the
+// user (PIN or biometric) would make the sign-in single-factor.
+func (rp relyingParty) checkRP(ad authenticatorData) error {
+	want := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.RPIDHash, want[:]) {
+		return errors.New("RP ID hash mismatch")
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return errors.New("user presence flag not set")
+	}
+	if ad.Flags&flagUserVerified == 0 {
+		return errors.New("user verification flag not set")
+	}
+	return nil
+}
+
+// parseCOSEKey returns the algorithm and public key of a COSE_Key (RFC 9053).
+func parseCOSEKey(raw []byte) (int64, crypto.PublicKey, error) {
+	v, _, err := cborDecode(raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return 0, nil, errors.New("COSE key is not a map")
+	}
+	alg, _ := m[int64(3)].(int64)
+	bytesAt := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+
+	switch alg {
+	case coseES256:
+		x, y := bytesAt(-2), bytesAt(-3)
+		if crv, _ := m[int64(-1)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("unsupported EC2 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return 0, nil, errors.New("EC2 point is not on the curve")
+		}
+		return alg, key, nil
+	case coseRS256:
+		n, e := bytesAt(-1), bytesAt(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, errors.New("unsupported RSA key")
+		}
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case coseEdDSA:
+		x := bytesAt(-2)
+		if crv, _ := m[int64(-1)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("unsupported OKP key")
+		}
+		return alg, ed25519.PublicKey(x), nil
+	}
+	return 0, nil, fmt.Errorf("unsupported COSE algorithm %d", alg)
+}
+
+func verifySignature(alg int64, pub crypto.PublicKey, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if alg == coseES256 && ecdsa.VerifyASN1(key, digest[:], sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if alg == coseRS256 {
+			if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err == nil {
+				return nil
+			}
+		}
+	case ed25519.PublicKey:
+		if alg == coseEdDSA && ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	}
+	return errors.New("signature verification failed")
+}
+
+// registeredCredential is what a successful registration ceremony yields.
+type registeredCredential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+	Format    string
+}
+
+// verifyAttestation validates a registration response against the clientDataJSON
+// challenge (already matched by the caller) and returns the new credential.
+func (rp relyingParty) verifyAttestation(clientDataJSON, attestationObject []byte) (registeredCredential, error) {
+	v, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return registeredCredential{}, fmt.Errorf("attestation object: %w", err)
+	}
+	obj, ok := v.(map[any]any)
+	if !ok {
+		return registeredCredential{}, errors.New("attestation object is not a map")
+	}
+	format, _ := obj["fmt"].(string)
+	attStmt, _ := obj["attStmt"].(map[any]any)
+	rawAuthData, _ := obj["authData"].([]byte)
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return registeredCredential{}, err
+	}
+	if err := rp.checkRP(ad); err != nil {
+		return registeredCredential{}, err
+	}
+	if ad.Flags&flagAttestedData == 0 || len(ad.CredentialID) == 0 {
+		return registeredCredential{}, errors.New("no attested credential data")
+	}
+	alg, pub, err := parseCOSEKey(ad.PublicKey)
+	if err != nil {
+		return registeredCredential{}, err
+	}
+
+	switch format {
+	case "none":
+		if len(attStmt) != 0 {
+			return registeredCredential{}, errors.New("attestation statement must be empty for \"none\"")
+		}
+	case "packed":
+		if err := verifyPackedAttestation(attStmt, alg, pub, rawAuthData, clientDataJSON); err != nil {
+			return registeredCredential{}, err
+		}
+	default:
+		return registeredCredential{}, fmt.Errorf("unsupported attestation format %q", format)
+	}
+
+	return registeredCredential{ID: ad.CredentialID, PublicKey: ad.PublicKey, SignCount: ad.SignCount, Format: format}, nil
+}
+
+// verifyPackedAttestation checks the statement signature over authData||hash(clientData),
+// either with the attestation certificate or, for self attestation, the credential key.
+// The certificate's trust chain is not evaluated since we do not restrict authenticator models.
+func verifyPackedAttestation(attStmt map[any]any, credAlg int64, credKey crypto.PublicKey, authData, clientDataJSON []byte) error {
+	alg, _ := attStmt["alg"].(int64)
+	sig, _ := attStmt["sig"].([]byte)
+	if len(sig) == 0 {
+		return errors.New("packed attestation without signature")
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+
+	x5c, hasCert := attStmt["x5c"].([]any)
+	if !hasCert {
+		if alg != credAlg {
+			return errors.New("self attestation algorithm does not match credential")
+		}
+		return verifySignature(alg, credKey, signed, sig)
+	}
+
+	if len(x5c) == 0 {
+		return errors.New("empty attestation certificate chain")
+	}
+	der, _ := x5c[0].([]byte)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("attestation certificate: %w", err)
+	}
+	if cert.IsCA {
+		return errors.New("attestation certificate must not be a CA")
+	}
+	return verifySignature(alg, cert.PublicKey, signed, sig)
+}
+
+// verifyAssertion checks an authentication response for a stored credential and
+// returns the authenticator's new signature counter.
+func (rp relyingParty) verifyAssertion(publicKey []byte, storedCount uint32, clientDataJSON, rawAuthData, sig []byte) (uint32, error) {
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.checkRP(ad); err != nil {
+		return 0, err
+	}
+	alg, pub, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if err := verifySignature(alg, pub, append(append([]byte{}, rawAuthData...), clientDataHash[:]...), sig); err != nil {
+		return 0, err
+	}
+	// Authenticators without a counter always report zero; otherwise it must grow,
+	// or the credential may have been cloned.
+	if (ad.SignCount != 0 || storedCount != 0) && ad.SignCount <= storedCount {
+		return 0, errSignCountRegressed
+	}
+	return ad.SignCount, nil
+}
+
+var errSignCountRegressed = errors.New("signature counter did not increase")
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type webauthnCredential struct {
+	ID         string     `json:"id"` // base64url credential ID
+	Name       string     `json:"name"`
+	Format     string     `json:"attestation_format"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func listCredentials(username string) ([]webauthnCredential, error) {
+	rows, err := db.Query("SELECT credential_id, name, format, created_at, last_used_at FROM webauthn_credentials WHERE username = ? ORDER BY created_at", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	creds := []webauthnCredential{}
+	for rows.Next() {
+		var cred webauthnCredential
+		var id []byte
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&id, &cred.Name, &cred.Format, &cred.CreatedAt, &lastUsed); err != nil {
+			return nil, err
+		}
+		cred.ID = base64.RawURLEncoding.EncodeToString(id)
+		if lastUsed.Valid {
+			cred.LastUsedAt = &lastUsed.Time
+		}
+		creds = append(creds, cred)
+	}
+	return creds, rows.Err()
+}
+
+// beginPasskeyRegistrationHandler returns PublicKeyCredentialCreationOptions for the
+// logged-in user after re-authentication, since a passkey is a permanent way into the
+// account. The challenge is what ties the finish step to this confirmation.
+func beginPasskeyRegistrationHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		Password string `json:"password"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&data); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+	if err := reauthenticate(c, username, data.Password); err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	var userID int64
+	if err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	creds, err := listCredentials(username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	exclude := []fiber.Map{}
+	for _, cred := range creds {
+		exclude = append(exclude, fiber.Map{"type": "public-key", "id": cred.ID})
+	}
+	challenge, err := newChallenge(username, "webauthn.create")
+	if err != nil {
+		return c.Status(503).JSON(fiber.Map{"error": "Too many pending passkey ceremonies, try again later"})
+	}
+
+	return c.JSON(fiber.Map{
+		"challenge": challenge,
+		"rp":        fiber.Map{"id": rp.ID, "name": rp.Name},
+		"user": fiber.Map{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(userID, 10))),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams": []fiber.Map{
+			{"type": "public-key", "alg": coseES256},
+			{"type": "public-key", "alg": coseEdDSA},
+			{"type": "public-key", "alg": coseRS256},
+		},
+		"timeout":            int(challengeTTL / time.Millisecond),
+		"attestation":        "none",
+		"excludeCredentials": exclude,
+		"authenticatorSelection": fiber.Map{
+			"residentKey":      "preferred",
+			"userVerification": "required",
+		},
+	})
+}
+
+func finishPasskeyRegistrationHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	var data struct {
+		Name     string `json:"name"`
+		Response struct {
+			ClientDataJSON    string `json:"clientDataJSON"`
+			AttestationObject string `json:"attestationObject"`
+		} `json:"response"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	clientDataJSON, err1 := decodeB64URL(data.Response.ClientDataJSON)
+	attestationObject, err2 := decodeB64URL(data.Response.AttestationObject)
+	if err1 != nil || err2 != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if utf8.RuneCountInString(data.Name) > 255 {
+		return c.Status(400).JSON(fiber.Map{"error": "Passkey name is too long"})
+	}
+
+	cd, err := rp.parseClientData(clientDataJSON, "webauthn.create")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Passkey registration failed: " + err.Error()})
+	}
+	if pending, ok := takeChallenge(cd.Challenge, "webauthn.create"); !ok || pending.Username != username {
+		return c.Status(400).JSON(fiber.Map{"error": "Passkey registration failed: unknown or expired challenge"})
+	}
+	cred, err := rp.verifyAttestation(clientDataJSON, attestationObject)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Passkey registration failed: " + err.Error()})
+	}
+
+	if data.Name == "" {
+		data.Name = "Passkey"
+	}
+	_, err = db.Exec(`INSERT INTO webauthn_credentials (credential_id, username, name, public_key, sign_count, format, created_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?)`, cred.ID, username, data.Name, cred.PublicKey, cred.SignCount, cred.Format, time.Now())
+	if isDuplicateKey(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "Passkey is already registered"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	audit(username, "passkey_register", c.IP(), data.Name)
+	return c.JSON(fiber.Map{"message": "Passkey registered", "id": base64.RawURLEncoding.EncodeToString(cred.ID)})
+}
+
+// beginPasskeyLoginHandler returns PublicKeyCredentialRequestOptions. Without a
+// username the browser offers any discoverable credential for this RP.
+func beginPasskeyLoginHandler(c *fiber.Ctx) error {
+	var data struct {
+		Username string `json:"username"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&data); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+
+	allow := []fiber.Map{}
+	if data.Username != "" {
+		data.Username = resolveUsername(data.Username)
+		creds, err := listCredentials(data.Username)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		}
+		for _, cred := range creds {
+			allow = append(allow, fiber.Map{"type": "public-key", "id": cred.ID})
+		}
+	}
+	challenge, err := newChallenge(data.Username, "webauthn.get")
+	if err != nil {
+		return c.Status(503).JSON(fiber.Map{"error": "Too many pending passkey ceremonies, try again later"})
+	}
+
+	return c.JSON(fiber.Map{
+		"challenge":        challenge,
+		"rpId":             rp.ID,
+		"timeout":          int(challengeTTL / time.Millisecond),
+		"allowCredentials": allow,
+		"userVerification": "required",
+	})
+}
+
+// finishPasskeyLoginHandler verifies an assertion and starts the same session as loginHandler.
+func finishPasskeyLoginHandler(c *fiber.Ctx) error {
+	var data struct {
+		RawID    string `json:"rawId"`
+		Response struct {
+			ClientDataJSON    string `json:"clientDataJSON"`
+			AuthenticatorData string `json:"authenticatorData"`
+			Signature         string `json:"signature"`
+		} `json:"response"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		loginAttempts.WithLabelValues("failure", "invalid_request").Inc()
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	credID, err1 := decodeB64URL(data.RawID)
+	clientDataJSON, err2 := decodeB64URL(data.Response.ClientDataJSON)
+	authData, err3 := decodeB64URL(data.Response.AuthenticatorData)
+	sig, err4 := decodeB64URL(data.Response.Signature)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		loginAttempts.WithLabelValues("failure", "invalid_request").Inc()
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	cd, err := rp.parseClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		loginAttempts.WithLabelValues("failure", "passkey_invalid").Inc()
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+	pending, ok := takeChallenge(cd.Challenge, "webauthn.get")
+	if !ok {
+		loginAttempts.WithLabelValues("failure", "passkey_challenge").Inc()
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	var username string
+	var publicKey []byte
+	var storedCount uint32
+	err = db.QueryRow("SELECT username, public_key, sign_count FROM webauthn_credentials WHERE credential_id = ?", credID).
+		Scan(&username, &publicKey, &storedCount)
+	if err != nil || (pending.Username != "" && pending.Username != username) {
+		loginAttempts.WithLabelValues("failure", "passkey_unknown").Inc()
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	count, err := rp.verifyAssertion(publicKey, storedCount, clientDataJSON, authData, sig)
+	if err == errSignCountRegressed {
+		loginAttempts.WithLabelValues("failure", "passkey_counter").Inc()
+		audit(username, "passkey_counter_regressed", c.IP(), data.RawID)
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	} else if err != nil {
+		loginAttempts.WithLabelValues("failure", "passkey_invalid").Inc()
+		audit(username, "login_failure", c.IP(), "passkey: "+err.Error())
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+
+	res, err := db.Exec("UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ? WHERE credential_id = ? AND sign_count = ?",
+		count, time.Now(), credID, storedCount)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	// A concurrent login moved the counter on first: two assertions carried counters
+	// based on the same value, so one of them came from a clone. Counter-less
+	// authenticators always report zero and cannot race.
+	if n, _ := res.RowsAffected(); n == 0 && count != 0 {
+		loginAttempts.WithLabelValues("failure", "passkey_counter").Inc()
+		audit(username, "passkey_counter_regressed", c.IP(), data.RawID)
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+	if err := startSession(c, username, "passkey"); err != nil {
+		return sessionRefused(c, err)
+	}
+	return c.JSON(fiber.Map{"message": "Login successful"})
+}
+
+func listPasskeysHandler(c *fiber.Ctx) error {
+	creds, err := listCredentials(c.Locals("username").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(fiber.Map{"passkeys": creds})
+}
+
+// deletePasskeyHandler removes a passkey unless it is the account's last way to sign in.
+func deletePasskeyHandler(c *fiber.Ctx) error {
+	username := c.Locals("username").(string)
+	credID, err := decodeB64URL(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	hasPassword, links, passkeys, err := signInMethods(username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if !hasPassword && links == 0 && passkeys <= 1 {
+		return c.Status(409).JSON(fiber.Map{"error": "Cannot remove your only way to sign in"})
+	}
+
+	res, err := db.Exec("DELETE FROM webauthn_credentials WHERE credential_id = ? AND username = ?", credID, username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Passkey not found"})
+	}
+	audit(username, "passkey_delete", c.IP(), c.Params("id"))
+	return c.JSON(fiber.Map{"message": "Passkey removed"})
+}
+
+// exportPasskeys lists the user's passkeys for the personal-data export.
+func exportPasskeys(username string) (any, error) {
+	return listCredentials(username)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// cborPair is one entry of a CBOR map; maps keep their order so that encodings are
+// deterministic.
+type cborPair struct {
+	Key, Value any
+}
+
+// cborEncode writes the subset of CBOR that WebAuthn messages use.
+func cborEncode(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []any:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, cborEncode(item)...)
+		}
+		return out
+	case []cborPair:
+		out := head(5, uint64(len(v)))
+		for _, p := range v {
+			out = append(out, cborEncode(p.Key)...)
+			out = append(out, cborEncode(p.Value)...)
+		}
+		return out
+	}
+	panic("cborEncode: unsupported type")
+}
+
+// softAuthenticator is an ES256 authenticator in software.
+type softAuthenticator struct {
+	key     *ecdsa.PrivateKey
+	id      []byte
+	counter uint32 // last value reported; stays 0 for an authenticator without a counter
+	counts  bool
+	// presenceOnly reports user presence without user verification, like a
+	// security key without a PIN.
+	presenceOnly bool
+}
+
+func newSoftAuthenticator(t *testing.T, counts bool) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, id: randomBytes(16), counts: counts}
+}
+
+func (a *softAuthenticator) rawID() string {
+	return base64.RawURLEncoding.EncodeToString(a.id)
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	return cborEncode([]cborPair{
+		{1, 2},         // kty: EC2
+		{3, coseES256}, // alg
+		{-1, 1},        // crv: P-256
+		{-2, a.key.X.FillBytes(make([]byte, 32))},
+		{-3, a.key.Y.FillBytes(make([]byte, 32))},
+	})
+}
+
+// authData builds authenticator data reporting counter; registration adds the
+// attested credential.
+func (a *softAuthenticator) authData(counter uint32, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	flags := byte(flagUserPresent | flagUserVerified)
+	if a.presenceOnly {
+		flags = flagUserPresent
+	}
+	if attested {
+		flags |= flagAttestedData
+	}
+	b := append(rpIDHash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, counter)
+	if attested {
+		b = append(b, make([]byte, 16)...) // AAGUID
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, a.coseKey()...)
+	}
+	return b
+}
+
+func (a *softAuthenticator) sign(authData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+func clientData(ceremony, challenge, origin string) []byte {
+	raw, _ := json.Marshal(collectedClientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	return raw
+}
+
+// attest answers a registration challenge with a "none" or self "packed" attestation.
+func (a *softAuthenticator) attest(challenge, format string) fiber.Map {
+	cd := clientData("webauthn.create", challenge, rp.Origin)
+	authData := a.authData(a.counter, true)
+	attStmt := []cborPair{}
+	if format == "packed" {
+		attStmt = []cborPair{{"alg", coseES256}, {"sig", a.sign(authData, cd)}}
+	}
+	obj := cborEncode([]cborPair{{"fmt", format}, {"attStmt", attStmt}, {"authData", authData}})
+	return fiber.Map{"name": "Test key", "response": fiber.Map{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(cd),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(obj),
+	}}
+}
+
+// assertWith answers a login challenge reporting counter.
+func (a *softAuthenticator) assertWith(challenge string, counter uint32) fiber.Map {
+	cd := clientData("webauthn.get", challenge, rp.Origin)
+	authData := a.authData(counter, false)
+	return fiber.Map{"rawId": a.rawID(), "response": fiber.Map{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(cd),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(a.sign(authData, cd)),
+	}}
+}
+
+// assert answers a login challenge, moving the counter on if the authenticator has one.
+func (a *softAuthenticator) assert(challenge string) fiber.Map {
+	if a.counts {
+		a.counter++
+	}
+	return a.assertWith(challenge, a.counter)
+}
+
+func beginPasskey(t *testing.T, path string, body any, cookies ...*http.Cookie) string {
+	t.Helper()
+	options := decode(t, request(t, "POST", path, body, cookies...), 200)
+	challenge, _ := options["challenge"].(string)
+	if challenge == "" {
+		t.Fatalf("%s returned no challenge: %v", path, options)
+	}
+	return challenge
+}
+
+// registerPasskey creates a user with a passkey on a, and returns the user's name.
+func registerPasskey(t *testing.T, a *softAuthenticator, format string) string {
+	t.Helper()
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+	challenge := beginPasskey(t, "/api/webauthn/register/begin", fiber.Map{"password": "correct horse"}, cookie)
+	decode(t, request(t, "POST", "/api/webauthn/register/finish", a.attest(challenge, format), cookie), 200)
+	return username
+}
+
+func passkeyLogin(t *testing.T, username string, body func(challenge string) fiber.Map) *http.Response {
+	t.Helper()
+	challenge := beginPasskey(t, "/api/webauthn/login/begin", fiber.Map{"username": username})
+	return request(t, "POST", "/api/webauthn/login/finish", body(challenge))
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	for _, format := range []string{"none", "packed"} {
+		t.Run(format, func(t *testing.T) {
+			a := newSoftAuthenticator(t, true)
+			username := registerPasskey(t, a, format)
+
+			resp := passkeyLogin(t, username, a.assert)
+			decode(t, resp, 200)
+			cookie := sessionCookie(resp)
+			if cookie == nil {
+				t.Fatal("passkey login did not set a session cookie")
+			}
+			passkeys := decode(t, request(t, "GET", "/api/webauthn/credentials", nil, cookie), 200)["passkeys"].([]any)
+			if len(passkeys) != 1 || passkeys[0].(map[string]any)["id"] != a.rawID() ||
+				passkeys[0].(map[string]any)["attestation_format"] != format {
+				t.Errorf("passkeys = %v", passkeys)
+			}
+
+			// Discoverable login, without a username.
+			challenge := beginPasskey(t, "/api/webauthn/login/begin", nil)
+			decode(t, request(t, "POST", "/api/webauthn/login/finish", a.assert(challenge)), 200)
+		})
+	}
+}
+
+func TestPasskeyRegistrationRequiresPassword(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+
+	decode(t, request(t, "POST", "/api/webauthn/register/begin", nil, cookie), 401)
+	decode(t, request(t, "POST", "/api/webauthn/register/begin", fiber.Map{"password": "wrong"}, cookie), 401)
+	beginPasskey(t, "/api/webauthn/register/begin", fiber.Map{"password": "correct horse"}, cookie)
+}
+
+func TestPasskeyRegistrationRejected(t *testing.T) {
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+	a := newSoftAuthenticator(t, true)
+
+	tests := map[string]func(challenge string) fiber.Map{
+		"wrong origin": func(challenge string) fiber.Map {
+			body := a.attest(challenge, "none")
+			cd := clientData("webauthn.create", challenge, "https://evil.example")
+			body["response"].(fiber.Map)["clientDataJSON"] = base64.RawURLEncoding.EncodeToString(cd)
+			return body
+		},
+		"unknown challenge": func(string) fiber.Map {
+			return a.attest(base64.RawURLEncoding.EncodeToString(randomBytes(32)), "none")
+		},
+		"packed statement signed by another key": func(challenge string) fiber.Map {
+			cd := clientData("webauthn.create", challenge, rp.Origin)
+			authData := a.authData(0, true)
+			sig := newSoftAuthenticator(t, true).sign(authData, cd)
+			obj := cborEncode([]cborPair{{"fmt", "packed"}, {"attStmt", []cborPair{{"alg", coseES256}, {"sig", sig}}}, {"authData", authData}})
+			return fiber.Map{"response": fiber.Map{
+				"clientDataJSON":    base64.RawURLEncoding.EncodeToString(cd),
+				"attestationObject": base64.RawURLEncoding.EncodeToString(obj),
+			}}
+		},
+		"name too long": func(challenge string) fiber.Map {
+			body := a.attest(challenge, "none")
+			body["name"] = strings.Repeat("é", 256)
+			return body
+		},
+		"credential ID too long": func(challenge string) fiber.Map {
+			long := newSoftAuthenticator(t, true)
+			long.id = randomBytes(maxCredentialIDLength + 1)
+			return long.attest(challenge, "none")
+		},
+	}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			challenge := beginPasskey(t, "/api/webauthn/register/begin", fiber.Map{"password": "correct horse"}, cookie)
+			decode(t, request(t, "POST", "/api/webauthn/register/finish", body(challenge), cookie), 400)
+		})
+	}
+	if passkeys := decode(t, request(t, "GET", "/api/webauthn/credentials", nil, cookie), 200)["passkeys"].([]any); len(passkeys) != 0 {
+		t.Errorf("rejected registrations stored passkeys: %v", passkeys)
+	}
+}
+
+func TestPasskeyRegisteredTwice(t *testing.T) {
+	a := newSoftAuthenticator(t, true)
+	username := registerPasskey(t, a, "none")
+	cookie := login(t, username, "correct horse")
+	challenge := beginPasskey(t, "/api/webauthn/register/begin", fiber.Map{"password": "correct horse"}, cookie)
+	decode(t, request(t, "POST", "/api/webauthn/register/finish", a.attest(challenge, "none"), cookie), 409)
+}
+
+func TestPasskeyUserVerificationRequired(t *testing.T) {
+	options := decode(t, request(t, "POST", "/api/webauthn/login/begin", nil), 200)
+	if options["userVerification"] != "required" {
+		t.Errorf("login options ask for userVerification %v", options["userVerification"])
+	}
+
+	// Registration: presence alone is not enough to enroll.
+	username := newUsername()
+	register(t, username, "correct horse")
+	cookie := login(t, username, "correct horse")
+	unverified := newSoftAuthenticator(t, true)
+	unverified.presenceOnly = true
+	challenge := beginPasskey(t, "/api/webauthn/register/begin", fiber.Map{"password": "correct horse"}, cookie)
+	decode(t, request(t, "POST", "/api/webauthn/register/finish", unverified.attest(challenge, "none"), cookie), 400)
+
+	// Login: a registered passkey that stops verifying the user does not sign in.
+	a := newSoftAuthenticator(t, true)
+	username = registerPasskey(t, a, "none")
+	a.presenceOnly = true
+	decode(t, passkeyLogin(t, username, a.assert), 401)
+	a.presenceOnly = false
+	decode(t, passkeyLogin(t, username, a.assert), 200)
+}
+
+func TestPasskeyChallengeReplay(t *testing.T) {
+	a := newSoftAuthenticator(t, true)
+	username := registerPasskey(t, a, "none")
+
+	challenge := beginPasskey(t, "/api/webauthn/login/begin", fiber.Map{"username": username})
+	decode(t, request(t, "POST", "/api/webauthn/login/finish", a.assert(challenge)), 200)
+	// The same challenge, even with a fresh counter and signature, is spent.
+	decode(t, request(t, "POST", "/api/webauthn/login/finish", a.assert(challenge)), 401)
+
+	// A registration challenge does not sign anyone in.
+	cookie := login(t, username, "correct horse")
+	regChallenge := beginPasskey(t, "/api/webauthn/register/begin", fiber.Map{"password": "correct horse"}, cookie)
+	decode(t, request(t, "POST", "/api/webauthn/login/finish", a.assert(regChallenge)), 401)
+}
+
+func TestPasskeyCounterRegression(t *testing.T) {
+	a := newSoftAuthenticator(t, true)
+	username := registerPasskey(t, a, "none")
+	decode(t, passkeyLogin(t, username, a.assert), 200)
+	decode(t, passkeyLogin(t, username, a.assert), 200)
+
+	// A clone reports a counter the original already used.
+	stale := a.counter
+	decode(t, passkeyLogin(t, username, func(challenge string) fiber.Map { return a.assertWith(challenge, stale) }), 401)
+	decode(t, passkeyLogin(t, username, func(challenge string) fiber.Map { return a.assertWith(challenge, stale-1) }), 401)
+	decode(t, passkeyLogin(t, username, a.assert), 200)
+
+	// Authenticators without a counter report zero every time.
+	fixed := newSoftAuthenticator(t, false)
+	username = registerPasskey(t, fixed, "none")
+	for i := 0; i < 3; i++ {
+		decode(t, passkeyLogin(t, username, fixed.assert), 200)
+	}
+}
+
+func TestDeleteLastPasskey(t *testing.T) {
+	a := newSoftAuthenticator(t, true)
+	username := registerPasskey(t, a, "none")
+	// A provisioned account without a password signs in only with its passkey.
+	if _, err := db.Exec("UPDATE users SET password_hash = '!' WHERE username = ?", username); err != nil {
+		t.Fatal(err)
+	}
+	resp := passkeyLogin(t, username, a.assert)
+	decode(t, resp, 200)
+	cookie := sessionCookie(resp)
+
+	path := "/api/webauthn/credentials/" + a.rawID()
+	decode(t, request(t, "DELETE", path, nil, cookie), 409)
+
+	// A linked identity is another way in, so the passkey may go.
+	_, err := db.Exec("INSERT INTO user_identities (provider, subject, username, email, created_at) VALUES ('mock', ?, ?, '', ?)",
+		username, username, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, request(t, "DELETE", path, nil, cookie), 200)
+}
+
+func TestPasskeyChallengeLimit(t *testing.T) {
+	expired := time.Now().Add(-time.Second)
+	challengesMu.Lock()
+	for len(challenges) < maxPendingChallenges {
+		challenges[generateToken()] = pendingChallenge{Ceremony: "webauthn.get", ExpiresAt: expired}
+	}
+	challengesMu.Unlock()
+	t.Cleanup(func() { expireChallenges(time.Now()) })
+
+	decode(t, request(t, "POST", "/api/webauthn/login/begin", nil), 503)
+	expireChallenges(time.Now())
+	beginPasskey(t, "/api/webauthn/login/begin", nil)
+}
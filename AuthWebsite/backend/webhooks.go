@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Account lifecycle events sent to webhook endpoints.
+const (
+	eventUserRegistered      = "user.registered"
+	eventUserLoggedIn        = "user.logged_in"
+	eventUserPasswordChanged = "user.password_changed"
+	eventUserDeleted         = "user.deleted"
+)
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+// maxDeliveriesPage bounds the limit of a delivery log listing.
+const maxDeliveriesPage = 200
+
+type webhookConfig struct {
+	Endpoints   []string
+	Secret      string
+	Events      map[string]bool // nil means every event
+	MaxAttempts int
+	BaseBackoff time.Duration
+	Client      *http.Client
+}
+
+var webhooks webhookConfig
+
+// loadWebhookConfig reads AUTH_WEBHOOK_URLS, AUTH_WEBHOOK_SECRET, AUTH_WEBHOOK_EVENTS and
+// AUTH_WEBHOOK_MAX_ATTEMPTS. Endpoints cannot be configured without a secret, since
+// receivers could not tell our deliveries from forged ones.
+func loadWebhookConfig() (webhookConfig, error) {
+	cfg := webhookConfig{
+		Secret:      envOr("AUTH_WEBHOOK_SECRET", ""),
+		MaxAttempts: 8,
+		BaseBackoff: 30 * time.Second,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, u := range strings.Split(envOr("AUTH_WEBHOOK_URLS", ""), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			cfg.Endpoints = append(cfg.Endpoints, u)
+		}
+	}
+	if events := envOr("AUTH_WEBHOOK_EVENTS", ""); events != "" {
+		cfg.Events = make(map[string]bool)
+		for _, e := range strings.Split(events, ",") {
+			cfg.Events[strings.TrimSpace(e)] = true
+		}
+	}
+	if n, err := strconv.Atoi(envOr("AUTH_WEBHOOK_MAX_ATTEMPTS", "")); err == nil && n > 0 {
+		cfg.MaxAttempts = n
+	}
+	if len(cfg.Endpoints) > 0 && cfg.Secret == "" {
+		return webhookConfig{}, errors.New("AUTH_WEBHOOK_URLS is set but AUTH_WEBHOOK_SECRET is empty")
+	}
+	return cfg, nil
+}
+
+type webhookPayload struct {
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       fiber.Map `json:"data"`
+}
+
+// emitEvent queues event for every configured endpoint. The queue lives in MySQL so
+// deliveries survive restarts; failures here are logged and never fail the request.
+func emitEvent(event string, data fiber.Map) {
+	if len(webhooks.Endpoints) == 0 || (webhooks.Events != nil && !webhooks.Events[event]) {
+		return
+	}
+	payload, err := json.Marshal(webhookPayload{Event: event, OccurredAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		log.Println("webhook payload:", err)
+		return
+	}
+	now := time.Now()
+	for _, endpoint := range webhooks.Endpoints {
+		_, err := db.Exec(`INSERT INTO webhook_deliveries (endpoint, event, payload, status, created_at, next_attempt_at)
+            VALUES (?, ?, ?, ?, ?, ?)`, endpoint, event, string(payload), deliveryPending, now, now)
+		if err != nil {
+			log.Println("queue webhook:", err)
+		}
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.body" keyed with secret.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff doubles the delay after every failed attempt, capped at six hours.
+func webhookBackoff(base time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < 6*time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, 6*time.Hour)
+}
+
+type webhookDelivery struct {
+	ID            int64      `json:"id"`
+	Endpoint      string     `json:"endpoint"`
+	Event         string     `json:"event"`
+	Payload       string     `json:"payload"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+const deliveryColumns = "id, endpoint, event, payload, status, attempts, last_error, created_at, next_attempt_at, delivered_at"
+
+func scanDelivery(row interface{ Scan(...any) error }) (webhookDelivery, error) {
+	var d webhookDelivery
+	var lastError sql.NullString
+	var deliveredAt sql.NullTime
+	err := row.Scan(&d.ID, &d.Endpoint, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+		&lastError, &d.CreatedAt, &d.NextAttemptAt, &deliveredAt)
+	d.LastError = lastError.String
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return d, err
+}
+
+// deliverWebhook POSTs one delivery and reports an error for anything but a 2xx response.
+func deliverWebhook(ctx context.Context, cfg webhookConfig, d webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Endpoint, strings.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(cfg.Secret, timestamp, []byte(d.Payload)))
+
+	resp, err := cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("endpoint returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// processWebhooks attempts every delivery that is due and records the outcome.
+func processWebhooks(ctx context.Context, cfg webhookConfig) error {
+	rows, err := db.QueryContext(ctx, "SELECT "+deliveryColumns+` FROM webhook_deliveries
+            WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT 50`, deliveryPending, time.Now())
+	if err != nil {
+		return err
+	}
+	var due []webhookDelivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		err := deliverWebhook(ctx, cfg, d)
+		attempts := d.Attempts + 1
+		switch {
+		case err == nil:
+			_, err = db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, last_error = NULL, delivered_at = ? WHERE id = ?",
+				deliveryDelivered, attempts, time.Now(), d.ID)
+		case attempts >= cfg.MaxAttempts:
+			_, err = db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, last_error = ? WHERE id = ?",
+				deliveryDead, attempts, err.Error(), d.ID)
+		default:
+			next := time.Now().Add(webhookBackoff(cfg.BaseBackoff, attempts))
+			_, err = db.Exec("UPDATE webhook_deliveries SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?",
+				attempts, err.Error(), next, d.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runWebhookWorker polls the delivery queue until ctx is cancelled.
+func runWebhookWorker(ctx context.Context, cfg webhookConfig) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := processWebhooks(ctx, cfg); err != nil && ctx.Err() == nil {
+				log.Println("webhooks:", err)
+			}
+		}
+	}
+}
+
+func listDeliveriesHandler(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 50)
+	if limit < 1 || limit > maxDeliveriesPage {
+		return c.Status(400).JSON(fiber.Map{"error": "limit must be between 1 and 200"})
+	}
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries"
+	var args []any
+	if status := c.Query("status"); status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	defer rows.Close()
+	deliveries := []webhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+		}
+		deliveries = append(deliveries, d)
+	}
+	return c.JSON(fiber.Map{"deliveries": deliveries})
+}
+
+func getDeliveryHandler(c *fiber.Ctx) error {
+	d, err := scanDelivery(db.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE id = ?", c.Params("id")))
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Delivery not found"})
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	return c.JSON(d)
+}
+
+// replayDeliveryHandler puts a delivery back in the queue, including dead-lettered ones.
+func replayDeliveryHandler(c *fiber.Ctx) error {
+	res, err := db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ?",
+		deliveryPending, time.Now(), c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB error"})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Delivery not found"})
+	}
+	audit(c.Locals("username").(string), "webhook_replay", c.IP(), c.Params("id"))
+	return c.JSON(fiber.Map{"message": "Delivery queued for replay"})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the deliveries it gets and answers with the next status
+// in statuses, repeating the last one.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	got      []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	r := &webhookReceiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.got = append(r.got, req)
+		r.bodies = append(r.bodies, body)
+		status := r.statuses[0]
+		if len(r.statuses) > 1 {
+			r.statuses = r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.got)
+}
+
+// deliverUntil runs the worker until receiver has got n deliveries. DATETIME columns
+// round to the second, so a delivery may only be due a moment after it is queued.
+func deliverUntil(t *testing.T, cfg webhookConfig, receiver *webhookReceiver, n int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for receiver.count() < n && time.Now().Before(deadline) {
+		if err := processWebhooks(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := receiver.count(); got != n {
+		t.Fatalf("receiver got %d deliveries, want %d", got, n)
+	}
+}
+
+// useWebhooks sends events to endpoint for the rest of the test.
+func useWebhooks(t *testing.T, endpoint string, maxAttempts int) webhookConfig {
+	cfg := webhookConfig{
+		Endpoints:   []string{endpoint},
+		Secret:      "test secret",
+		MaxAttempts: maxAttempts,
+		Client:      &http.Client{Timeout: 5 * time.Second},
+	}
+	saved := webhooks
+	webhooks = cfg
+	t.Cleanup(func() { webhooks = saved })
+	return cfg
+}
+
+// endpointDeliveries lists the deliveries to endpoint through the admin API.
+func endpointDeliveries(t *testing.T, admin *http.Cookie, endpoint string) []map[string]any {
+	t.Helper()
+	data := decode(t, request(t, "GET", "/api/admin/webhooks/deliveries", nil, admin), 200)
+	var result []map[string]any
+	for _, d := range data["deliveries"].([]any) {
+		if d := d.(map[string]any); d["endpoint"] == endpoint {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+func TestWebhookSignature(t *testing.T) {
+	adminCookie := admin(t)
+	receiver := newWebhookReceiver(t, 204)
+	cfg := useWebhooks(t, receiver.URL, 3)
+
+	username := newUsername()
+	register(t, username, "correct horse")
+	deliverUntil(t, cfg, receiver, 1)
+
+	req, body := receiver.got[0], receiver.bodies[0]
+	if req.Header.Get("X-Webhook-Event") != eventUserRegistered {
+		t.Errorf("X-Webhook-Event = %q", req.Header.Get("X-Webhook-Event"))
+	}
+	timestamp := req.Header.Get("X-Webhook-Timestamp")
+	if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(ts, 0)) > time.Minute {
+		t.Errorf("X-Webhook-Timestamp = %q", timestamp)
+	}
+	want := "sha256=" + signWebhook(cfg.Secret, timestamp, body)
+	if got := req.Header.Get("X-Webhook-Signature"); got != want {
+		t.Errorf("X-Webhook-Signature = %q, want %q", got, want)
+	}
+	if forged := signWebhook("other secret", timestamp, body); "sha256="+forged == want {
+		t.Error("signature does not depend on the secret")
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != eventUserRegistered || payload.Data["username"] != username {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	deliveries := endpointDeliveries(t, adminCookie, receiver.URL)
+	if len(deliveries) != 1 || deliveries[0]["status"] != deliveryDelivered || deliveries[0]["attempts"] != 1.0 {
+		t.Errorf("delivery log = %v", deliveries)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	adminCookie := admin(t)
+	receiver := newWebhookReceiver(t, 500, 503, 200)
+	cfg := useWebhooks(t, receiver.URL, 5)
+
+	register(t, newUsername(), "correct horse")
+	for i := 1; i <= 3; i++ {
+		deliverUntil(t, cfg, receiver, i)
+		deliveries := endpointDeliveries(t, adminCookie, receiver.URL)
+		if len(deliveries) != 1 {
+			t.Fatalf("delivery log = %v", deliveries)
+		}
+		d := deliveries[0]
+		if d["attempts"] != float64(i) {
+			t.Errorf("run %d: attempts = %v", i, d["attempts"])
+		}
+		if i < 3 && (d["status"] != deliveryPending || !strings.Contains(d["last_error"].(string), "50")) {
+			t.Errorf("run %d: failed delivery = %v", i, d)
+		}
+		if i == 3 && (d["status"] != deliveryDelivered || d["last_error"] != nil || d["delivered_at"] == nil) {
+			t.Errorf("delivered delivery = %v", d)
+		}
+	}
+
+	// Every attempt carries the same body.
+	for _, body := range receiver.bodies[1:] {
+		if string(body) != string(receiver.bodies[0]) {
+			t.Errorf("retry body %s differs from %s", body, receiver.bodies[0])
+		}
+	}
+}
+
+func TestWebhookDeadLetterAndReplay(t *testing.T) {
+	adminCookie := admin(t)
+	receiver := newWebhookReceiver(t, 500, 500, 200)
+	cfg := useWebhooks(t, receiver.URL, 2)
+
+	register(t, newUsername(), "correct horse")
+	deliverUntil(t, cfg, receiver, 2)
+	// A dead delivery is not attempted again.
+	time.Sleep(time.Second)
+	if err := processWebhooks(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := receiver.count(); n != 2 {
+		t.Fatalf("receiver got %d deliveries after the delivery was dead-lettered", n)
+	}
+	deliveries := endpointDeliveries(t, adminCookie, receiver.URL)
+	if len(deliveries) != 1 || deliveries[0]["status"] != deliveryDead {
+		t.Fatalf("delivery log = %v", deliveries)
+	}
+
+	id := strconv.Itoa(int(deliveries[0]["id"].(float64)))
+	decode(t, request(t, "POST", "/api/admin/webhooks/deliveries/"+id+"/replay", nil, adminCookie), 200)
+	deliverUntil(t, cfg, receiver, 3)
+	d := decode(t, request(t, "GET", "/api/admin/webhooks/deliveries/"+id, nil, adminCookie), 200)
+	if d["status"] != deliveryDelivered || d["attempts"] != 1.0 {
+		t.Errorf("replayed delivery = %v", d)
+	}
+}
+
+func TestWebhookConfigRequiresSecret(t *testing.T) {
+	t.Setenv("AUTH_WEBHOOK_URLS", "https://hooks.example.com/auth")
+	t.Setenv("AUTH_WEBHOOK_SECRET", "")
+	if _, err := loadWebhookConfig(); err == nil {
+		t.Error("endpoints without a secret were accepted")
+	}
+
+	t.Setenv("AUTH_WEBHOOK_SECRET", "s3cret")
+	cfg, err := loadWebhookConfig()
+	if err != nil || len(cfg.Endpoints) != 1 {
+		t.Errorf("loadWebhookConfig() = %+v, %v", cfg, err)
+	}
+
+	t.Setenv("AUTH_WEBHOOK_URLS", "")
+	t.Setenv("AUTH_WEBHOOK_SECRET", "")
+	if _, err := loadWebhookConfig(); err != nil {
+		t.Errorf("no endpoints and no secret: %v", err)
+	}
+}
+
+func TestListDeliveriesLimit(t *testing.T) {
+	adminCookie := admin(t)
+	for _, limit := range []string{"0", "-1", "201", "1000000"} {
+		decode(t, request(t, "GET", "/api/admin/webhooks/deliveries?limit="+limit, nil, adminCookie), 400)
+	}
+	for _, limit := range []string{"1", "200"} {
+		decode(t, request(t, "GET", "/api/admin/webhooks/deliveries?limit="+limit, nil, adminCookie), 200)
+	}
+}
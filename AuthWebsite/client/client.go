@@ -0,0 +1,323 @@
+// Package client is a typed Go client for the AuthWebsite HTTP API.
+//
+// A Client keeps the session cookie set by Login in its cookie jar, so later calls
+// on the same Client are authenticated:
+//
+//	c, _ := client.New("http://localhost:8080")
+//	if err := c.Login(ctx, client.LoginRequest{Username: "ada", Password: "secret"}); err != nil {
+//		if errors.Is(err, client.ErrInvalidCredentials) { ... }
+//	}
+//	profile, err := c.Profile(ctx)
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"math/rand/v2"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the API of one AuthWebsite server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	http       *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient makes the Client send requests through hc. A cookie jar is added
+// if hc has none.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithRetries sets how often idempotent calls are retried after network errors or
+// 429/502/503/504 responses, and the initial backoff between attempts.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.maxRetries, c.backoff = n, backoff }
+}
+
+// New returns a Client for the server at baseURL, e.g. "https://auth.example.com".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		http:       &http.Client{Timeout: 30 * time.Second},
+		maxRetries: 3,
+		backoff:    200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.http.Jar == nil {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		c.http.Jar = jar
+	}
+	return c, nil
+}
+
+// RegisterRequest is the body of POST /api/register.
+type RegisterRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	InviteCode string `json:"invite_code,omitempty"`
+	// AcceptedPolicies maps each current policy's kind to its version, see Policies.
+	AcceptedPolicies map[string]string `json:"accepted_policies,omitempty"`
+}
+
+// LoginRequest is the body of POST /api/login.
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// ProfileFields are the user-editable parts of an account.
+type ProfileFields struct {
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email"`
+	AvatarURL   string `json:"avatar_url"`
+	Locale      string `json:"locale"`
+	Timezone    string `json:"timezone"`
+}
+
+// Organization is the session's active organization and the user's role in it.
+type Organization struct {
+	ID   int64  `json:"id"`
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// Impersonation is set when an admin is acting as the user.
+type Impersonation struct {
+	Impersonator string    `json:"impersonator"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Profile is the response of GET /api/profile.
+type Profile struct {
+	Message       string         `json:"message"`
+	Username      string         `json:"username"`
+	Profile       ProfileFields  `json:"profile"`
+	Organization  *Organization  `json:"organization"`
+	Impersonation *Impersonation `json:"impersonation"`
+}
+
+// Policy is a version of the terms of service or privacy policy.
+type Policy struct {
+	Kind        string    `json:"kind"`
+	Version     string    `json:"version"`
+	Title       string    `json:"title"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+type messageResponse struct {
+	Message string `json:"message"`
+}
+
+type powChallenge struct {
+	Required   bool   `json:"required"`
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+}
+
+// Register creates an account, solving the server's proof-of-work challenge first.
+func (c *Client) Register(ctx context.Context, req RegisterRequest) error {
+	var pow powChallenge
+	if err := c.do(ctx, http.MethodGet, "/api/register/challenge", nil, &pow, true); err != nil {
+		return err
+	}
+	body := struct {
+		RegisterRequest
+		Challenge string `json:"pow_challenge,omitempty"`
+		Nonce     string `json:"pow_nonce,omitempty"`
+	}{RegisterRequest: req}
+	if pow.Required {
+		nonce, err := solve(ctx, pow.Challenge, pow.Difficulty)
+		if err != nil {
+			return err
+		}
+		body.Challenge, body.Nonce = pow.Challenge, nonce
+	}
+	return c.do(ctx, http.MethodPost, "/api/register", body, &messageResponse{}, false)
+}
+
+// Policies returns the policies in effect, which Register and AcceptPolicies must
+// accept in these versions.
+func (c *Client) Policies(ctx context.Context) ([]Policy, error) {
+	var resp struct {
+		Policies []Policy `json:"policies"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/policies", nil, &resp, true); err != nil {
+		return nil, err
+	}
+	return resp.Policies, nil
+}
+
+// AcceptPolicies records the signed-in user's consent to new policy versions, which
+// is needed after calls fail with ErrConsentRequired.
+func (c *Client) AcceptPolicies(ctx context.Context, accepted map[string]string) error {
+	body := struct {
+		Accepted map[string]string `json:"accepted_policies"`
+	}{accepted}
+	return c.do(ctx, http.MethodPost, "/api/consent", body, &messageResponse{}, true)
+}
+
+// Login signs in and stores the session cookie in the Client's jar.
+func (c *Client) Login(ctx context.Context, req LoginRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/login", req, &messageResponse{}, false)
+}
+
+// Profile returns the signed-in user's profile.
+func (c *Client) Profile(ctx context.Context) (*Profile, error) {
+	var p Profile
+	if err := c.do(ctx, http.MethodGet, "/api/profile", nil, &p, true); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ChangePassword replaces the signed-in user's password. It is the only call that
+// succeeds while the password is expired (ErrPasswordExpired).
+func (c *Client) ChangePassword(ctx context.Context, current, next string) error {
+	body := struct {
+		Current string `json:"current_password"`
+		New     string `json:"new_password"`
+	}{current, next}
+	return c.do(ctx, http.MethodPost, "/api/account/password", body, &messageResponse{}, false)
+}
+
+// StepUp confirms the session with the password after the server answered
+// ErrStepUpRequired because the client's network changed.
+func (c *Client) StepUp(ctx context.Context, password string) error {
+	body := struct {
+		Password string `json:"password"`
+	}{password}
+	return c.do(ctx, http.MethodPost, "/api/session/step-up", body, &messageResponse{}, false)
+}
+
+// Logout ends the session. Repeating it is harmless, so it is retried like a GET.
+func (c *Client) Logout(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/logout", nil, &messageResponse{}, true)
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// do sends a JSON request and decodes a 2xx response into out. Idempotent calls are
+// retried with exponential backoff and jitter.
+func (c *Client) do(ctx context.Context, method, path string, in, out any, idempotent bool) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	attempts := 1
+	if idempotent {
+		attempts += c.maxRetries
+	}
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := c.backoff << (attempt - 1)
+			delay += rand.N(delay/2 + 1)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var retry bool
+		retry, lastErr = c.attempt(ctx, method, path, payload, out)
+		if !retry {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// attempt performs one request and reports whether a failure is worth retrying.
+func (c *Client) attempt(ctx context.Context, method, path string, payload []byte, out any) (bool, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return false, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(data, &e)
+		if e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return retryable(resp.StatusCode), &APIError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return false, fmt.Errorf("authwebsite: decoding %s response: %w", path, err)
+	}
+	return false, nil
+}
+
+// solve finds a nonce such that SHA-256(challenge + ":" + nonce) starts with
+// difficulty zero bits.
+func solve(ctx context.Context, challenge string, difficulty int) (string, error) {
+	for nonce := 0; ; nonce++ {
+		if nonce%4096 == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		candidate := strconv.Itoa(nonce)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+candidate))) >= difficulty {
+			return candidate, nil
+		}
+	}
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors matched by APIError through errors.Is.
+var (
+	ErrInvalidRequest        = errors.New("invalid request")
+	ErrInvalidCredentials    = errors.New("invalid credentials")
+	ErrUnauthorized          = errors.New("unauthorized")
+	ErrForbidden             = errors.New("forbidden")
+	ErrRegistrationClosed    = errors.New("registration is closed")
+	ErrInvitationRequired    = errors.New("invitation code required")
+	ErrInvalidInvitation     = errors.New("invitation code is invalid")
+	ErrRegistrationFailed    = errors.New("user already exists or could not be stored")
+	ErrInvalidProof          = errors.New("proof of work rejected")
+	ErrInvalidUsername       = errors.New("username is not allowed")
+	ErrUsernameReserved      = errors.New("username is reserved")
+	ErrUsernameConfusable    = errors.New("username is too similar to an existing account")
+	ErrUsernameTaken         = errors.New("username is already taken")
+	ErrAccountDisabled       = errors.New("account is disabled")
+	ErrPasswordResetRequired = errors.New("password reset required")
+	ErrPasswordExpired       = errors.New("password expired")
+	ErrPasswordReused        = errors.New("password was used recently")
+	ErrConsentRequired       = errors.New("the current policies must be accepted")
+	ErrStepUpRequired        = errors.New("the session must be confirmed with the password")
+	ErrServer                = errors.New("server error")
+)
+
+// serverMessages maps the "error" strings of the API onto the errors above.
+var serverMessages = map[string]error{
+	"Invalid request":        ErrInvalidRequest,
+	"Invalid credentials":    ErrInvalidCredentials,
+	"Unauthorized":           ErrUnauthorized,
+	"Forbidden":              ErrForbidden,
+	"Registration is closed": ErrRegistrationClosed,
+	"An invitation code is required to register":     ErrInvitationRequired,
+	"Invitation code is invalid, expired or used up": ErrInvalidInvitation,
+	"User already exists or DB error":                ErrRegistrationFailed,
+	"Proof of work is missing, invalid or expired":   ErrInvalidProof,
+	"Invalid username":                               ErrInvalidUsername,
+	"Username is reserved":                           ErrUsernameReserved,
+	"Username is too similar to an existing account": ErrUsernameConfusable,
+	"Username is already taken":                      ErrUsernameTaken,
+	"Account is disabled":                            ErrAccountDisabled,
+	"Password reset required":                        ErrPasswordResetRequired,
+	"Password expired":                               ErrPasswordExpired,
+	"Password was used recently":                     ErrPasswordReused,
+	"Consent required":                               ErrConsentRequired,
+	"Re-authentication required":                     ErrStepUpRequired,
+}
+
+// APIError is a non-2xx response from the API.
+type APIError struct {
+	StatusCode int
+	Message    string // the response's "error" field
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("authwebsite: %d %s", e.StatusCode, e.Message)
+}
+
+// Unwrap lets errors.Is compare an APIError with the package's error values.
+func (e *APIError) Unwrap() error {
+	if err, ok := serverMessages[e.Message]; ok {
+		return err
+	}
+	switch {
+	case e.StatusCode == 401:
+		return ErrUnauthorized
+	case e.StatusCode == 403:
+		return ErrForbidden
+	case e.StatusCode >= 500:
+		return ErrServer
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+const methods = ['get', 'post', 'put', 'patch', 'delete'];
+let spec;
+
+function el(tag, attrs = {}, ...children) {
+  const e = document.createElement(tag);
+  Object.assign(e, attrs);
+  e.append(...children.filter((c) => c != null));
+  return e;
+}
+
+function resolve(obj) {
+  while (obj && obj.$ref) {
+    obj = obj.$ref.slice(2).split('/').reduce((o, key) => o[key], spec);
+  }
+  return obj;
+}
+
+// expand inlines $refs so that schemas can be shown as one example-like tree.
+function expand(schema, depth = 0) {
+  if (schema && schema.$ref && depth > 6) return { $ref: schema.$ref };
+  schema = resolve(schema);
+  if (!schema || typeof schema !== 'object') return schema;
+  const out = Array.isArray(schema) ? [] : {};
+  for (const [key, value] of Object.entries(schema)) {
+    out[key] = typeof value === 'object' ? expand(value, depth + 1) : value;
+  }
+  return out;
+}
+
+function bodySection(title, body) {
+  body = resolve(body);
+  if (!body || !body.content) return null;
+  return el('div', {},
+    el('h4', { textContent: title }),
+    ...Object.entries(body.content).map(([type, media]) =>
+      el('div', {}, el('code', { textContent: type }),
+        el('pre', { textContent: JSON.stringify(expand(media.schema), null, 2) }))));
+}
+
+function operation(path, method, op) {
+  const secured = (op.security ?? spec.security ?? []).length > 0;
+  const params = [...(spec.paths[path].parameters ?? []), ...(op.parameters ?? [])].map(resolve);
+  const rows = Object.entries(op.responses ?? {}).map(([code, r]) =>
+    el('tr', {}, el('td', {}, el('code', { textContent: code })), el('td', { textContent: resolve(r).description ?? '' })));
+
+  return el('details', { className: 'op' },
+    el('summary', {},
+      el('span', { className: 'method ' + method, textContent: method }), path,
+      el('span', { className: 'summary', textContent: op.summary ?? '' }),
+      secured ? el('span', { className: 'lock', title: 'Requires authentication', textContent: ' 🔒' }) : null),
+    el('div', {},
+      op.description ? el('p', { textContent: op.description }) : null,
+      params.length ? el('div', {}, el('h4', { textContent: 'Parameters' }),
+        el('table', {}, ...params.map((p) => el('tr', {},
+          el('td', {}, el('code', { textContent: p.name })),
+          el('td', { textContent: p.in + (p.required ? ', required' : '') }),
+          el('td', { textContent: p.description ?? resolve(p.schema)?.type ?? '' }))))) : null,
+      bodySection('Request body', op.requestBody),
+      el('h4', { textContent: 'Responses' }), el('table', {}, ...rows),
+      ...Object.entries(op.responses ?? {}).filter(([code]) => code.startsWith('2'))
+        .map(([code, r]) => bodySection(code + ' response', r))));
+}
+
+async function load() {
+  spec = await (await fetch('/api/openapi.json')).json();
+  document.getElementById('title').append(' ', el('small', { textContent: 'v' + spec.info.version }));
+  document.getElementById('description').textContent = spec.info.description ?? '';
+
+  const byTag = new Map((spec.tags ?? []).map((t) => [t.name, { tag: t, ops: [] }]));
+  for (const [path, item] of Object.entries(spec.paths)) {
+    for (const method of methods) {
+      if (!item[method]) continue;
+      const name = item[method].tags?.[0] ?? 'other';
+      if (!byTag.has(name)) byTag.set(name, { tag: { name }, ops: [] });
+      byTag.get(name).ops.push(operation(path, method, item[method]));
+    }
+  }
+
+  const main = document.getElementById('ops');
+  main.textContent = '';
+  for (const { tag, ops } of byTag.values()) {
+    if (!ops.length) continue;
+    main.append(el('section', {}, el('h2', { textContent: tag.name }),
+      tag.description ? el('p', { textContent: tag.description }) : null, ...ops));
+  }
+}
+
+load().catch((err) => {
+  document.getElementById('ops').textContent = 'Could not load the API description: ' + err;
+});